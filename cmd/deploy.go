@@ -17,11 +17,15 @@ limitations under the License.
 package cmd
 
 import (
+	"bufio"
 	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
 
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/ecs"
-	"github.com/aws/smithy-go/logging"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
 	"github.com/shipatlas/ecs-toolkit/pkg"
 	"github.com/shipatlas/ecs-toolkit/utils"
 	"github.com/spf13/cobra"
@@ -30,10 +34,16 @@ import (
 )
 
 type deployOptions struct {
-	imageTag      string
-	skipTasks     bool
-	skipTasksPre  bool
-	skipTasksPost bool
+	annotate        []string
+	annotations     map[string]string
+	imageTag        string
+	logsEndpointURL string
+	maxParallel     int
+	skipTasks       bool
+	skipTasksPre    bool
+	skipTasksPost   bool
+	taskLogs        bool
+	taskLogsTail    int
 }
 
 var (
@@ -52,7 +62,19 @@ var (
 		ecs-toolkit deploy --image-tag=5a853f72 --skip-pre-tasks
 		
 		# Deploy new revision of an application but skip only post-deployment tasks
-		ecs-toolkit deploy --image-tag=5a853f72 --skip-post-tasks`)
+		ecs-toolkit deploy --image-tag=5a853f72 --skip-post-tasks
+		
+		# Deploy new revision of an application and stream the logs of tasks
+		# while watching them, including the last 50 lines if a task fails
+		ecs-toolkit deploy --image-tag=5a853f72 --task-logs --task-logs-tail=50
+		
+		# Deploy new revision of an application but only deploy two services or
+		# tasks at a time
+		ecs-toolkit deploy --image-tag=5a853f72 --max-parallel=2
+		
+		# Deploy new revision of an application and tag the task definitions and
+		# services with extra deployment metadata
+		ecs-toolkit deploy --image-tag=5a853f72 --annotate=ticket=OPS-123`)
 
 	deployCmdOptions = &deployOptions{}
 )
@@ -82,6 +104,11 @@ func init() {
 	deployCmd.Flags().BoolVar(&deployCmdOptions.skipTasks, "skip-tasks", false, "skips both pre-deployment & post-deployment tasks")
 	deployCmd.Flags().BoolVar(&deployCmdOptions.skipTasksPre, "skip-pre-tasks", false, "skip only pre-deployment tasks")
 	deployCmd.Flags().BoolVar(&deployCmdOptions.skipTasksPost, "skip-post-tasks", false, "skip only post-deployment tasks")
+	deployCmd.Flags().BoolVar(&deployCmdOptions.taskLogs, "task-logs", false, "stream container logs from cloudwatch logs while watching tasks")
+	deployCmd.Flags().IntVar(&deployCmdOptions.taskLogsTail, "task-logs-tail", 20, "number of most recent container log lines to report when a task fails")
+	deployCmd.Flags().StringVar(&deployCmdOptions.logsEndpointURL, "logs-endpoint-url", "", "custom endpoint url for cloudwatch logs")
+	deployCmd.Flags().IntVar(&deployCmdOptions.maxParallel, "max-parallel", 0, "maximum number of services or tasks to deploy at the same time, 0 for no limit")
+	deployCmd.Flags().StringArrayVar(&deployCmdOptions.annotate, "annotate", []string{}, "key=value tag to add to the task definitions and services deployed, can be set more than once")
 
 	// Configure required flags, applying to this specific command.
 	deployCmd.MarkFlagRequired("image-tag")
@@ -91,40 +118,139 @@ func (options *deployOptions) validate() {
 	if options.imageTag == "" {
 		log.Fatal("image-tag flag must be set and should not be blank")
 	}
+
+	if options.taskLogsTail < 0 {
+		log.Fatal("task-logs-tail flag should not be negative")
+	}
+
+	if options.maxParallel < 0 {
+		log.Fatal("max-parallel flag should not be negative")
+	}
+
+	options.annotations = map[string]string{}
+	for _, annotation := range options.annotate {
+		key, value, ok := strings.Cut(annotation, "=")
+		if !ok || key == "" {
+			log.Fatalf("annotate flag should be in the form key=value, got %q", annotation)
+		}
+		if err := pkg.ValidateTagKey(key); err != nil {
+			log.Fatalf("annotate flag key is invalid: %v", err)
+		}
+
+		options.annotations[key] = value
+	}
 }
 
 func (options *deployOptions) run() {
-	awsLogger := logging.LoggerFunc(func(classification logging.Classification, format string, v ...interface{}) {
-		switch classification {
-		case logging.Debug:
-			log.Debug(format)
-		case logging.Warn:
-			log.Warn(format)
+	// Custom endpoint for CloudWatch Logs takes precedence over the one in the
+	// config file. Copy the endpoints to avoid modifying the config.
+	awsConfig := awsConfigWithFlags(toolConfig.AWS)
+	if options.logsEndpointURL != "" {
+		awsConfig.Endpoints = map[string]string{}
+		for service, url := range toolConfig.AWS.Endpoints {
+			awsConfig.Endpoints[service] = url
+		}
+		awsConfig.Endpoints["logs"] = options.logsEndpointURL
+	}
+
+	// Log the progress of the deployment and set up delivery of deployment
+	// events to webhooks.
+	emitter := pkg.NewEventEmitter()
+	emitter.Subscribe(pkg.NewLogObserver(log.NewEntry(log.StandardLogger())))
+	notifiers := []*pkg.WebhookNotifier{}
+	for index := range toolConfig.Webhooks {
+		notifier, err := pkg.NewWebhookNotifier(&toolConfig.Webhooks[index])
+		if err != nil {
+			log.Fatalf("unable to set up webhook: %v", err)
 		}
+
+		emitter.Subscribe(notifier)
+		notifiers = append(notifiers, notifier)
+	}
+
+	// Canaries with manual promotion are promoted at the prompt.
+	canaryPromoter := newCanaryPrompt()
+
+	err := toolConfig.DeployTargets(func(target *pkg.Target, logger *log.Entry) error {
+		return options.deployTarget(target, target.AWSConfig(awsConfig), emitter, canaryPromoter, logger)
 	})
 
-	awsCfg, err := config.LoadDefaultConfig(context.TODO(), config.WithLogger(awsLogger))
+	// Make sure all events have been delivered before exiting.
+	for _, notifier := range notifiers {
+		notifier.Close()
+	}
+
 	if err != nil {
-		log.Fatalf("unable to load aws config: %v", err)
+		log.Fatal("error deploying application, exiting!")
 	}
-	client := ecs.NewFromConfig(awsCfg)
+}
 
-	if !options.skipTasks && !options.skipTasksPre {
-		err = toolConfig.DeployTasks(&options.imageTag, pkg.TaskStagePre, client)
-		if err != nil {
-			log.Fatal("error deploying pre-deployment tasks, exiting!")
+func (options *deployOptions) deployTarget(target *pkg.Target, awsConfig pkg.AWS, observer pkg.DeploymentObserver, canaryPromoter pkg.CanaryPromoter, logger *log.Entry) error {
+	// Each target gets its own clients since targets can be in different
+	// regions or even accounts, this also means new task definitions are
+	// registered in each target's region.
+	awsCfg, err := loadAWSConfig(awsConfig, logger)
+	if err != nil {
+		logger.Errorf("unable to load aws config: %v", err)
+
+		return err
+	}
+
+	deployerOptions := []pkg.DeployerOption{
+		pkg.WithCanaryPromoter(canaryPromoter),
+		pkg.WithMaxConcurrency(options.maxParallel),
+		pkg.WithObserver(observer),
+	}
+	if options.taskLogs {
+		taskLogs := &pkg.TaskLogsOptions{
+			Client: cloudwatchlogs.NewFromConfig(awsCfg),
+			Tail:   options.taskLogsTail,
 		}
+		deployerOptions = append(deployerOptions, pkg.WithTaskLogs(taskLogs))
 	}
 
-	err = toolConfig.DeployServices(&options.imageTag, client)
+	deployer, err := newDeployer(awsCfg, deployerOptions...)
 	if err != nil {
-		log.Fatal("error deploying services, exiting!")
+		logger.Errorf("unable to set up deployer: %v", err)
+
+		return err
 	}
 
-	if !options.skipTasks && !options.skipTasksPost {
-		err = toolConfig.DeployTasks(&options.imageTag, pkg.TaskStagePost, client)
+	deployInput := &pkg.DeployInput{
+		ImageTag:      options.imageTag,
+		Target:        target,
+		SkipPreTasks:  options.skipTasks || options.skipTasksPre,
+		SkipPostTasks: options.skipTasks || options.skipTasksPost,
+		Annotations:   options.annotations,
+	}
+	_, err = deployer.Deploy(context.Background(), deployInput)
+
+	return err
+}
+
+// newCanaryPrompt asks whether to promote canaries with manual promotion, one
+// canary at a time since services are deployed in parallel. Canaries are not
+// promoted unless running in a terminal.
+func newCanaryPrompt() pkg.CanaryPromoter {
+	var mutex sync.Mutex
+	reader := bufio.NewReader(os.Stdin)
+
+	return pkg.CanaryPromoterFunc(func(ctx context.Context, canary *pkg.PendingCanary) (bool, error) {
+		stat, err := os.Stdin.Stat()
+		if err != nil || stat.Mode()&os.ModeCharDevice == 0 {
+			return false, errors.New("not running in a terminal")
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		fmt.Fprintf(os.Stderr, "Promote canary %s to service %s in cluster %s? [y/N] ", canary.CanaryService, canary.Service, canary.Cluster)
+		answer, err := reader.ReadString('\n')
 		if err != nil {
-			log.Fatal("error deploying post-deployment tasks, exiting!")
+			return false, err
 		}
-	}
+		answer = strings.ToLower(strings.TrimSpace(answer))
+
+		return answer == "y" || answer == "yes", nil
+	})
 }
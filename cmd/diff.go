@@ -0,0 +1,191 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/shipatlas/ecs-toolkit/pkg"
+	"github.com/shipatlas/ecs-toolkit/utils"
+	"github.com/spf13/cobra"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type diffOptions struct {
+	imageTag string
+	service  string
+}
+
+var (
+	diffCmdLong = utils.LongDesc(`
+		Compare two revisions of a task definition, or the task definition a
+		service currently uses with the one the next deployment would register,
+		listing the changes to the task definition and each of its containers`)
+
+	diffCmdExamples = utils.Examples(`
+		# Compare two revisions of a task definition
+		ecs-toolkit diff app-web-server:103 app-web-server:104
+
+		# Compare the task definition of a service with the one deploying a new
+		# image tag would register
+		ecs-toolkit diff --service=app-web-server --image-tag=5a853f72`)
+
+	diffCmdOptions = &diffOptions{}
+)
+
+// diffCmd represents the diff command
+var diffCmd = &cobra.Command{
+	Use:     "diff [<family>:<revision> <family>:<revision>]",
+	Short:   "Compare task definition revisions.",
+	Long:    diffCmdLong,
+	Example: diffCmdExamples,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if diffCmdOptions.service != "" {
+			return cobra.NoArgs(cmd, args)
+		}
+
+		return cobra.ExactArgs(2)(cmd, args)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		diffCmdOptions.validate()
+		diffCmdOptions.run(args)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+
+	// Local flags, which, will be global for the application.
+	diffCmd.Flags().StringVar(&diffCmdOptions.service, "service", "", "service to compare with the next deployment")
+	diffCmd.Flags().StringVarP(&diffCmdOptions.imageTag, "image-tag", "t", "", "image tag the next deployment would use, required with --service")
+}
+
+func (options *diffOptions) validate() {
+	if options.service != "" && options.imageTag == "" {
+		log.Fatal("image-tag flag is required with service flag")
+	}
+
+	if options.service == "" && options.imageTag != "" {
+		log.Fatal("image-tag flag is only used with service flag")
+	}
+}
+
+func (options *diffOptions) run(args []string) {
+	if options.service == "" {
+		options.runTaskDefinitions(args[0], args[1])
+
+		return
+	}
+
+	awsConfig := awsConfigWithFlags(toolConfig.AWS)
+
+	failed := false
+	targets := toolConfig.DeploymentTargets()
+	for index := range targets {
+		target := &targets[index]
+		logger := log.WithField("cluster", target.Cluster)
+		if target.Region != nil {
+			logger = logger.WithField("region", *target.Region)
+		}
+
+		awsCfg, err := loadAWSConfig(target.AWSConfig(awsConfig), logger)
+		if err != nil {
+			logger.Errorf("unable to load aws config: %v", err)
+			failed = true
+
+			continue
+		}
+
+		deployer, err := newDeployer(awsCfg)
+		if err != nil {
+			logger.Errorf("unable to set up deployer: %v", err)
+			failed = true
+
+			continue
+		}
+
+		diffServiceInput := &pkg.DiffServiceInput{
+			Target:   target,
+			Service:  options.service,
+			ImageTag: options.imageTag,
+		}
+		diff, err := deployer.DiffService(context.Background(), diffServiceInput)
+		if err != nil {
+			logger.Errorf("unable to compare task definitions: %v", err)
+			failed = true
+
+			continue
+		}
+
+		printDiff(diff)
+	}
+
+	if failed {
+		log.Fatal("error comparing task definitions, exiting!")
+	}
+}
+
+// runTaskDefinitions compares two revisions with the AWS config of the first
+// target, the revisions are the same whichever target uses them.
+func (options *diffOptions) runTaskDefinitions(from string, to string) {
+	awsConfig := awsConfigWithFlags(toolConfig.AWS)
+
+	targets := toolConfig.DeploymentTargets()
+	target := &targets[0]
+	logger := log.WithField("cluster", target.Cluster)
+	if target.Region != nil {
+		logger = logger.WithField("region", *target.Region)
+	}
+
+	awsCfg, err := loadAWSConfig(target.AWSConfig(awsConfig), logger)
+	if err != nil {
+		logger.Fatalf("unable to load aws config: %v", err)
+	}
+
+	deployer, err := newDeployer(awsCfg)
+	if err != nil {
+		logger.Fatalf("unable to set up deployer: %v", err)
+	}
+
+	diff, err := deployer.DiffTaskDefinitions(context.Background(), from, to)
+	if err != nil {
+		logger.Fatalf("unable to compare task definitions: %v", err)
+	}
+
+	printDiff(diff)
+}
+
+func printDiff(diff *pkg.TaskDefinitionDiff) {
+	to := diff.To
+	if to == "" {
+		to = "(next deployment)"
+	}
+
+	fmt.Printf("--- %s\n", diff.From)
+	fmt.Printf("+++ %s\n", to)
+	if len(diff.Changes) == 0 {
+		fmt.Println("no changes")
+
+		return
+	}
+
+	for _, change := range diff.Changes {
+		fmt.Println(change.String())
+	}
+}
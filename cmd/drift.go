@@ -0,0 +1,134 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+
+	"github.com/shipatlas/ecs-toolkit/pkg"
+	"github.com/shipatlas/ecs-toolkit/utils"
+	"github.com/spf13/cobra"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	driftCmdLong = utils.LongDesc(`
+		Check that the services and tasks in the config match what's in the
+		cluster, exiting with a non-zero status if they don't. The services and
+		task definitions must exist, the task definitions must have all the
+		containers in the config, the containers of each service must be on the
+		same image tag and no service may have been updated outside of
+		ecs-toolkit since it was last deployed`)
+
+	driftCmdExamples = utils.Examples(`
+		# Check the application for drift
+		ecs-toolkit drift`)
+)
+
+// driftCmd represents the drift command
+var driftCmd = &cobra.Command{
+	Use:     "drift",
+	Short:   "Check an application for drift between the config and the cluster.",
+	Long:    driftCmdLong,
+	Example: driftCmdExamples,
+	Args: func(cmd *cobra.Command, args []string) error {
+		err := cobra.NoArgs(cmd, args)
+
+		return err
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		runDrift()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(driftCmd)
+}
+
+func runDrift() {
+	awsConfig := awsConfigWithFlags(toolConfig.AWS)
+
+	failed := false
+	drifted := false
+	targets := toolConfig.DeploymentTargets()
+	for index := range targets {
+		target := &targets[index]
+		logger := log.WithField("cluster", target.Cluster)
+		if target.Region != nil {
+			logger = logger.WithField("region", *target.Region)
+		}
+
+		awsCfg, err := loadAWSConfig(target.AWSConfig(awsConfig), logger)
+		if err != nil {
+			logger.Errorf("unable to load aws config: %v", err)
+			failed = true
+
+			continue
+		}
+
+		deployer, err := newDeployer(awsCfg)
+		if err != nil {
+			logger.Errorf("unable to set up deployer: %v", err)
+			failed = true
+
+			continue
+		}
+
+		result, err := deployer.Drift(context.Background(), &pkg.DriftInput{Target: target})
+		if err != nil {
+			logger.Errorf("unable to check for drift: %v", err)
+			failed = true
+
+			continue
+		}
+
+		for _, service := range result.Unverified {
+			logger.WithField("service", service).Warn("unable to check for updates outside of ecs-toolkit, service not deployed by it yet")
+		}
+
+		for _, drift := range result.Drifts {
+			driftSublogger := logger.WithField("drift", drift.Type)
+			if drift.Service != "" {
+				driftSublogger = driftSublogger.WithField("service", drift.Service)
+			}
+			if drift.Task != "" {
+				driftSublogger = driftSublogger.WithField("task", drift.Task)
+			}
+			if drift.Container != "" {
+				driftSublogger = driftSublogger.WithField("container", drift.Container)
+			}
+			driftSublogger.Error(drift.Message)
+		}
+
+		if len(result.Drifts) > 0 {
+			logger.Errorf("drift report - total: %d", len(result.Drifts))
+			drifted = true
+
+			continue
+		}
+		logger.Info("no drift found")
+	}
+
+	if failed {
+		log.Fatal("error checking for drift, exiting!")
+	}
+
+	if drifted {
+		log.Fatal("drift found, exiting!")
+	}
+}
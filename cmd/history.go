@@ -0,0 +1,186 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/shipatlas/ecs-toolkit/pkg"
+	"github.com/shipatlas/ecs-toolkit/utils"
+	"github.com/spf13/cobra"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type historyOptions struct {
+	limit    int
+	services []string
+}
+
+var (
+	historyCmdLong = utils.LongDesc(`
+		List the most recent revisions of the task definitions of the services
+		and tasks of an application, with their status, the images of their
+		containers, which services currently run them and the deployments that
+		registered them`)
+
+	historyCmdExamples = utils.Examples(`
+		# List the last 10 revisions of the task definitions of all the services
+		# and tasks specified in the config
+		ecs-toolkit history
+
+		# List the last 5 revisions of the task definition of only one service
+		ecs-toolkit history --service=app-web-server --limit=5`)
+
+	historyCmdOptions = &historyOptions{}
+)
+
+// historyCmd represents the history command
+var historyCmd = &cobra.Command{
+	Use:     "history",
+	Short:   "List task definition revisions of an application.",
+	Long:    historyCmdLong,
+	Example: historyCmdExamples,
+	Args: func(cmd *cobra.Command, args []string) error {
+		err := cobra.NoArgs(cmd, args)
+
+		return err
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		historyCmdOptions.validate()
+		historyCmdOptions.run()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(historyCmd)
+
+	// Local flags, which, will be global for the application.
+	historyCmd.Flags().StringArrayVar(&historyCmdOptions.services, "service", []string{}, "service to list revisions of, defaults to all services and tasks in the config")
+	historyCmd.Flags().IntVar(&historyCmdOptions.limit, "limit", pkg.DefaultHistoryLimit, "number of most recent task definition revisions to list per family")
+}
+
+func (options *historyOptions) validate() {
+	if options.limit < 1 {
+		log.Fatal("limit flag should be at least 1")
+	}
+}
+
+func (options *historyOptions) run() {
+	awsConfig := awsConfigWithFlags(toolConfig.AWS)
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "CLUSTER\tSERVICE\tREVISION\tSTATUS\tREGISTERED\tRUNNING\tIMAGES\tDEPLOYMENT ID\tIMAGE TAG\tCOMMIT\tDEPLOYED BY\tCI RUN")
+
+	failed := false
+	targets := toolConfig.DeploymentTargets()
+	for index := range targets {
+		target := &targets[index]
+		logger := log.WithField("cluster", target.Cluster)
+		if target.Region != nil {
+			logger = logger.WithField("region", *target.Region)
+		}
+
+		awsCfg, err := loadAWSConfig(target.AWSConfig(awsConfig), logger)
+		if err != nil {
+			logger.Errorf("unable to load aws config: %v", err)
+			failed = true
+
+			continue
+		}
+
+		deployer, err := newDeployer(awsCfg)
+		if err != nil {
+			logger.Errorf("unable to set up deployer: %v", err)
+			failed = true
+
+			continue
+		}
+
+		historyInput := &pkg.HistoryInput{
+			Target:   target,
+			Services: options.services,
+			Limit:    options.limit,
+		}
+		histories, err := deployer.History(context.Background(), historyInput)
+		if err != nil {
+			logger.Errorf("unable to list deployment history: %v", err)
+			failed = true
+
+			continue
+		}
+
+		for _, history := range histories {
+			for _, revision := range history.Revisions {
+				fmt.Fprintln(writer, historyRow(target.Cluster, historyService(history), revision))
+			}
+		}
+	}
+	writer.Flush()
+
+	if failed {
+		log.Fatal("error listing deployment history, exiting!")
+	}
+}
+
+// historyRow puts together a row of the history table, revisions that weren't
+// registered by a deployment are listed without any deployment metadata.
+func historyRow(cluster string, service string, revision pkg.TaskDefinitionRevision) string {
+	orDash := func(value string) string {
+		if value == "" {
+			return "-"
+		}
+
+		return value
+	}
+
+	registeredAt := ""
+	if !revision.RegisteredAt.IsZero() {
+		registeredAt = revision.RegisteredAt.Format(time.RFC3339)
+	}
+
+	images := []string{}
+	for _, image := range revision.Images {
+		images = append(images, fmt.Sprintf("%s=%s", image.Container, image.Image))
+	}
+
+	deployment := revision.Deployment
+	if deployment == nil {
+		deployment = &pkg.DeploymentMetadata{}
+	}
+
+	return fmt.Sprintf("%s\t%s\t%s:%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s",
+		cluster, service, revision.Family, revision.Revision, orDash(string(revision.Status)), orDash(registeredAt),
+		orDash(strings.Join(revision.Services, ",")), orDash(strings.Join(images, ",")),
+		orDash(deployment.DeploymentID), orDash(deployment.ImageTag), orDash(deployment.GitCommit),
+		orDash(deployment.DeployedBy), orDash(deployment.CIRunURL))
+}
+
+// historyService names what uses the family, the services in the config along
+// with the stages of the tasks e.g. `app-web-server,pre-task`.
+func historyService(history pkg.FamilyHistory) string {
+	users := append([]string{}, history.Services...)
+	for _, stage := range history.TaskStages {
+		users = append(users, fmt.Sprintf("%s-task", stage))
+	}
+
+	return strings.Join(users, ",")
+}
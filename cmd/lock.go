@@ -0,0 +1,204 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"time"
+
+	"github.com/shipatlas/ecs-toolkit/pkg"
+	"github.com/shipatlas/ecs-toolkit/utils"
+	"github.com/spf13/cobra"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type lockReleaseOptions struct {
+	force bool
+}
+
+var (
+	lockCmdLong = utils.LongDesc(`
+		Inspect and manage the lock that keeps deployments of an application
+		from running at the same time`)
+
+	lockStatusCmdLong = utils.LongDesc(`
+		Show who holds the deployment lock of an application, if anyone`)
+
+	lockStatusCmdExamples = utils.Examples(`
+		# Show who holds the deployment lock in each target
+		ecs-toolkit lock status`)
+
+	lockReleaseCmdLong = utils.LongDesc(`
+		Release the deployment lock of an application e.g. after a deployment
+		was killed before it could release it. Only expired locks are released
+		unless forced`)
+
+	lockReleaseCmdExamples = utils.Examples(`
+		# Release the deployment lock if it has expired
+		ecs-toolkit lock release
+
+		# Release the deployment lock even if someone holds it
+		ecs-toolkit lock release --force`)
+
+	lockReleaseCmdOptions = &lockReleaseOptions{}
+)
+
+// lockCmd represents the lock command
+var lockCmd = &cobra.Command{
+	Use:   "lock",
+	Short: "Manage the deployment lock of an application.",
+	Long:  lockCmdLong,
+}
+
+// lockStatusCmd represents the lock status command
+var lockStatusCmd = &cobra.Command{
+	Use:     "status",
+	Short:   "Show who holds the deployment lock.",
+	Long:    lockStatusCmdLong,
+	Example: lockStatusCmdExamples,
+	Args: func(cmd *cobra.Command, args []string) error {
+		err := cobra.NoArgs(cmd, args)
+
+		return err
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		runLockStatus()
+	},
+}
+
+// lockReleaseCmd represents the lock release command
+var lockReleaseCmd = &cobra.Command{
+	Use:     "release",
+	Short:   "Release the deployment lock.",
+	Long:    lockReleaseCmdLong,
+	Example: lockReleaseCmdExamples,
+	Args: func(cmd *cobra.Command, args []string) error {
+		err := cobra.NoArgs(cmd, args)
+
+		return err
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		lockReleaseCmdOptions.run()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(lockCmd)
+	lockCmd.AddCommand(lockStatusCmd)
+	lockCmd.AddCommand(lockReleaseCmd)
+
+	// Local flags, which, will be global for the application.
+	lockReleaseCmd.Flags().BoolVar(&lockReleaseCmdOptions.force, "force", false, "release the lock even if it hasn't expired")
+}
+
+func runLockStatus() {
+	failed := false
+	forEachLockTarget(func(target *pkg.Target, locker pkg.Locker, logger *log.Entry) {
+		lease, err := locker.Status(context.Background(), target.Cluster, toolConfig.Lock.LockKey())
+		if err != nil {
+			logger.Errorf("unable to fetch deployment lock: %v", err)
+			failed = true
+
+			return
+		}
+
+		if lease == nil {
+			logger.Info("deployment lock is free")
+
+			return
+		}
+
+		lockSublogger := logger.WithFields(log.Fields{"owner": lease.Owner, "image-tag": lease.ImageTag})
+		if lease.Expired(time.Now()) {
+			lockSublogger.Infof("deployment lock expired at %s, since acquired at %s", lease.ExpiresAt.Format(time.RFC3339), lease.AcquiredAt.Format(time.RFC3339))
+
+			return
+		}
+		lockSublogger.Infof("deployment lock held until %s, since acquired at %s", lease.ExpiresAt.Format(time.RFC3339), lease.AcquiredAt.Format(time.RFC3339))
+	})
+
+	if failed {
+		log.Fatal("error fetching deployment lock, exiting!")
+	}
+}
+
+func (options *lockReleaseOptions) run() {
+	failed := false
+	forEachLockTarget(func(target *pkg.Target, locker pkg.Locker, logger *log.Entry) {
+		ctx := context.Background()
+
+		lease, err := locker.Status(ctx, target.Cluster, toolConfig.Lock.LockKey())
+		if err != nil {
+			logger.Errorf("unable to fetch deployment lock: %v", err)
+			failed = true
+
+			return
+		}
+
+		if lease == nil {
+			logger.Info("deployment lock is free, nothing to release")
+
+			return
+		}
+
+		if !lease.Expired(time.Now()) && !options.force {
+			logger.Errorf("deployment lock held by %s until %s, use --force to release it anyway", lease.Owner, lease.ExpiresAt.Format(time.RFC3339))
+			failed = true
+
+			return
+		}
+
+		err = locker.ForceRelease(ctx, target.Cluster, toolConfig.Lock.LockKey())
+		if err != nil {
+			logger.Errorf("unable to release deployment lock: %v", err)
+			failed = true
+
+			return
+		}
+		logger.Infof("released deployment lock held by %s", lease.Owner)
+	})
+
+	if failed {
+		log.Fatal("error releasing deployment lock, exiting!")
+	}
+}
+
+// forEachLockTarget calls the function with the deployment lock of each
+// target in turn.
+func forEachLockTarget(fn func(target *pkg.Target, locker pkg.Locker, logger *log.Entry)) {
+	if toolConfig.Lock == nil {
+		log.Fatal("lock must be set in the config")
+	}
+
+	awsConfig := awsConfigWithFlags(toolConfig.AWS)
+	targets := toolConfig.DeploymentTargets()
+	for index := range targets {
+		target := &targets[index]
+		logger := log.WithFields(log.Fields{"cluster": target.Cluster, "lock": toolConfig.Lock.LockKey()})
+		if target.Region != nil {
+			logger = logger.WithField("region", *target.Region)
+		}
+
+		awsCfg, err := loadAWSConfig(target.AWSConfig(awsConfig), logger)
+		if err != nil {
+			logger.Fatalf("unable to load aws config: %v", err)
+		}
+
+		fn(target, pkg.NewLocker(toolConfig.Lock, awsCfg), logger)
+	}
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"time"
+
+	"github.com/shipatlas/ecs-toolkit/pkg"
+	"github.com/shipatlas/ecs-toolkit/utils"
+	"github.com/spf13/cobra"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type pruneOptions struct {
+	delete bool
+	dryRun bool
+	keep   int
+	minAge time.Duration
+}
+
+var (
+	pruneCmdLong = utils.LongDesc(`
+		Deregister old revisions of the task definitions of the services and
+		tasks of an application, keeping the most recent ones and any used by a
+		service or running task in any of the targets. Flags take precedence over
+		the prune options in the config`)
+
+	pruneCmdExamples = utils.Examples(`
+		# List the revisions that would be deregistered, keeping the last 20
+		ecs-toolkit prune --keep=20 --dry-run
+
+		# Deregister revisions past the last 20 that are more than a week old
+		ecs-toolkit prune --keep=20 --min-age=168h
+
+		# Deregister and delete revisions past the last 20, along with any that
+		# were already deregistered
+		ecs-toolkit prune --keep=20 --delete`)
+
+	pruneCmdOptions = &pruneOptions{}
+)
+
+// pruneCmd represents the prune command
+var pruneCmd = &cobra.Command{
+	Use:     "prune",
+	Short:   "Deregister old task definition revisions of an application.",
+	Long:    pruneCmdLong,
+	Example: pruneCmdExamples,
+	Args: func(cmd *cobra.Command, args []string) error {
+		err := cobra.NoArgs(cmd, args)
+
+		return err
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		pruneCmdOptions.validate()
+		pruneCmdOptions.run(cmd)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(pruneCmd)
+
+	// Local flags, which, will be global for the application.
+	pruneCmd.Flags().IntVar(&pruneCmdOptions.keep, "keep", pkg.DefaultPruneKeep, "number of most recent active revisions to keep per family")
+	pruneCmd.Flags().DurationVar(&pruneCmdOptions.minAge, "min-age", pkg.DefaultPruneMinAge, "how long ago a revision must have been registered to be pruned")
+	pruneCmd.Flags().BoolVar(&pruneCmdOptions.delete, "delete", false, "delete revisions once deregistered, along with older inactive ones")
+	pruneCmd.Flags().BoolVar(&pruneCmdOptions.dryRun, "dry-run", false, "only list the revisions that would be pruned")
+}
+
+func (options *pruneOptions) validate() {
+	if options.keep < 1 {
+		log.Fatal("keep flag should be at least 1")
+	}
+
+	if options.minAge < 0 {
+		log.Fatal("min-age flag should not be negative")
+	}
+}
+
+func (options *pruneOptions) run(cmd *cobra.Command) {
+	awsConfig := awsConfigWithFlags(toolConfig.AWS)
+
+	// The targets share task definition families, possibly across accounts,
+	// so every one of them is checked for the revisions it uses before any is
+	// pruned.
+	targets := toolConfig.DeploymentTargets()
+	deployers := make([]*pkg.Deployer, len(targets))
+	inUse := map[string]bool{}
+	for index := range targets {
+		target := &targets[index]
+		logger := log.WithField("cluster", target.Cluster)
+		if target.Region != nil {
+			logger = logger.WithField("region", *target.Region)
+		}
+
+		awsCfg, err := loadAWSConfig(target.AWSConfig(awsConfig), logger)
+		if err != nil {
+			logger.Fatalf("unable to load aws config: %v", err)
+		}
+
+		deployer, err := newDeployer(awsCfg)
+		if err != nil {
+			logger.Fatalf("unable to set up deployer: %v", err)
+		}
+		deployers[index] = deployer
+
+		targetInUse, err := deployer.TaskDefinitionsInUse(context.Background(), target)
+		if err != nil {
+			logger.Fatalf("unable to fetch task definitions in use: %v", err)
+		}
+		for arn := range targetInUse {
+			inUse[arn] = true
+		}
+	}
+
+	failed := false
+	for index := range targets {
+		target := &targets[index]
+		logger := log.WithField("cluster", target.Cluster)
+		if target.Region != nil {
+			logger = logger.WithField("region", *target.Region)
+		}
+
+		pruneInput := toolConfig.PruneInput(target)
+		pruneInput.DryRun = options.dryRun
+		pruneInput.InUse = inUse
+		if cmd.Flags().Changed("keep") {
+			pruneInput.Keep = options.keep
+		}
+		if cmd.Flags().Changed("min-age") {
+			pruneInput.MinAge = options.minAge
+		}
+		if cmd.Flags().Changed("delete") {
+			pruneInput.Delete = options.delete
+		}
+
+		_, err := deployers[index].Prune(context.Background(), pruneInput)
+		if err != nil {
+			logger.Errorf("error pruning task definitions: %v", err)
+			failed = true
+
+			continue
+		}
+	}
+
+	if failed {
+		log.Fatal("error pruning task definitions, exiting!")
+	}
+}
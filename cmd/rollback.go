@@ -0,0 +1,115 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+
+	"github.com/shipatlas/ecs-toolkit/pkg"
+	"github.com/shipatlas/ecs-toolkit/utils"
+	"github.com/spf13/cobra"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type rollbackOptions struct {
+	maxParallel int
+	services    []string
+}
+
+var (
+	rollbackCmdLong = utils.LongDesc(`
+		Roll back the services of an application to the previous revision of
+		their task definitions`)
+
+	rollbackCmdExamples = utils.Examples(`
+		# Roll back all the services specified in the config
+		ecs-toolkit rollback
+
+		# Roll back only some of the services specified in the config
+		ecs-toolkit rollback --service=app-web-server --service=app-worker`)
+
+	rollbackCmdOptions = &rollbackOptions{}
+)
+
+// rollbackCmd represents the rollback command
+var rollbackCmd = &cobra.Command{
+	Use:     "rollback",
+	Short:   "Roll back the services of an application on AWS ECS.",
+	Long:    rollbackCmdLong,
+	Example: rollbackCmdExamples,
+	Args: func(cmd *cobra.Command, args []string) error {
+		err := cobra.NoArgs(cmd, args)
+
+		return err
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		rollbackCmdOptions.validate()
+		rollbackCmdOptions.run()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(rollbackCmd)
+
+	// Local flags, which, will be global for the application.
+	rollbackCmd.Flags().StringArrayVar(&rollbackCmdOptions.services, "service", []string{}, "service to roll back, defaults to all services in the config")
+	rollbackCmd.Flags().IntVar(&rollbackCmdOptions.maxParallel, "max-parallel", 0, "maximum number of services to roll back at the same time, 0 for no limit")
+}
+
+func (options *rollbackOptions) validate() {
+	if options.maxParallel < 0 {
+		log.Fatal("max-parallel flag should not be negative")
+	}
+}
+
+func (options *rollbackOptions) run() {
+	awsConfig := awsConfigWithFlags(toolConfig.AWS)
+	logObserver := pkg.NewLogObserver(log.NewEntry(log.StandardLogger()))
+
+	err := toolConfig.DeployTargets(func(target *pkg.Target, logger *log.Entry) error {
+		awsCfg, err := loadAWSConfig(target.AWSConfig(awsConfig), logger)
+		if err != nil {
+			logger.Errorf("unable to load aws config: %v", err)
+
+			return err
+		}
+
+		deployer, err := newDeployer(awsCfg, pkg.WithMaxConcurrency(options.maxParallel), pkg.WithObserver(logObserver))
+		if err != nil {
+			logger.Errorf("unable to set up deployer: %v", err)
+
+			return err
+		}
+
+		rollbackInput := &pkg.RollbackInput{
+			Target:   target,
+			Services: options.services,
+		}
+		_, err = deployer.Rollback(context.Background(), rollbackInput)
+		if err != nil {
+			logger.Errorf("error rolling back services: %v", err)
+
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Fatal("error rolling back application, exiting!")
+	}
+}
@@ -20,6 +20,11 @@ import (
 	"os"
 	"strings"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	"github.com/aws/smithy-go/logging"
 	"github.com/shipatlas/ecs-toolkit/pkg"
 	"github.com/shipatlas/ecs-toolkit/utils"
 	"github.com/spf13/cobra"
@@ -29,8 +34,13 @@ import (
 )
 
 type rootOptions struct {
-	configFile string
-	logLevel   string
+	configFile  string
+	endpointURL string
+	logFile     string
+	logFormat   string
+	logLevel    string
+	profile     string
+	region      string
 }
 
 var toolConfig = pkg.Config{}
@@ -44,7 +54,19 @@ var (
 		ecs-toolkit --config=/some/other/path/.ecs-toolkit.yml
 		
 		# Set the logging level i.e. in order: trace, debug, info, warn, error, fatal, panic
-		ecs-toolkit --log-level=debug`)
+		ecs-toolkit --log-level=debug
+		
+		# Log in JSON format e.g. for log aggregation
+		ecs-toolkit --log-format=json
+		
+		# Log to a file in JSON format while still logging to the console as usual
+		ecs-toolkit --log-file=deploy.log --log-format=json
+		
+		# Set the AWS profile and region to use, overriding the config file
+		ecs-toolkit --profile=production --region=eu-west-1
+		
+		# Send all AWS requests to a custom endpoint e.g. LocalStack
+		ecs-toolkit --endpoint-url=http://localhost:4566`)
 
 	rootCmdOptions = &rootOptions{}
 )
@@ -76,6 +98,11 @@ func init() {
 	// Persistent flags, which, will be global for the application.
 	rootCmd.PersistentFlags().StringVarP(&rootCmdOptions.configFile, "config", "c", ".ecs-toolkit.yml", "path to configuration file")
 	rootCmd.PersistentFlags().StringVarP(&rootCmdOptions.logLevel, "log-level", "l", "info", "logging level i.e. "+strings.Join(utils.LogLevels, "|"))
+	rootCmd.PersistentFlags().StringVar(&rootCmdOptions.logFormat, "log-format", "text", "logging format i.e. "+strings.Join(utils.LogFormats, "|")+", applies to the log file if set")
+	rootCmd.PersistentFlags().StringVar(&rootCmdOptions.logFile, "log-file", "", "path to a file to log to as well as the console")
+	rootCmd.PersistentFlags().StringVar(&rootCmdOptions.region, "region", "", "aws region to use, overrides the config file")
+	rootCmd.PersistentFlags().StringVar(&rootCmdOptions.profile, "profile", "", "aws profile to use, overrides the config file")
+	rootCmd.PersistentFlags().StringVar(&rootCmdOptions.endpointURL, "endpoint-url", "", "custom endpoint url for all aws services, overrides the config file")
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -111,4 +138,61 @@ func initConfig() {
 
 func initLogging() {
 	utils.SetLogLevel(rootCmdOptions.logLevel)
+
+	// The console keeps the usual output when logging to a file so that it's
+	// still easy to follow along.
+	if rootCmdOptions.logFile != "" {
+		utils.AddLogFile(rootCmdOptions.logFile, rootCmdOptions.logFormat)
+
+		return
+	}
+
+	utils.SetLogFormat(rootCmdOptions.logFormat)
+}
+
+// awsConfigWithFlags returns the given AWS options with any of the AWS flags
+// that have been set taking precedence.
+func awsConfigWithFlags(awsConfig pkg.AWS) pkg.AWS {
+	if rootCmdOptions.region != "" {
+		awsConfig.Region = &rootCmdOptions.region
+	}
+
+	if rootCmdOptions.profile != "" {
+		awsConfig.Profile = &rootCmdOptions.profile
+	}
+
+	if rootCmdOptions.endpointURL != "" {
+		awsConfig.EndpointURL = &rootCmdOptions.endpointURL
+	}
+
+	return awsConfig
+}
+
+// loadAWSConfig loads the configuration for AWS clients from the given options.
+func loadAWSConfig(awsConfig pkg.AWS, logger *log.Entry) (aws.Config, error) {
+	awsLogger := logging.LoggerFunc(func(classification logging.Classification, format string, v ...interface{}) {
+		switch classification {
+		case logging.Debug:
+			log.Debugf(format, v...)
+		case logging.Warn:
+			log.Warnf(format, v...)
+		}
+	})
+
+	return awsConfig.Load(logger, config.WithLogger(awsLogger))
+}
+
+// newDeployer sets up a deployer for the config file using clients created
+// from the AWS config.
+func newDeployer(awsCfg aws.Config, options ...pkg.DeployerOption) (*pkg.Deployer, error) {
+	clientOptions := []pkg.DeployerOption{
+		pkg.WithClient(ecs.NewFromConfig(awsCfg)),
+		pkg.WithLoadBalancingClient(elasticloadbalancingv2.NewFromConfig(awsCfg)),
+	}
+	if toolConfig.Lock != nil {
+		clientOptions = append(clientOptions, pkg.WithLocker(pkg.NewLocker(toolConfig.Lock, awsCfg)))
+	}
+	options = append(clientOptions, options...)
+
+	return pkg.NewDeployer(&toolConfig, options...)
 }
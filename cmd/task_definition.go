@@ -0,0 +1,256 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/shipatlas/ecs-toolkit/pkg"
+	"github.com/shipatlas/ecs-toolkit/utils"
+	"github.com/spf13/cobra"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type taskDefinitionExportOptions struct {
+	format string
+	output string
+}
+
+type taskDefinitionRegisterOptions struct {
+	containers []string
+	imageTag   string
+}
+
+var (
+	taskDefinitionCmdLong = utils.LongDesc(`
+		Export task definitions to files and register them from those files, so
+		that they can be kept in version control and edited safely`)
+
+	taskDefinitionExportCmdLong = utils.LongDesc(`
+		Write out a task definition as a JSON or YAML file that can be
+		registered again, leaving out the fields set by ECS on registration and
+		the tags set by ecs-toolkit. The task definition is looked up with the
+		AWS config of the first target`)
+
+	taskDefinitionExportCmdExamples = utils.Examples(`
+		# Export the latest revision of a task definition as JSON
+		ecs-toolkit task-definition export app-web-server > app-web-server.json
+
+		# Export a specific revision of a task definition as YAML
+		ecs-toolkit task-definition export app-web-server:104 --output=app-web-server.yml`)
+
+	taskDefinitionRegisterCmdLong = utils.LongDesc(`
+		Register a new revision of the task definition in a JSON or YAML file,
+		as written by export, optionally updating the image tag of its
+		containers first. The task definition is registered once for each AWS
+		account and region the targets are in`)
+
+	taskDefinitionRegisterCmdExamples = utils.Examples(`
+		# Register the task definition in a file as it is
+		ecs-toolkit task-definition register app-web-server.json
+
+		# Register the task definition in a file, updating the image tag of
+		# one of its containers
+		ecs-toolkit task-definition register app-web-server.yml --image-tag=5a853f72 --container=rails`)
+
+	taskDefinitionExportCmdOptions   = &taskDefinitionExportOptions{}
+	taskDefinitionRegisterCmdOptions = &taskDefinitionRegisterOptions{}
+)
+
+// taskDefinitionCmd represents the task-definition command
+var taskDefinitionCmd = &cobra.Command{
+	Use:   "task-definition",
+	Short: "Export and register task definitions as files.",
+	Long:  taskDefinitionCmdLong,
+}
+
+// taskDefinitionExportCmd represents the task-definition export command
+var taskDefinitionExportCmd = &cobra.Command{
+	Use:     "export <family>[:<revision>]",
+	Short:   "Export a task definition to a file.",
+	Long:    taskDefinitionExportCmdLong,
+	Example: taskDefinitionExportCmdExamples,
+	Args: func(cmd *cobra.Command, args []string) error {
+		err := cobra.ExactArgs(1)(cmd, args)
+
+		return err
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		taskDefinitionExportCmdOptions.validate()
+		taskDefinitionExportCmdOptions.run(args[0])
+	},
+}
+
+// taskDefinitionRegisterCmd represents the task-definition register command
+var taskDefinitionRegisterCmd = &cobra.Command{
+	Use:     "register <file>",
+	Short:   "Register a task definition from a file.",
+	Long:    taskDefinitionRegisterCmdLong,
+	Example: taskDefinitionRegisterCmdExamples,
+	Args: func(cmd *cobra.Command, args []string) error {
+		err := cobra.ExactArgs(1)(cmd, args)
+
+		return err
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		taskDefinitionRegisterCmdOptions.validate()
+		taskDefinitionRegisterCmdOptions.run(args[0])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(taskDefinitionCmd)
+	taskDefinitionCmd.AddCommand(taskDefinitionExportCmd)
+	taskDefinitionCmd.AddCommand(taskDefinitionRegisterCmd)
+
+	// Local flags, which, will be global for the application.
+	taskDefinitionExportCmd.Flags().StringVarP(&taskDefinitionExportCmdOptions.output, "output", "o", "", "file to write the task definition to, defaults to stdout")
+	taskDefinitionExportCmd.Flags().StringVar(&taskDefinitionExportCmdOptions.format, "format", "", "format to write the task definition in (json or yaml), defaults to the one of the output file or json")
+	taskDefinitionRegisterCmd.Flags().StringVarP(&taskDefinitionRegisterCmdOptions.imageTag, "image-tag", "t", "", "image tag to update the containers to before registering")
+	taskDefinitionRegisterCmd.Flags().StringSliceVar(&taskDefinitionRegisterCmdOptions.containers, "container", []string{}, "container to update the image tag of, defaults to all of them")
+}
+
+func (options *taskDefinitionExportOptions) validate() {
+	if options.format == "" {
+		options.format = string(pkg.TaskDefinitionFormatFor(options.output))
+	}
+
+	if options.format != string(pkg.TaskDefinitionFormatJSON) && options.format != string(pkg.TaskDefinitionFormatYAML) {
+		log.Fatal("format flag should be json or yaml")
+	}
+}
+
+func (options *taskDefinitionExportOptions) run(taskDefinition string) {
+	awsConfig := awsConfigWithFlags(toolConfig.AWS)
+
+	targets := toolConfig.DeploymentTargets()
+	target := &targets[0]
+	logger := log.WithField("cluster", target.Cluster)
+	if target.Region != nil {
+		logger = logger.WithField("region", *target.Region)
+	}
+
+	awsCfg, err := loadAWSConfig(target.AWSConfig(awsConfig), logger)
+	if err != nil {
+		logger.Fatalf("unable to load aws config: %v", err)
+	}
+
+	deployer, err := newDeployer(awsCfg)
+	if err != nil {
+		logger.Fatalf("unable to set up deployer: %v", err)
+	}
+
+	exportTaskDefinitionInput := &pkg.ExportTaskDefinitionInput{
+		TaskDefinition: taskDefinition,
+		Format:         pkg.TaskDefinitionFormat(options.format),
+	}
+	data, err := deployer.ExportTaskDefinition(context.Background(), exportTaskDefinitionInput)
+	if err != nil {
+		logger.Fatalf("unable to export task definition: %v", err)
+	}
+
+	if options.output == "" {
+		fmt.Print(string(data))
+
+		return
+	}
+
+	err = os.WriteFile(options.output, data, 0644)
+	if err != nil {
+		logger.Fatalf("unable to write task definition file: %v", err)
+	}
+	logger.Infof("exported task definition to %s", options.output)
+}
+
+func (options *taskDefinitionRegisterOptions) validate() {
+	if len(options.containers) > 0 && options.imageTag == "" {
+		log.Fatal("container flag is only used with image-tag flag")
+	}
+}
+
+func (options *taskDefinitionRegisterOptions) run(file string) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		log.Fatalf("unable to read task definition file: %v", err)
+	}
+
+	awsConfig := awsConfigWithFlags(toolConfig.AWS)
+
+	failed := false
+	registered := map[string]bool{}
+	targets := toolConfig.DeploymentTargets()
+	for index := range targets {
+		target := &targets[index]
+		logger := log.WithField("cluster", target.Cluster)
+		if target.Region != nil {
+			logger = logger.WithField("region", *target.Region)
+		}
+
+		// Task definitions belong to an account and region rather than a
+		// cluster, so targets sharing them only need one registration.
+		targetAWSConfig := target.AWSConfig(awsConfig)
+		awsConfigKey := strings.Join([]string{
+			aws.ToString(targetAWSConfig.Profile),
+			aws.ToString(targetAWSConfig.RoleARN),
+			aws.ToString(targetAWSConfig.Region),
+		}, "|")
+		if registered[awsConfigKey] {
+			continue
+		}
+
+		awsCfg, err := loadAWSConfig(targetAWSConfig, logger)
+		if err != nil {
+			logger.Errorf("unable to load aws config: %v", err)
+			failed = true
+
+			continue
+		}
+
+		deployer, err := newDeployer(awsCfg)
+		if err != nil {
+			logger.Errorf("unable to set up deployer: %v", err)
+			failed = true
+
+			continue
+		}
+
+		registerTaskDefinitionFileInput := &pkg.RegisterTaskDefinitionFileInput{
+			Data:       data,
+			Format:     pkg.TaskDefinitionFormatFor(file),
+			ImageTag:   options.imageTag,
+			Containers: options.containers,
+		}
+		taskDefinition, err := deployer.RegisterTaskDefinitionFile(context.Background(), registerTaskDefinitionFileInput)
+		if err != nil {
+			logger.Errorf("unable to register task definition: %v", err)
+			failed = true
+
+			continue
+		}
+		registered[awsConfigKey] = true
+		logger.Infof("registered task definition %s:%d", *taskDefinition.Family, taskDefinition.Revision)
+	}
+
+	if failed {
+		log.Fatal("error registering task definition, exiting!")
+	}
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultSessionName is the session name used when assuming a role without
+// one being set.
+const DefaultSessionName = "ecs-toolkit"
+
+// endpointServiceIDs maps the keys allowed in the `endpoints` config to the
+// service IDs that the AWS SDK uses when resolving endpoints.
+var endpointServiceIDs = map[string]string{
+	"dynamodb": dynamodb.ServiceID,
+	"ecs":      ecs.ServiceID,
+	"elbv2":    elasticloadbalancingv2.ServiceID,
+	"logs":     cloudwatchlogs.ServiceID,
+	"sts":      sts.ServiceID,
+}
+
+// Load builds the configuration used by all AWS clients, starting from the
+// default credential chain and applying the profile, region, custom endpoints
+// and role to assume where they have been set.
+func (awsConfig *AWS) Load(logger *log.Entry, optFns ...func(*config.LoadOptions) error) (aws.Config, error) {
+	loadOptions := []func(*config.LoadOptions) error{}
+
+	// Set profile.
+	if awsConfig.Profile != nil {
+		logger.Debugf("using aws profile %s", *awsConfig.Profile)
+
+		loadOptions = append(loadOptions, config.WithSharedConfigProfile(*awsConfig.Profile))
+	}
+
+	// Set region.
+	if awsConfig.Region != nil {
+		logger.Debugf("using aws region %s", *awsConfig.Region)
+
+		loadOptions = append(loadOptions, config.WithRegion(*awsConfig.Region))
+	}
+
+	// Set custom endpoints, a service specific endpoint takes precedence over
+	// the one set for all services.
+	if awsConfig.EndpointURL != nil || len(awsConfig.Endpoints) > 0 {
+		logger.Debug("using custom aws endpoints")
+
+		loadOptions = append(loadOptions, config.WithEndpointResolverWithOptions(awsConfig.endpointResolver()))
+	}
+
+	loadOptions = append(loadOptions, optFns...)
+	awsCfg, err := config.LoadDefaultConfig(context.TODO(), loadOptions...)
+	if err != nil {
+		return awsCfg, err
+	}
+
+	// Set role to assume, the credentials loaded so far are used to assume the
+	// role and are then swapped out for the role's temporary credentials.
+	if awsConfig.RoleARN != nil {
+		logger.Debugf("assuming aws role %s", *awsConfig.RoleARN)
+
+		sessionName := DefaultSessionName
+		if awsConfig.SessionName != nil {
+			sessionName = *awsConfig.SessionName
+		}
+
+		stsClient := sts.NewFromConfig(awsCfg)
+		provider := stscreds.NewAssumeRoleProvider(stsClient, *awsConfig.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.ExternalID = awsConfig.ExternalID
+			o.RoleSessionName = sessionName
+		})
+		awsCfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+
+	return awsCfg, nil
+}
+
+func (awsConfig *AWS) endpointResolver() aws.EndpointResolverWithOptions {
+	endpoints := map[string]string{}
+	for key, url := range awsConfig.Endpoints {
+		endpoints[endpointServiceIDs[key]] = url
+	}
+
+	return aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+		url, ok := endpoints[service]
+		if !ok && awsConfig.EndpointURL != nil {
+			url, ok = *awsConfig.EndpointURL, true
+		}
+
+		// Fall back to the default endpoint resolution of the service.
+		if !ok {
+			return aws.Endpoint{}, &aws.EndpointNotFoundError{}
+		}
+
+		return aws.Endpoint{
+			URL:               url,
+			HostnameImmutable: true,
+			SigningRegion:     region,
+		}, nil
+	})
+}
@@ -0,0 +1,307 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultCanaryBakeTime is how long a canary runs before it's promoted
+	// unless set otherwise.
+	DefaultCanaryBakeTime = 5 * time.Minute
+
+	// canaryHealthCheckTimeout is how long the HTTP health check of a canary
+	// can take before it's considered to have failed.
+	canaryHealthCheckTimeout = 10 * time.Second
+
+	// canaryScaleDownTimeout is how long scaling down a canary can take.
+	canaryScaleDownTimeout = 30 * time.Second
+)
+
+// canaryHTTPClient makes the HTTP health checks of canaries, a hanging
+// health check would otherwise hold up the bake past its deadline.
+var canaryHTTPClient = &http.Client{Timeout: canaryHealthCheckTimeout}
+
+// CanaryPromoter decides whether a canary that has baked without any
+// problems should be promoted to the main service, it's only consulted for
+// canaries with manual promotion.
+type CanaryPromoter interface {
+	Promote(ctx context.Context, canary *PendingCanary) (bool, error)
+}
+
+// CanaryPromoterFunc allows the use of an ordinary function as a promoter.
+type CanaryPromoterFunc func(ctx context.Context, canary *PendingCanary) (bool, error)
+
+// PendingCanary describes a canary that's waiting to be promoted.
+type PendingCanary struct {
+	Cluster           string
+	Service           string
+	CanaryService     string
+	TaskDefinitionArn string
+}
+
+func (promoterFunc CanaryPromoterFunc) Promote(ctx context.Context, canary *PendingCanary) (bool, error) {
+	return promoterFunc(ctx, canary)
+}
+
+func (canary *Canary) bakeTime() time.Duration {
+	if canary.BakeTime != nil {
+		return time.Duration(*canary.BakeTime) * time.Second
+	}
+
+	return DefaultCanaryBakeTime
+}
+
+func (canary *Canary) desiredCount() int32 {
+	if canary.DesiredCount != nil {
+		return *canary.DesiredCount
+	}
+
+	return 1
+}
+
+func (canary *Canary) maxStoppedTasks() int32 {
+	if canary.MaxStoppedTasks != nil {
+		return *canary.MaxStoppedTasks
+	}
+
+	return 0
+}
+
+func (canary *Canary) promotion() CanaryPromotion {
+	if canary.Promotion != nil {
+		return CanaryPromotion(*canary.Promotion)
+	}
+
+	return CanaryPromotionAuto
+}
+
+// deployCanary rolls out the task definition to the canary service first and
+// lets it bake, keeping an eye on its health. If all is well the task
+// definition is then promoted to the main service the usual way, otherwise
+// the main service is left as is. Either way the canary is scaled back down
+// afterwards.
+func (deployer *Deployer) deployCanary(ctx context.Context, deployment *Deployment, serviceConfig *Service, service *types.Service, taskDefinition *string, serviceSublogger *log.Entry) (Status, error) {
+	canaryConfig := serviceConfig.Canary
+	canarySublogger := serviceSublogger.WithField("canary", canaryConfig.Service)
+
+	canaryService, err := deployer.describeService(ctx, &deployment.Target.Cluster, canaryConfig.Service)
+	if err != nil {
+		canarySublogger.Errorf("unable to fetch canary service profile: %v", err)
+
+		return FailedStatus, err
+	}
+
+	// Tasks started before the canary is updated don't count towards its
+	// health, they're from a previous canary or are being replaced.
+	canaryStartedAt := deployer.clock.Now()
+	watch := newServiceWatch(*canaryService.ServiceName, canaryStartedAt, serviceConfig.maxWaitTime())
+
+	desiredCount := canaryConfig.desiredCount()
+	canarySublogger.Infof("rolling out to canary with %d task(s)", desiredCount)
+	updateServiceResult, err := deployer.client.UpdateService(ctx, &ecs.UpdateServiceInput{
+		Service:            canaryService.ServiceName,
+		Cluster:            canaryService.ClusterArn,
+		DesiredCount:       &desiredCount,
+		ForceNewDeployment: true,
+		TaskDefinition:     taskDefinition,
+	})
+	if err != nil {
+		canarySublogger.Errorf("unable to update canary service: %v", err)
+
+		return FailedStatus, err
+	}
+	canaryTaskDefinitionArn := *updateServiceResult.Service.TaskDefinition
+
+	canarySublogger.Info("watch canary rollout progress")
+	err = deployer.watchService(ctx, deployment, watch, canarySublogger)
+	if err == nil {
+		canarySublogger.Info("checking if canary is stable")
+		err = deployer.waitForServiceStable(ctx, deployment, watch, canarySublogger)
+	}
+	if err != nil {
+		return deployer.abortCanary(deployment, serviceConfig, canaryService, err.Error(), canarySublogger)
+	}
+
+	// Keep checking on the health of the canary until it has baked for long
+	// enough, the checks are paced by the poller and share its describe calls.
+	bakeTime := canaryConfig.bakeTime()
+	bakeDeadline := deployer.clock.Now().Add(bakeTime)
+	deployment.publish(&CanaryStarted{
+		EventMeta:         EventMeta{Type: EventCanaryStarted, Status: RunningStatus},
+		Service:           serviceConfig.Name,
+		CanaryService:     canaryConfig.Service,
+		TaskDefinitionArn: canaryTaskDefinitionArn,
+		BakeTimeSeconds:   int64(bakeTime / time.Second),
+	})
+	for {
+		polledService, canaryTasks, err := deployer.poller.serviceWithTasks(ctx, deployment.Target.Cluster, canaryConfig.Service, types.DesiredStatusRunning, types.DesiredStatusStopped)
+		if err != nil {
+			canarySublogger.Errorf("unable to fetch canary service profile: %v", err)
+
+			return deployer.abortCanary(deployment, serviceConfig, canaryService, fmt.Sprintf("unable to fetch canary service profile: %v", err), canarySublogger)
+		}
+		canaryService = polledService
+
+		problem := checkCanary(ctx, canaryConfig, canaryTasks, canaryTaskDefinitionArn, canaryStartedAt, canarySublogger)
+		if problem != "" {
+			return deployer.abortCanary(deployment, serviceConfig, canaryService, problem, canarySublogger)
+		}
+
+		if !deployer.clock.Now().Before(bakeDeadline) {
+			break
+		}
+	}
+
+	if canaryConfig.promotion() == CanaryPromotionManual {
+		if deployer.canaryPromoter == nil {
+			return deployer.abortCanary(deployment, serviceConfig, canaryService, "promotion is manual but there's no way to promote", canarySublogger)
+		}
+
+		canarySublogger.Info("canary is healthy, waiting for promotion")
+		promote, err := deployer.canaryPromoter.Promote(ctx, &PendingCanary{
+			Cluster:           deployment.Target.Cluster,
+			Service:           serviceConfig.Name,
+			CanaryService:     canaryConfig.Service,
+			TaskDefinitionArn: canaryTaskDefinitionArn,
+		})
+		if err != nil {
+			return deployer.abortCanary(deployment, serviceConfig, canaryService, fmt.Sprintf("unable to promote: %v", err), canarySublogger)
+		}
+		if !promote {
+			return deployer.abortCanary(deployment, serviceConfig, canaryService, "not promoted", canarySublogger)
+		}
+	}
+
+	deployment.publish(&CanaryPromoted{
+		EventMeta:     EventMeta{Type: EventCanaryPromoted, Status: SucceededStatus},
+		Service:       serviceConfig.Name,
+		CanaryService: canaryConfig.Service,
+	})
+
+	// Promote the exact task definition the canary ran, then the canary is no
+	// longer needed whatever the outcome.
+	status, err := deployer.updateService(ctx, deployment, serviceConfig, service, &canaryTaskDefinitionArn, serviceSublogger)
+	deployer.scaleDownCanary(canaryService, canarySublogger)
+
+	return status, err
+}
+
+// checkCanary checks on the health of the tasks the canary has started since
+// it was updated and, if set, its HTTP health check. It returns what's wrong
+// with the canary, if anything.
+func checkCanary(ctx context.Context, canaryConfig *Canary, tasks []types.Task, taskDefinitionArn string, startedAt time.Time, canarySublogger *log.Entry) string {
+	stoppedTasks := int32(0)
+	for _, task := range tasks {
+		if *task.TaskDefinitionArn != taskDefinitionArn || task.CreatedAt == nil || task.CreatedAt.Before(startedAt) {
+			continue
+		}
+
+		if *task.DesiredStatus == "STOPPED" {
+			stoppedTasks++
+			if task.StoppedReason != nil {
+				canarySublogger.Warnf("canary task stopped, reason: %s", strings.ToLower(*task.StoppedReason))
+			}
+
+			continue
+		}
+
+		if task.HealthStatus == types.HealthStatusUnhealthy {
+			return fmt.Sprintf("task %s is unhealthy", *task.TaskArn)
+		}
+	}
+	if stoppedTasks > canaryConfig.maxStoppedTasks() {
+		return fmt.Sprintf("%d task(s) stopped, more than the %d allowed", stoppedTasks, canaryConfig.maxStoppedTasks())
+	}
+
+	if canaryConfig.HealthCheckURL != nil {
+		err := checkCanaryURL(ctx, *canaryConfig.HealthCheckURL)
+		if err != nil {
+			return fmt.Sprintf("health check failed: %v", err)
+		}
+	}
+	canarySublogger.Debugf("canary is healthy, %d task(s) stopped", stoppedTasks)
+
+	return ""
+}
+
+// abortCanary scales the canary back down and fails the deployment of the
+// service, leaving the main service as is.
+func (deployer *Deployer) abortCanary(deployment *Deployment, serviceConfig *Service, canaryService *types.Service, reason string, canarySublogger *log.Entry) (Status, error) {
+	deployer.scaleDownCanary(canaryService, canarySublogger)
+	deployment.publish(&CanaryAborted{
+		EventMeta:     EventMeta{Type: EventCanaryAborted, Status: FailedStatus},
+		Service:       serviceConfig.Name,
+		CanaryService: serviceConfig.Canary.Service,
+		Reason:        reason,
+	})
+
+	return FailedStatus, &ErrCanaryAborted{Service: serviceConfig.Name, CanaryService: serviceConfig.Canary.Service, Reason: reason}
+}
+
+// scaleDownCanary scales the canary down to no tasks. It has to happen even if
+// the deployment was cancelled, so it isn't tied to the deployment's context.
+func (deployer *Deployer) scaleDownCanary(canaryService *types.Service, canarySublogger *log.Entry) {
+	canarySublogger.Info("scaling down canary")
+
+	ctx, cancel := context.WithTimeout(context.Background(), canaryScaleDownTimeout)
+	defer cancel()
+
+	desiredCount := int32(0)
+	_, err := deployer.client.UpdateService(ctx, &ecs.UpdateServiceInput{
+		Service:      canaryService.ServiceName,
+		Cluster:      canaryService.ClusterArn,
+		DesiredCount: &desiredCount,
+	})
+	if err != nil {
+		canarySublogger.Errorf("unable to scale down canary: %v", err)
+	}
+}
+
+// checkCanaryURL expects a successful response from the URL.
+func checkCanaryURL(ctx context.Context, url string) error {
+	ctx, cancel := context.WithTimeout(ctx, canaryHealthCheckTimeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := canaryHTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 400 {
+		return errors.New(response.Status)
+	}
+
+	return nil
+}
@@ -26,18 +26,124 @@ import (
 
 type Config struct {
 	Version string `mapstructure:"version" validate:"required,oneof=v1"`
-	Cluster string `mapstructure:"cluster" validate:"required"`
+	Cluster string `mapstructure:"cluster" validate:"required_without=Targets,excluded_with=Targets"`
+
+	AWS           AWS               `mapstructure:"aws"`
+	Hooks         Hooks             `mapstructure:"hooks"`
+	Lock          *Lock             `mapstructure:"lock"`
+	PollInterval  *int64            `mapstructure:"poll_interval" validate:"omitempty,min=1"`
+	Prune         *Prune            `mapstructure:"prune"`
+	Services      []Service         `mapstructure:"services" validate:"omitempty,dive"`
+	Tags          map[string]string `mapstructure:"tags" validate:"omitempty,max=40,dive,keys,min=1,max=128,startsnotwith=aws:,endkeys,max=256"`
+	Targets       []Target          `mapstructure:"targets" validate:"required_without=Cluster,omitempty,dive"`
+	TargetRollout *string           `mapstructure:"target_rollout" validate:"omitempty,oneof=sequential parallel"`
+	Tasks         Tasks             `mapstructure:"tasks" validate:"omitempty,dive"`
+	Verify        *Verify           `mapstructure:"verify"`
+	Webhooks      []Webhook         `mapstructure:"webhooks" validate:"omitempty,dive"`
+}
+
+type AWS struct {
+	Endpoints   map[string]string `mapstructure:"endpoints" validate:"omitempty,dive,keys,oneof=dynamodb ecs elbv2 logs sts,endkeys,url"`
+	EndpointURL *string           `mapstructure:"endpoint_url" validate:"omitempty,url"`
+	ExternalID  *string           `mapstructure:"external_id" validate:"omitempty,min=2,max=1224"`
+	Profile     *string           `mapstructure:"profile" validate:"omitempty,min=1"`
+	Region      *string           `mapstructure:"region" validate:"omitempty,min=1"`
+	RoleARN     *string           `mapstructure:"role_arn" validate:"omitempty,startswith=arn:"`
+	SessionName *string           `mapstructure:"session_name" validate:"omitempty,min=2,max=64"`
+}
+
+type Hook struct {
+	Command string `mapstructure:"command" validate:"required"`
+
+	ContinueOnError *bool   `mapstructure:"continue_on_error"`
+	Name            *string `mapstructure:"name"`
+	Timeout         *int64  `mapstructure:"timeout" validate:"omitempty,min=1"`
+}
 
-	Services []Service `mapstructure:"services" validate:"omitempty,dive"`
-	Tasks    Tasks     `mapstructure:"tasks" validate:"omitempty,dive"`
+type Hooks struct {
+	AfterDeploy   []Hook `mapstructure:"after_deploy" validate:"omitempty,dive"`
+	AfterPreTasks []Hook `mapstructure:"after_pre_tasks" validate:"omitempty,dive"`
+	AfterServices []Hook `mapstructure:"after_services" validate:"omitempty,dive"`
+	BeforeDeploy  []Hook `mapstructure:"before_deploy" validate:"omitempty,dive"`
+	OnFailure     []Hook `mapstructure:"on_failure" validate:"omitempty,dive"`
+}
+
+type HookStage string
+
+type Lock struct {
+	Backend *string `mapstructure:"backend" validate:"omitempty,oneof=ecs dynamodb"`
+	Key     *string `mapstructure:"key" validate:"omitempty,min=1,max=64"`
+	Table   *string `mapstructure:"table" validate:"required_if=Backend dynamodb"`
+	TTL     *int64  `mapstructure:"ttl" validate:"omitempty,min=30"`
+	Wait    *int64  `mapstructure:"wait" validate:"omitempty,min=0"`
+}
+
+type LockBackend string
+
+type Prune struct {
+	AfterDeploy *bool  `mapstructure:"after_deploy"`
+	Delete      *bool  `mapstructure:"delete"`
+	Keep        *int   `mapstructure:"keep" validate:"omitempty,min=1"`
+	MinAge      *int64 `mapstructure:"min_age" validate:"omitempty,min=0"`
 }
 
 type Service struct {
 	Name       string   `mapstructure:"name" validate:"required"`
 	Containers []string `mapstructure:"containers" validate:"required,min=1,dive"`
 
-	Force   *bool  `mapstructure:"force"`
-	MaxWait *int64 `mapstructure:"max_wait" validate:"omitempty,min=5"`
+	Canary                  *Canary                  `mapstructure:"canary" validate:"required_if=Strategy canary"`
+	DeploymentConfiguration *DeploymentConfiguration `mapstructure:"deployment_configuration"`
+	DesiredCount            *int32                   `mapstructure:"desired_count" validate:"omitempty,min=0"`
+	Force                   *bool                    `mapstructure:"force"`
+	HealthCheckGracePeriod  *int32                   `mapstructure:"health_check_grace_period" validate:"omitempty,min=0"`
+	MaxWait                 *int64                   `mapstructure:"max_wait" validate:"omitempty,min=5"`
+	Strategy                *string                  `mapstructure:"strategy" validate:"omitempty,oneof=rolling canary recreate"`
+	TaskDefinitionFile      *string                  `mapstructure:"task_definition_file" validate:"omitempty,min=1"`
+	Verify                  *Verify                  `mapstructure:"verify"`
+	WaitForTargets          *bool                    `mapstructure:"wait_for_targets"`
+}
+
+type DeploymentConfiguration struct {
+	Alarms                *DeploymentAlarms         `mapstructure:"alarms"`
+	CircuitBreaker        *DeploymentCircuitBreaker `mapstructure:"circuit_breaker"`
+	MaximumPercent        *int32                    `mapstructure:"maximum_percent" validate:"omitempty,min=100"`
+	MinimumHealthyPercent *int32                    `mapstructure:"minimum_healthy_percent" validate:"omitempty,min=0,max=100"`
+}
+
+type DeploymentAlarms struct {
+	Names []string `mapstructure:"names" validate:"required,min=1,dive,required"`
+
+	Enable   bool `mapstructure:"enable"`
+	Rollback bool `mapstructure:"rollback"`
+}
+
+type DeploymentCircuitBreaker struct {
+	Enable   bool `mapstructure:"enable"`
+	Rollback bool `mapstructure:"rollback"`
+}
+
+type ServiceStrategy string
+
+type Canary struct {
+	Service string `mapstructure:"service" validate:"required"`
+
+	BakeTime        *int64  `mapstructure:"bake_time" validate:"omitempty,min=0"`
+	DesiredCount    *int32  `mapstructure:"desired_count" validate:"omitempty,min=1"`
+	HealthCheckURL  *string `mapstructure:"health_check_url" validate:"omitempty,url"`
+	MaxStoppedTasks *int32  `mapstructure:"max_stopped_tasks" validate:"omitempty,min=0"`
+	Promotion       *string `mapstructure:"promotion" validate:"omitempty,oneof=auto manual"`
+}
+
+type CanaryPromotion string
+
+type Target struct {
+	Cluster string `mapstructure:"cluster" validate:"required"`
+
+	ExternalID  *string `mapstructure:"external_id" validate:"omitempty,min=2,max=1224"`
+	Profile     *string `mapstructure:"profile" validate:"omitempty,min=1"`
+	Region      *string `mapstructure:"region" validate:"omitempty,min=1"`
+	RoleARN     *string `mapstructure:"role_arn" validate:"omitempty,startswith=arn:"`
+	SessionName *string `mapstructure:"session_name" validate:"omitempty,min=2,max=64"`
 }
 
 type Task struct {
@@ -48,6 +154,7 @@ type Task struct {
 	CapacityProviderStrategies []CapacityProviderStrategy `mapstructure:"capacity_provider_strategies" validate:"omitempty,max=6,dive"`
 	LaunchType                 *string                    `mapstructure:"launch_type" validate:"omitempty,oneof=ec2 fargate external"`
 	NetworkConfiguration       *NetworkConfiguration      `mapstructure:"network_configuration" validate:"omitempty,dive"`
+	TaskDefinitionFile         *string                    `mapstructure:"task_definition_file" validate:"omitempty,min=1"`
 }
 
 type Tasks struct {
@@ -57,6 +164,38 @@ type Tasks struct {
 
 type TaskStage string
 
+type Verify struct {
+	Checks []VerifyCheck `mapstructure:"checks" validate:"required,min=1,dive"`
+
+	Rollback *bool `mapstructure:"rollback"`
+}
+
+type VerifyCheck struct {
+	URL string `mapstructure:"url" validate:"required,url"`
+
+	Body      *string           `mapstructure:"body"`
+	Headers   map[string]string `mapstructure:"headers"`
+	JSONPath  *string           `mapstructure:"json_path" validate:"required_with=JSONValue"`
+	JSONValue *string           `mapstructure:"json_value" validate:"required_with=JSONPath"`
+	Retries   *int              `mapstructure:"retries" validate:"omitempty,min=0,max=20"`
+	Status    *int              `mapstructure:"status" validate:"omitempty,min=100,max=599"`
+	Timeout   *int64            `mapstructure:"timeout" validate:"omitempty,min=1"`
+}
+
+type TargetRollout string
+
+type Webhook struct {
+	URL string `mapstructure:"url" validate:"required"`
+
+	Events     []string          `mapstructure:"events" validate:"omitempty,dive,oneof=canary.aborted canary.promoted canary.started deployment.finished deployment.progress deployment.started service.event service.stable service.task_stopped service.updated stage.completed stage.started task_definition.registered task.failed task.started task.state_changed task.stopped verification.completed"`
+	Format     *string           `mapstructure:"format" validate:"omitempty,oneof=json slack teams"`
+	Headers    map[string]string `mapstructure:"headers"`
+	MaxRetries *int              `mapstructure:"max_retries" validate:"omitempty,min=0,max=10"`
+	Secret     *string           `mapstructure:"secret"`
+	Template   *string           `mapstructure:"template" validate:"excluded_with=Format"`
+	Timeout    *int64            `mapstructure:"timeout" validate:"omitempty,min=1"`
+}
+
 type CapacityProviderStrategy struct {
 	CapacityProvider string `mapstructure:"capacity_provider" validate:"required"`
 	Base             int32  `mapstructure:"base"`
@@ -78,6 +217,35 @@ const (
 	TaskStagePre  TaskStage = "pre"
 )
 
+const (
+	HookStageAfterDeploy   HookStage = "after_deploy"
+	HookStageAfterPreTasks HookStage = "after_pre_tasks"
+	HookStageAfterServices HookStage = "after_services"
+	HookStageBeforeDeploy  HookStage = "before_deploy"
+	HookStageOnFailure     HookStage = "on_failure"
+)
+
+const (
+	LockBackendDynamoDB LockBackend = "dynamodb"
+	LockBackendECS      LockBackend = "ecs"
+)
+
+const (
+	ServiceStrategyCanary   ServiceStrategy = "canary"
+	ServiceStrategyRecreate ServiceStrategy = "recreate"
+	ServiceStrategyRolling  ServiceStrategy = "rolling"
+)
+
+const (
+	CanaryPromotionAuto   CanaryPromotion = "auto"
+	CanaryPromotionManual CanaryPromotion = "manual"
+)
+
+const (
+	TargetRolloutParallel   TargetRollout = "parallel"
+	TargetRolloutSequential TargetRollout = "sequential"
+)
+
 func (config *Config) Validate() error {
 	validate := validator.New()
 	err := validate.Struct(config)
@@ -93,5 +261,12 @@ func (config *Config) Validate() error {
 		return err
 	}
 
+	err = config.Prune.validateAfterDeploy(config.DeploymentTargets())
+	if err != nil {
+		log.Error(err)
+
+		return err
+	}
+
 	return nil
 }
@@ -0,0 +1,63 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"testing"
+)
+
+func TestValidatePruneAfterDeploy(t *testing.T) {
+	afterDeploy := true
+	testCases := []struct {
+		name    string
+		targets []Target
+		wantErr bool
+	}{
+		{
+			name:    "single target",
+			targets: []Target{{Cluster: "a", Profile: stringPtr("staging")}},
+		},
+		{
+			name:    "same aws settings",
+			targets: []Target{{Cluster: "a"}, {Cluster: "b"}},
+		},
+		{
+			name:    "other region",
+			targets: []Target{{Cluster: "a", Region: stringPtr("eu-west-1")}, {Cluster: "b", Region: stringPtr("us-east-1"), Profile: stringPtr("us")}},
+		},
+		{
+			name:    "different aws settings",
+			targets: []Target{{Cluster: "a"}, {Cluster: "b", RoleARN: stringPtr("arn:aws:iam::123456789012:role/deploy")}},
+			wantErr: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			config := &Config{
+				Version: "v1",
+				Prune:   &Prune{AfterDeploy: &afterDeploy},
+				Targets: testCase.targets,
+			}
+
+			err := config.Validate()
+			if (err != nil) != testCase.wantErr {
+				t.Errorf("got error %v, want error %t", err, testCase.wantErr)
+			}
+		})
+	}
+}
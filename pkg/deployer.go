@@ -0,0 +1,693 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultPollInterval is how often the progress of tasks and services is
+// checked unless set otherwise.
+const DefaultPollInterval = 3 * time.Second
+
+// Clock tells the time, it can be replaced to control the passing of time
+// e.g. when testing.
+type Clock interface {
+	Now() time.Time
+	After(duration time.Duration) <-chan time.Time
+}
+
+// Deployer deploys the services and tasks in the config to a target. It's
+// what the command line uses and is meant to be used as a library as well,
+// set it up with NewDeployer.
+type Deployer struct {
+	canaryPromoter CanaryPromoter
+	client         ECSAPI
+	clock          Clock
+	config         *Config
+	elbClient      LoadBalancingAPI
+	emitter        *EventEmitter
+	lockOwner      string
+	locker         Locker
+	logger         *log.Entry
+	maxConcurrency int
+	pollInterval   time.Duration
+	poller         *poller
+	taskLogs       *TaskLogsOptions
+}
+
+// DeployerOption configures a Deployer.
+type DeployerOption func(deployer *Deployer)
+
+type DeployInput struct {
+	// The docker image tag to update the containers to.
+	//
+	// This member is required.
+	ImageTag string
+
+	// The target to deploy to. Defaults to the only target in the config, it
+	// must be set if the config has several targets.
+	Target *Target
+
+	// Skip running the pre-deployment tasks.
+	SkipPreTasks bool
+
+	// Skip running the post-deployment tasks.
+	SkipPostTasks bool
+
+	// Tags to add to the task definitions registered and the services updated
+	// on top of the deployment metadata and the tags in the config, taking
+	// precedence over both.
+	Annotations map[string]string
+}
+
+// DeployResult is the outcome of a deployment.
+type DeployResult struct {
+	// The ID of the deployment, it's tagged onto the task definitions and
+	// services that were changed.
+	DeploymentID string
+
+	// The overall status of the deployment.
+	Status Status
+
+	// The status of each service, keyed by name.
+	Services map[string]Status
+
+	// The status of each pre-deployment task, keyed by family.
+	PreTasks map[string]Status
+
+	// The status of each post-deployment task, keyed by family.
+	PostTasks map[string]Status
+
+	// The ARNs of the task definitions registered during the deployment.
+	TaskDefinitions []string
+
+	// The ARNs of the task definitions the services used before the
+	// deployment, keyed by service name. Pass them on to Rollback to undo the
+	// deployment.
+	PreviousTaskDefinitions map[string]string
+
+	// The windows of time during which services being recreated were down.
+	Downtimes []Downtime
+}
+
+// DeployPlan describes the changes a deployment would make.
+type DeployPlan struct {
+	PreTasks  []PlannedTaskDefinition
+	Services  []PlannedTaskDefinition
+	PostTasks []PlannedTaskDefinition
+}
+
+// PlannedTaskDefinition describes the changes to the task definition of a
+// service or task.
+type PlannedTaskDefinition struct {
+	// The name of the service or the family of the task.
+	Name string
+
+	// The ARN of the task definition currently in use, empty if there's none
+	// yet.
+	TaskDefinitionArn string
+
+	// The changes to the container images, if any.
+	Containers []ContainerImageChange
+}
+
+type RollbackInput struct {
+	// The target to roll back. Defaults to the only target in the config, it
+	// must be set if the config has several targets.
+	Target *Target
+
+	// The services to roll back. Defaults to all the services in the config.
+	Services []string
+
+	// The task definitions to roll the services back to, keyed by service
+	// name. Defaults to the revision before the one a service currently uses.
+	TaskDefinitions map[string]string
+}
+
+// RollbackResult is the outcome of a rollback.
+type RollbackResult struct {
+	// The overall status of the rollback.
+	Status Status
+
+	// The status of each service, keyed by name.
+	Services map[string]Status
+
+	// The ARNs of the task definitions the services were rolled back to,
+	// keyed by service name.
+	TaskDefinitions map[string]string
+}
+
+// itemResult is the outcome of deploying a single service or task.
+type itemResult struct {
+	name   string
+	status Status
+	err    error
+}
+
+type systemClock struct{}
+
+// NewDeployer sets up a deployer for the config, an ECS client must be set
+// using WithClient.
+func NewDeployer(config *Config, options ...DeployerOption) (*Deployer, error) {
+	deployer := &Deployer{
+		clock:        systemClock{},
+		config:       config,
+		emitter:      NewEventEmitter(),
+		lockOwner:    defaultLockOwner(),
+		logger:       log.NewEntry(log.StandardLogger()),
+		pollInterval: DefaultPollInterval,
+	}
+
+	if config.PollInterval != nil {
+		deployer.pollInterval = time.Duration(*config.PollInterval) * time.Second
+	}
+
+	for _, option := range options {
+		option(deployer)
+	}
+
+	if deployer.client == nil {
+		return nil, errors.New("ecs client must be set")
+	}
+
+	if config.Lock != nil && deployer.locker == nil {
+		return nil, errors.New("locker must be set when the config has a lock")
+	}
+
+	if deployer.pollInterval <= 0 {
+		return nil, errors.New("poll interval must be positive")
+	}
+
+	// All the services and tasks being watched share the same poller so that
+	// describe calls can be batched.
+	deployer.poller = newPoller(deployer.client, deployer.clock, deployer.pollInterval, deployer.logger)
+
+	return deployer, nil
+}
+
+// WithCanaryPromoter sets what decides whether canaries with manual
+// promotion are promoted. Without it such canaries are always aborted.
+func WithCanaryPromoter(canaryPromoter CanaryPromoter) DeployerOption {
+	return func(deployer *Deployer) {
+		deployer.canaryPromoter = canaryPromoter
+	}
+}
+
+// WithClient sets the ECS client to use, the target's cluster must be
+// reachable with it.
+func WithClient(client ECSAPI) DeployerOption {
+	return func(deployer *Deployer) {
+		deployer.client = client
+	}
+}
+
+// WithClock sets the clock to use. Defaults to the system clock.
+func WithClock(clock Clock) DeployerOption {
+	return func(deployer *Deployer) {
+		deployer.clock = clock
+	}
+}
+
+// WithLoadBalancingClient sets the Elastic Load Balancing client to use to
+// wait for the tasks of services with load balancers to be healthy targets.
+// Without it services are stable as soon as ECS considers them to be.
+func WithLoadBalancingClient(elbClient LoadBalancingAPI) DeployerOption {
+	return func(deployer *Deployer) {
+		deployer.elbClient = elbClient
+	}
+}
+
+// WithLocker sets the backend of the deployment lock, it must be set if the
+// config has a lock.
+func WithLocker(locker Locker) DeployerOption {
+	return func(deployer *Deployer) {
+		deployer.locker = locker
+	}
+}
+
+// WithLockOwner sets who holds the deployment lock while deploying. Defaults
+// to the current user, host and process.
+func WithLockOwner(lockOwner string) DeployerOption {
+	return func(deployer *Deployer) {
+		deployer.lockOwner = lockOwner
+	}
+}
+
+// WithLogger sets the logger for warnings, errors and debugging output.
+// Progress is published to observers instead, use a LogObserver to log it.
+// Defaults to the standard logger.
+func WithLogger(logger *log.Entry) DeployerOption {
+	return func(deployer *Deployer) {
+		deployer.logger = logger
+	}
+}
+
+// WithMaxConcurrency limits how many services or tasks are deployed at the
+// same time. Defaults to all of them at once.
+func WithMaxConcurrency(maxConcurrency int) DeployerOption {
+	return func(deployer *Deployer) {
+		deployer.maxConcurrency = maxConcurrency
+	}
+}
+
+// WithObserver subscribes the observer to the events published during
+// deployments, it can be set more than once.
+func WithObserver(observer DeploymentObserver) DeployerOption {
+	return func(deployer *Deployer) {
+		deployer.emitter.Subscribe(observer)
+	}
+}
+
+// WithPollInterval sets how often the progress of tasks and services is
+// checked, taking precedence over the config. Defaults to
+// DefaultPollInterval.
+func WithPollInterval(pollInterval time.Duration) DeployerOption {
+	return func(deployer *Deployer) {
+		deployer.pollInterval = pollInterval
+	}
+}
+
+// WithTaskLogs streams the container logs of tasks while watching them.
+func WithTaskLogs(taskLogs *TaskLogsOptions) DeployerOption {
+	return func(deployer *Deployer) {
+		deployer.taskLogs = taskLogs
+	}
+}
+
+// Plan works out the changes a deployment would make to the task definitions
+// of the services and tasks, without changing anything.
+func (deployer *Deployer) Plan(ctx context.Context, input *DeployInput) (*DeployPlan, error) {
+	target, err := deployer.target(input.Target)
+	if err != nil {
+		return nil, err
+	}
+	clusterSublogger := target.loggerFrom(deployer.logger)
+	plan := &DeployPlan{}
+
+	planTasks := func(tasks []Task) ([]PlannedTaskDefinition, error) {
+		planned := []PlannedTaskDefinition{}
+		for index := range tasks {
+			taskConfig := &tasks[index]
+			plannedTaskDefinition, err := deployer.planTaskDefinition(ctx, target, taskConfig.Family, &input.ImageTag, &taskConfig.Family, taskConfig.TaskDefinitionFile, taskConfig.Containers, clusterSublogger.WithField("task", taskConfig.Family))
+			if err != nil {
+				return nil, err
+			}
+			planned = append(planned, *plannedTaskDefinition)
+		}
+
+		return planned, nil
+	}
+
+	if !input.SkipPreTasks {
+		plan.PreTasks, err = planTasks(deployer.config.Tasks.Pre)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for index := range deployer.config.Services {
+		serviceConfig := &deployer.config.Services[index]
+		serviceSublogger := clusterSublogger.WithField("service", serviceConfig.Name)
+
+		service, err := deployer.describeService(ctx, &target.Cluster, serviceConfig.Name)
+		if err != nil {
+			serviceSublogger.Errorf("unable to fetch service profile: %v", err)
+
+			return nil, err
+		}
+
+		plannedTaskDefinition, err := deployer.planTaskDefinition(ctx, target, serviceConfig.Name, &input.ImageTag, service.TaskDefinition, serviceConfig.TaskDefinitionFile, serviceConfig.Containers, serviceSublogger)
+		if err != nil {
+			return nil, err
+		}
+		plan.Services = append(plan.Services, *plannedTaskDefinition)
+	}
+
+	if !input.SkipPostTasks {
+		plan.PostTasks, err = planTasks(deployer.config.Tasks.Post)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return plan, nil
+}
+
+// Deploy deploys a new version of the application to the target, running the
+// pre-deployment tasks, then updating the services and finally running the
+// post-deployment tasks along with any hooks. The result is returned even if
+// the deployment fails.
+func (deployer *Deployer) Deploy(ctx context.Context, input *DeployInput) (*DeployResult, error) {
+	target, err := deployer.target(input.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	if input.ImageTag == "" {
+		return nil, errors.New("image tag must be set")
+	}
+
+	deployment := deployer.newDeployment(target, input.ImageTag)
+	deployment.tags, err = deployer.deploymentTags(deployment, input.Annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hold the deployment lock for the whole deployment, it's cancelled if
+	// the lock is lost along the way.
+	ctx, unlock, err := deployer.holdLock(ctx, target, input.ImageTag)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	deployment.Start()
+
+	err = deployer.deploy(ctx, deployment, input)
+	if err != nil {
+		deployment.Complete(FailedStatus)
+
+		hookErr := deployer.config.RunHooks(ctx, HookStageOnFailure, deployment)
+		if hookErr != nil {
+			deployment.logger().Errorf("error running on failure hooks: %v", hookErr)
+		}
+	}
+	deployment.Finish()
+
+	result := &DeployResult{
+		DeploymentID:            deployment.ID,
+		Status:                  deployment.Status(),
+		Services:                deployment.ServiceStatuses(),
+		PreTasks:                deployment.TaskStatuses(TaskStagePre),
+		PostTasks:               deployment.TaskStatuses(TaskStagePost),
+		TaskDefinitions:         deployment.TaskDefinitions(),
+		PreviousTaskDefinitions: deployment.PreviousTaskDefinitions(),
+		Downtimes:               deployment.Downtimes(),
+	}
+
+	return result, err
+}
+
+// Rollback rolls the services of the target back to the previous revision of
+// their task definitions, or the ones given, waiting for them to be stable.
+func (deployer *Deployer) Rollback(ctx context.Context, input *RollbackInput) (*RollbackResult, error) {
+	target, err := deployer.target(input.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceConfigs := []*Service{}
+	for index := range deployer.config.Services {
+		serviceConfig := &deployer.config.Services[index]
+		if len(input.Services) > 0 && !containsString(input.Services, serviceConfig.Name) {
+			continue
+		}
+		serviceConfigs = append(serviceConfigs, serviceConfig)
+	}
+
+	if len(serviceConfigs) < len(input.Services) {
+		return nil, errors.New("unable to roll back services not in the config")
+	}
+
+	// Rolling back changes the services as much as deploying does, so it
+	// holds the same lock.
+	ctx, unlock, err := deployer.holdLock(ctx, target, "")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return deployer.rollback(ctx, target, serviceConfigs, input.TaskDefinitions)
+}
+
+// rollback rolls the services back to the given task definitions, or the
+// previous revision of the ones they run if not given. The caller must hold
+// the lock on the target, which a deployment already does.
+func (deployer *Deployer) rollback(ctx context.Context, target *Target, serviceConfigs []*Service, taskDefinitions map[string]string) (*RollbackResult, error) {
+	deployment := deployer.newDeployment(target, "")
+	rolledBackTo := sync.Map{}
+
+	err := deployer.deployServices(ctx, deployment, serviceConfigs, func(ctx context.Context, serviceConfig *Service, logger *log.Entry) (Status, error) {
+		serviceSublogger := logger.WithField("service", serviceConfig.Name)
+
+		service, err := deployer.describeService(ctx, &target.Cluster, serviceConfig.Name)
+		if err != nil {
+			serviceSublogger.Errorf("unable to fetch service profile: %v", err)
+
+			var notFoundErr *ErrServiceNotFound
+			if errors.As(err, &notFoundErr) {
+				return SkippedStatus, err
+			}
+
+			return FailedStatus, err
+		}
+
+		taskDefinition, ok := taskDefinitions[serviceConfig.Name]
+		if !ok {
+			taskDefinition, err = deployer.previousTaskDefinition(ctx, *service.TaskDefinition)
+			if err != nil {
+				serviceSublogger.Errorf("unable to find previous task definition: %v", err)
+
+				return FailedStatus, err
+			}
+		}
+		serviceSublogger.Infof("rolling back to task definition %s", taskDefinition)
+		rolledBackTo.Store(serviceConfig.Name, taskDefinition)
+
+		return deployer.updateService(ctx, deployment, serviceConfig, service, &taskDefinition, serviceSublogger)
+	})
+
+	status := SucceededStatus
+	if err != nil {
+		status = FailedStatus
+	}
+
+	result := &RollbackResult{
+		Status:          status,
+		Services:        deployment.ServiceStatuses(),
+		TaskDefinitions: map[string]string{},
+	}
+	rolledBackTo.Range(func(service, taskDefinition interface{}) bool {
+		result.TaskDefinitions[service.(string)] = taskDefinition.(string)
+
+		return true
+	})
+
+	return result, err
+}
+
+func (deployer *Deployer) deploy(ctx context.Context, deployment *Deployment, input *DeployInput) error {
+	logger := deployment.logger()
+
+	err := deployer.config.RunHooks(ctx, HookStageBeforeDeploy, deployment)
+	if err != nil {
+		logger.Error("error running before deploy hooks")
+
+		return err
+	}
+
+	if !input.SkipPreTasks {
+		err = deployer.deployTasks(ctx, deployment, TaskStagePre)
+		if err != nil {
+			logger.Error("error deploying pre-deployment tasks")
+
+			return err
+		}
+
+		err = deployer.config.RunHooks(ctx, HookStageAfterPreTasks, deployment)
+		if err != nil {
+			logger.Error("error running after pre-deployment tasks hooks")
+
+			return err
+		}
+	}
+
+	serviceConfigs := []*Service{}
+	for index := range deployer.config.Services {
+		serviceConfigs = append(serviceConfigs, &deployer.config.Services[index])
+	}
+
+	err = deployer.deployServices(ctx, deployment, serviceConfigs, func(ctx context.Context, serviceConfig *Service, logger *log.Entry) (Status, error) {
+		return deployer.deployService(ctx, deployment, serviceConfig, logger)
+	})
+	if err != nil {
+		logger.Error("error deploying services")
+
+		return err
+	}
+
+	if deployer.config.Verify != nil {
+		err = deployer.verifyApplication(ctx, deployment)
+		if err != nil {
+			logger.Error("error verifying application")
+
+			return err
+		}
+	}
+
+	err = deployer.config.RunHooks(ctx, HookStageAfterServices, deployment)
+	if err != nil {
+		logger.Error("error running after services hooks")
+
+		return err
+	}
+
+	if !input.SkipPostTasks {
+		err = deployer.deployTasks(ctx, deployment, TaskStagePost)
+		if err != nil {
+			logger.Error("error deploying post-deployment tasks")
+
+			return err
+		}
+	}
+
+	if deployer.config.Prune.afterDeploy() {
+		deployer.pruneAfterDeploy(ctx, deployment)
+	}
+
+	deployment.Complete(SucceededStatus)
+	err = deployer.config.RunHooks(ctx, HookStageAfterDeploy, deployment)
+	if err != nil {
+		logger.Error("error running after deploy hooks")
+
+		return err
+	}
+
+	return nil
+}
+
+func (deployer *Deployer) newDeployment(target *Target, imageTag string) *Deployment {
+	deployment := newDeploymentWithClock(target, imageTag, deployer.emitter, deployer.clock)
+	deployment.baseLogger = deployer.logger
+
+	return deployment
+}
+
+func (deployer *Deployer) planTaskDefinition(ctx context.Context, target *Target, name string, imageTag *string, taskDefinition *string, taskDefinitionFile *string, containers []string, logger *log.Entry) (*PlannedTaskDefinition, error) {
+	taskContainerUpdateable := make(map[string]bool)
+	for _, containerName := range containers {
+		taskContainerUpdateable[containerName] = true
+	}
+
+	taskDefinitionInput := GenerateTaskDefinitionInput{
+		ImageTag:             imageTag,
+		TaskDefinition:       taskDefinition,
+		UpdateableContainers: taskContainerUpdateable,
+		TaskDefinitionFile:   taskDefinitionFile,
+		TemplateData:         NewTaskDefinitionTemplateData(target.Cluster, *imageTag),
+	}
+	currentTaskDefinition, _, changes, err := buildTaskDefinition(ctx, &taskDefinitionInput, deployer.client, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	// There's no current task definition if a task definition file is for a
+	// family that hasn't been registered yet.
+	plannedTaskDefinition := &PlannedTaskDefinition{
+		Name:       name,
+		Containers: changes,
+	}
+	if currentTaskDefinition != nil {
+		plannedTaskDefinition.TaskDefinitionArn = *currentTaskDefinition.TaskDefinitionArn
+	}
+
+	return plannedTaskDefinition, nil
+}
+
+// forEach calls the function for each index up to count, in parallel but
+// with no more than the maximum concurrency running at the same time.
+func (deployer *Deployer) forEach(count int, fn func(index int)) {
+	limit := deployer.maxConcurrency
+	if limit <= 0 || limit > count {
+		limit = count
+	}
+
+	wg := sync.WaitGroup{}
+	semaphore := make(chan struct{}, limit)
+	for index := 0; index < count; index++ {
+		wg.Add(1)
+		semaphore <- struct{}{}
+
+		go func(index int) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			fn(index)
+		}(index)
+	}
+	wg.Wait()
+}
+
+func (deployer *Deployer) target(target *Target) (*Target, error) {
+	if target != nil {
+		return target, nil
+	}
+
+	targets := deployer.config.DeploymentTargets()
+	if len(targets) != 1 {
+		return nil, fmt.Errorf("target must be set, config has %d targets", len(targets))
+	}
+
+	return &targets[0], nil
+}
+
+// newStageCompleted summarises the results of the services or tasks in a
+// stage, it's only a success if none failed.
+func newStageCompleted(stage EventStage, results []itemResult) *StageCompleted {
+	stageCompleted := &StageCompleted{
+		EventMeta: EventMeta{Type: EventStageCompleted, Status: SucceededStatus},
+		Stage:     stage,
+		Total:     len(results),
+	}
+
+	for _, result := range results {
+		switch {
+		case result.err != nil && result.status == FailedStatus:
+			stageCompleted.Failed = stageCompleted.Failed + 1
+		case result.err != nil && result.status == SkippedStatus:
+			stageCompleted.Skipped = stageCompleted.Skipped + 1
+		}
+	}
+	stageCompleted.Successful = stageCompleted.Total - (stageCompleted.Failed + stageCompleted.Skipped)
+
+	return stageCompleted
+}
+
+func (clock systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (clock systemClock) After(duration time.Duration) <-chan time.Time {
+	return time.After(duration)
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+
+	return false
+}
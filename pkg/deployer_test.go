@@ -0,0 +1,604 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// fakeECSClient runs tasks that stop straight away, exiting with a non-zero
+// code if their family starts with `crash`. Task definitions of families that
+// start with `broken` can't be described. Services roll out as soon as they're
+// updated. Tags are kept by resource. Calls that aren't faked panic.
+type fakeECSClient struct {
+	ECSAPI
+
+	mutex          sync.Mutex
+	services       map[string]types.Service
+	tags           map[string]map[string]string
+	tasks          map[string]types.Task
+	runTasks       int
+	updateServices []ecs.UpdateServiceInput
+}
+
+func newFakeECSClient() *fakeECSClient {
+	return &fakeECSClient{services: map[string]types.Service{}, tags: map[string]map[string]string{}, tasks: map[string]types.Task{}}
+}
+
+// addService adds a stable service running revision 1 of the family named
+// after it.
+func (client *fakeECSClient) addService(cluster string, name string) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	serviceArn := fmt.Sprintf("arn:aws:ecs:us-east-1:123456789012:service/%s/%s", cluster, name)
+	client.services[name] = fakeService(serviceArn, name, *fakeTaskDefinition(name, 1, "app:v1").TaskDefinitionArn)
+}
+
+func (client *fakeECSClient) DescribeServices(ctx context.Context, params *ecs.DescribeServicesInput, optFns ...func(*ecs.Options)) (*ecs.DescribeServicesOutput, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	output := &ecs.DescribeServicesOutput{}
+	for _, name := range params.Services {
+		if service, ok := client.services[name]; ok {
+			output.Services = append(output.Services, service)
+		}
+	}
+
+	return output, nil
+}
+
+func (client *fakeECSClient) UpdateService(ctx context.Context, params *ecs.UpdateServiceInput, optFns ...func(*ecs.Options)) (*ecs.UpdateServiceOutput, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	service, ok := client.services[*params.Service]
+	if !ok {
+		return nil, fmt.Errorf("service %s not found", *params.Service)
+	}
+	client.updateServices = append(client.updateServices, *params)
+	service = fakeService(*service.ServiceArn, *service.ServiceName, *params.TaskDefinition)
+	client.services[*params.Service] = service
+
+	return &ecs.UpdateServiceOutput{Service: &service}, nil
+}
+
+func (client *fakeECSClient) TagResource(ctx context.Context, params *ecs.TagResourceInput, optFns ...func(*ecs.Options)) (*ecs.TagResourceOutput, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if client.tags[*params.ResourceArn] == nil {
+		client.tags[*params.ResourceArn] = map[string]string{}
+	}
+	for _, tag := range params.Tags {
+		client.tags[*params.ResourceArn][*tag.Key] = *tag.Value
+	}
+
+	return &ecs.TagResourceOutput{}, nil
+}
+
+func (client *fakeECSClient) UntagResource(ctx context.Context, params *ecs.UntagResourceInput, optFns ...func(*ecs.Options)) (*ecs.UntagResourceOutput, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	for _, key := range params.TagKeys {
+		delete(client.tags[*params.ResourceArn], key)
+	}
+
+	return &ecs.UntagResourceOutput{}, nil
+}
+
+func (client *fakeECSClient) ListTagsForResource(ctx context.Context, params *ecs.ListTagsForResourceInput, optFns ...func(*ecs.Options)) (*ecs.ListTagsForResourceOutput, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	output := &ecs.ListTagsForResourceOutput{}
+	output.Tags = ecsTags(client.tags[*params.ResourceArn])
+
+	return output, nil
+}
+
+func (client *fakeECSClient) DescribeClusters(ctx context.Context, params *ecs.DescribeClustersInput, optFns ...func(*ecs.Options)) (*ecs.DescribeClustersOutput, error) {
+	output := &ecs.DescribeClustersOutput{}
+	for _, cluster := range params.Clusters {
+		clusterArn := "arn:aws:ecs:us-east-1:123456789012:cluster/" + cluster
+		output.Clusters = append(output.Clusters, types.Cluster{ClusterName: stringPtr(cluster), ClusterArn: &clusterArn})
+	}
+
+	return output, nil
+}
+
+func (client *fakeECSClient) ListTasks(ctx context.Context, params *ecs.ListTasksInput, optFns ...func(*ecs.Options)) (*ecs.ListTasksOutput, error) {
+	return &ecs.ListTasksOutput{}, nil
+}
+
+func (client *fakeECSClient) DescribeTaskDefinition(ctx context.Context, params *ecs.DescribeTaskDefinitionInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTaskDefinitionOutput, error) {
+	family := *params.TaskDefinition
+	if strings.HasPrefix(family, "arn:") {
+		var err error
+		family, _, err = parseTaskDefinitionArn(family)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if strings.HasPrefix(family, "broken") {
+		return nil, fmt.Errorf("task definition %s not found", family)
+	}
+
+	return &ecs.DescribeTaskDefinitionOutput{TaskDefinition: fakeTaskDefinition(family, 1, "app:v1")}, nil
+}
+
+func (client *fakeECSClient) RegisterTaskDefinition(ctx context.Context, params *ecs.RegisterTaskDefinitionInput, optFns ...func(*ecs.Options)) (*ecs.RegisterTaskDefinitionOutput, error) {
+	return &ecs.RegisterTaskDefinitionOutput{TaskDefinition: fakeTaskDefinition(*params.Family, 2, *params.ContainerDefinitions[0].Image)}, nil
+}
+
+func (client *fakeECSClient) RunTask(ctx context.Context, params *ecs.RunTaskInput, optFns ...func(*ecs.Options)) (*ecs.RunTaskOutput, error) {
+	family, _, err := parseTaskDefinitionArn(*params.TaskDefinition)
+	if err != nil {
+		return nil, err
+	}
+
+	exitCode := int32(0)
+	if strings.HasPrefix(family, "crash") {
+		exitCode = 1
+	}
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	output := &ecs.RunTaskOutput{}
+	for index := int32(0); index < *params.Count; index++ {
+		client.runTasks++
+		taskArn := fmt.Sprintf("arn:aws:ecs:us-east-1:123456789012:task/%s/%s-%d", *params.Cluster, family, index)
+		task := types.Task{
+			TaskArn:           &taskArn,
+			TaskDefinitionArn: params.TaskDefinition,
+			LastStatus:        stringPtr("STOPPED"),
+			DesiredStatus:     stringPtr("STOPPED"),
+			Containers:        []types.Container{{Name: stringPtr("app"), ExitCode: &exitCode}},
+		}
+		client.tasks[taskArn] = task
+		output.Tasks = append(output.Tasks, task)
+	}
+
+	return output, nil
+}
+
+func (client *fakeECSClient) DescribeTasks(ctx context.Context, params *ecs.DescribeTasksInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTasksOutput, error) {
+	if len(params.Tasks) > maxTasksPerDescribe {
+		return nil, fmt.Errorf("too many tasks described at once: %d", len(params.Tasks))
+	}
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	output := &ecs.DescribeTasksOutput{}
+	for _, taskArn := range params.Tasks {
+		if task, ok := client.tasks[taskArn]; ok {
+			output.Tasks = append(output.Tasks, task)
+		}
+	}
+
+	return output, nil
+}
+
+// eventRecorder keeps the events published during a deployment, observers
+// are called from several goroutines at once.
+type eventRecorder struct {
+	mutex  sync.Mutex
+	events []DeploymentEvent
+}
+
+func (recorder *eventRecorder) Observe(event DeploymentEvent) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	recorder.events = append(recorder.events, event)
+}
+
+func (recorder *eventRecorder) stageCompleted(t *testing.T, stage EventStage) *StageCompleted {
+	t.Helper()
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	for _, event := range recorder.events {
+		if stageCompleted, ok := event.(*StageCompleted); ok && stageCompleted.Stage == stage {
+			return stageCompleted
+		}
+	}
+	t.Fatalf("no %s event for stage %s", EventStageCompleted, stage)
+
+	return nil
+}
+
+func fakeTaskDefinition(family string, revision int32, image string) *types.TaskDefinition {
+	arn := fmt.Sprintf("arn:aws:ecs:us-east-1:123456789012:task-definition/%s:%d", family, revision)
+
+	return &types.TaskDefinition{
+		Family:               &family,
+		Revision:             revision,
+		TaskDefinitionArn:    &arn,
+		ContainerDefinitions: []types.ContainerDefinition{{Name: stringPtr("app"), Image: &image}},
+	}
+}
+
+// fakeService is a stable service that has finished rolling out the task
+// definition.
+func fakeService(serviceArn string, name string, taskDefinitionArn string) types.Service {
+	return types.Service{
+		ServiceArn:     &serviceArn,
+		ServiceName:    &name,
+		Status:         stringPtr("ACTIVE"),
+		TaskDefinition: &taskDefinitionArn,
+		DesiredCount:   1,
+		RunningCount:   1,
+		Deployments: []types.Deployment{{
+			Id:             stringPtr("ecs-svc/" + name),
+			Status:         stringPtr("PRIMARY"),
+			RolloutState:   types.DeploymentRolloutStateCompleted,
+			TaskDefinition: &taskDefinitionArn,
+			DesiredCount:   1,
+			RunningCount:   1,
+		}},
+	}
+}
+
+// fakeLocker keeps the lock in memory, letting the owner take it again the
+// way the real backends do.
+type fakeLocker struct {
+	mutex    sync.Mutex
+	leases   map[string]LockLease
+	acquired int
+	released int
+}
+
+func newFakeLocker() *fakeLocker {
+	return &fakeLocker{leases: map[string]LockLease{}}
+}
+
+func (locker *fakeLocker) Acquire(ctx context.Context, lease *LockLease) error {
+	locker.mutex.Lock()
+	defer locker.mutex.Unlock()
+
+	current, ok := locker.leases[lease.Cluster+"/"+lease.Key]
+	if ok && current.Owner != lease.Owner && !current.Expired(lease.AcquiredAt) {
+		return &ErrLocked{Key: lease.Key, Owner: current.Owner, ExpiresAt: current.ExpiresAt}
+	}
+	locker.leases[lease.Cluster+"/"+lease.Key] = *lease
+	locker.acquired++
+
+	return nil
+}
+
+func (locker *fakeLocker) Renew(ctx context.Context, lease *LockLease) error {
+	locker.mutex.Lock()
+	defer locker.mutex.Unlock()
+
+	current, ok := locker.leases[lease.Cluster+"/"+lease.Key]
+	if !ok || current.Owner != lease.Owner {
+		return &ErrLockLost{Key: lease.Key}
+	}
+	locker.leases[lease.Cluster+"/"+lease.Key] = *lease
+
+	return nil
+}
+
+func (locker *fakeLocker) Release(ctx context.Context, lease *LockLease) error {
+	locker.mutex.Lock()
+	defer locker.mutex.Unlock()
+
+	current, ok := locker.leases[lease.Cluster+"/"+lease.Key]
+	if !ok || current.Owner != lease.Owner {
+		return &ErrLockLost{Key: lease.Key}
+	}
+	delete(locker.leases, lease.Cluster+"/"+lease.Key)
+	locker.released++
+
+	return nil
+}
+
+func (locker *fakeLocker) Status(ctx context.Context, cluster string, key string) (*LockLease, error) {
+	locker.mutex.Lock()
+	defer locker.mutex.Unlock()
+
+	current, ok := locker.leases[cluster+"/"+key]
+	if !ok {
+		return nil, nil
+	}
+
+	return &current, nil
+}
+
+func (locker *fakeLocker) ForceRelease(ctx context.Context, cluster string, key string) error {
+	locker.mutex.Lock()
+	defer locker.mutex.Unlock()
+
+	delete(locker.leases, cluster+"/"+key)
+
+	return nil
+}
+
+// held returns how many leases are held.
+func (locker *fakeLocker) held() int {
+	locker.mutex.Lock()
+	defer locker.mutex.Unlock()
+
+	return len(locker.leases)
+}
+
+func newTestDeployer(t *testing.T, config *Config, client ECSAPI, options ...DeployerOption) (*Deployer, *eventRecorder) {
+	t.Helper()
+
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+
+	recorder := &eventRecorder{}
+	options = append([]DeployerOption{
+		WithClient(client),
+		WithLogger(log.NewEntry(logger)),
+		WithObserver(recorder),
+		WithPollInterval(time.Millisecond),
+	}, options...)
+
+	deployer, err := NewDeployer(config, options...)
+	if err != nil {
+		t.Fatalf("unable to set up deployer: %v", err)
+	}
+
+	return deployer, recorder
+}
+
+func stringPtr(value string) *string {
+	return &value
+}
+
+func TestForEach(t *testing.T) {
+	testCases := []struct {
+		name           string
+		count          int
+		maxConcurrency int
+		wantPeak       int
+	}{
+		{name: "limited", count: 20, maxConcurrency: 3, wantPeak: 3},
+		{name: "limit above count", count: 4, maxConcurrency: 10, wantPeak: 4},
+		{name: "unlimited", count: 8, maxConcurrency: 0, wantPeak: 8},
+		{name: "nothing to do", count: 0, maxConcurrency: 2, wantPeak: 0},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			deployer, _ := newTestDeployer(t, &Config{}, newFakeECSClient(), WithMaxConcurrency(testCase.maxConcurrency))
+
+			mutex := sync.Mutex{}
+			running, peak := 0, 0
+			calls := make([]int, testCase.count)
+			deployer.forEach(testCase.count, func(index int) {
+				mutex.Lock()
+				running++
+				if running > peak {
+					peak = running
+				}
+				calls[index]++
+				mutex.Unlock()
+
+				// Hold on long enough for the others to start, if allowed.
+				time.Sleep(20 * time.Millisecond)
+
+				mutex.Lock()
+				running--
+				mutex.Unlock()
+			})
+
+			for index, count := range calls {
+				if count != 1 {
+					t.Errorf("index %d called %d times, want 1", index, count)
+				}
+			}
+			if peak != testCase.wantPeak {
+				t.Errorf("peak concurrency %d, want %d", peak, testCase.wantPeak)
+			}
+		})
+	}
+}
+
+func TestNewStageCompleted(t *testing.T) {
+	errFailed := errors.New("failed")
+	results := []itemResult{
+		{name: "a", status: SucceededStatus},
+		{name: "b", status: FailedStatus, err: errFailed},
+		{name: "c", status: SkippedStatus, err: errFailed},
+		{name: "d", status: SucceededStatus},
+		{name: "e", status: FailedStatus, err: errFailed},
+	}
+
+	stageCompleted := newStageCompleted(EventStageServices, results)
+	if stageCompleted.Total != 5 || stageCompleted.Successful != 2 || stageCompleted.Skipped != 1 || stageCompleted.Failed != 2 {
+		t.Errorf("got total: %d, successful: %d, skipped: %d, failed: %d, want 5, 2, 1, 2", stageCompleted.Total, stageCompleted.Successful, stageCompleted.Skipped, stageCompleted.Failed)
+	}
+}
+
+func TestDeployServicesSummary(t *testing.T) {
+	serviceConfigs := []*Service{}
+	for index := 0; index < 30; index++ {
+		serviceConfigs = append(serviceConfigs, &Service{Name: fmt.Sprintf("service-%02d", index)})
+	}
+
+	for _, maxConcurrency := range []int{0, 1, 4} {
+		t.Run(fmt.Sprintf("max parallel %d", maxConcurrency), func(t *testing.T) {
+			deployer, recorder := newTestDeployer(t, &Config{}, newFakeECSClient(), WithMaxConcurrency(maxConcurrency))
+			deployment := deployer.newDeployment(&Target{Cluster: "test"}, "v2")
+
+			// Every third service fails and every third one after that is
+			// skipped.
+			err := deployer.deployServices(context.Background(), deployment, serviceConfigs, func(ctx context.Context, serviceConfig *Service, logger *log.Entry) (Status, error) {
+				var index int
+				fmt.Sscanf(serviceConfig.Name, "service-%d", &index)
+
+				switch index % 3 {
+				case 0:
+					return FailedStatus, errors.New("failed")
+				case 1:
+					return SkippedStatus, errors.New("not found")
+				default:
+					return SucceededStatus, nil
+				}
+			})
+			if err == nil {
+				t.Error("expected an error with failed services")
+			}
+
+			stageCompleted := recorder.stageCompleted(t, EventStageServices)
+			if stageCompleted.Total != 30 || stageCompleted.Successful != 10 || stageCompleted.Skipped != 10 || stageCompleted.Failed != 10 {
+				t.Errorf("got total: %d, successful: %d, skipped: %d, failed: %d, want 30, 10, 10, 10", stageCompleted.Total, stageCompleted.Successful, stageCompleted.Skipped, stageCompleted.Failed)
+			}
+			if stageCompleted.Status != FailedStatus {
+				t.Errorf("got stage status %s, want %s", stageCompleted.Status, FailedStatus)
+			}
+
+			statuses := deployment.ServiceStatuses()
+			if len(statuses) != 30 {
+				t.Errorf("got %d service statuses, want 30", len(statuses))
+			}
+			for index, serviceConfig := range serviceConfigs {
+				want := []Status{FailedStatus, SkippedStatus, SucceededStatus}[index%3]
+				if statuses[serviceConfig.Name] != want {
+					t.Errorf("service %s has status %s, want %s", serviceConfig.Name, statuses[serviceConfig.Name], want)
+				}
+			}
+		})
+	}
+}
+
+func TestDeployTasksSummary(t *testing.T) {
+	config := &Config{}
+	for index := 0; index < 12; index++ {
+		family := fmt.Sprintf("migrate-%02d", index)
+		switch index % 4 {
+		case 0:
+			family = fmt.Sprintf("broken-%02d", index)
+		case 1:
+			family = fmt.Sprintf("crash-%02d", index)
+		}
+		config.Tasks.Pre = append(config.Tasks.Pre, Task{Family: family, Containers: []string{"app"}, Count: 3})
+	}
+
+	for _, maxConcurrency := range []int{0, 2} {
+		t.Run(fmt.Sprintf("max parallel %d", maxConcurrency), func(t *testing.T) {
+			client := newFakeECSClient()
+			deployer, recorder := newTestDeployer(t, config, client, WithMaxConcurrency(maxConcurrency))
+			deployment := deployer.newDeployment(&Target{Cluster: "test"}, "v2")
+
+			err := deployer.deployTasks(context.Background(), deployment, TaskStagePre)
+			if err == nil {
+				t.Error("expected an error with failed tasks")
+			}
+
+			stageCompleted := recorder.stageCompleted(t, EventStagePreTasks)
+			if stageCompleted.Total != 12 || stageCompleted.Successful != 6 || stageCompleted.Skipped != 0 || stageCompleted.Failed != 6 {
+				t.Errorf("got total: %d, successful: %d, skipped: %d, failed: %d, want 12, 6, 0, 6", stageCompleted.Total, stageCompleted.Successful, stageCompleted.Skipped, stageCompleted.Failed)
+			}
+
+			statuses := deployment.TaskStatuses(TaskStagePre)
+			for _, taskConfig := range config.Tasks.Pre {
+				want := SucceededStatus
+				if strings.HasPrefix(taskConfig.Family, "broken") || strings.HasPrefix(taskConfig.Family, "crash") {
+					want = FailedStatus
+				}
+				if statuses[taskConfig.Family] != want {
+					t.Errorf("task %s has status %s, want %s", taskConfig.Family, statuses[taskConfig.Family], want)
+				}
+			}
+
+			// Broken task definitions never get as far as running tasks.
+			if client.runTasks != 9*3 {
+				t.Errorf("got %d tasks run, want %d", client.runTasks, 9*3)
+			}
+			if registered := len(deployment.TaskDefinitions()); registered != 9 {
+				t.Errorf("got %d task definitions registered, want 9", registered)
+			}
+		})
+	}
+}
+
+func TestDeployRollbackKeepsLock(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	retries := 0
+	rollback := true
+	config := &Config{
+		Cluster:  "test",
+		Lock:     &Lock{},
+		Services: []Service{{Name: "app-web-server", Containers: []string{"app"}}},
+		Verify: &Verify{
+			Checks:   []VerifyCheck{{URL: server.URL, Retries: &retries}},
+			Rollback: &rollback,
+		},
+	}
+
+	client := newFakeECSClient()
+	client.addService("test", "app-web-server")
+	locker := newFakeLocker()
+
+	// The lock must still be held by the deployment once the failed
+	// verification has rolled the services back.
+	var heldAfterRollback int
+	deployer, _ := newTestDeployer(t, config, client, WithLocker(locker), WithObserver(DeploymentObserverFunc(func(event DeploymentEvent) {
+		if deploymentFinished, ok := event.(*DeploymentFinished); ok && deploymentFinished.Status == FailedStatus {
+			heldAfterRollback = locker.held()
+		}
+	})))
+
+	result, err := deployer.Deploy(context.Background(), &DeployInput{ImageTag: "v2"})
+	var verificationErr *ErrVerificationFailed
+	if !errors.As(err, &verificationErr) {
+		t.Fatalf("got error %v, want verification failure", err)
+	}
+	if result.Status != FailedStatus {
+		t.Errorf("got status %s, want %s", result.Status, FailedStatus)
+	}
+
+	// The service is updated to the new revision, then back to the old one.
+	if len(client.updateServices) != 2 || *client.updateServices[1].TaskDefinition != result.PreviousTaskDefinitions["app-web-server"] {
+		t.Errorf("expected the service to be rolled back, got %d updates", len(client.updateServices))
+	}
+
+	if heldAfterRollback != 1 {
+		t.Errorf("got %d leases held after the rollback, want 1", heldAfterRollback)
+	}
+	if locker.acquired != 1 || locker.released != 1 || locker.held() != 0 {
+		t.Errorf("got acquired: %d, released: %d, held: %d, want 1, 1, 0", locker.acquired, locker.released, locker.held())
+	}
+}
@@ -0,0 +1,262 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Deployment keeps track of a deployment of the application to a target,
+// collecting the outcome of each task and service as the deployment
+// progresses. It's safe for concurrent use.
+type Deployment struct {
+	// Identifies the deployment, it's tagged onto what the deployment changes
+	// so that it can be traced back.
+	ID string
+
+	// The docker image tag that the containers are being updated to.
+	ImageTag string
+
+	// The target that the application is being deployed to.
+	Target *Target
+
+	baseLogger              *log.Entry
+	clock                   Clock
+	downtimes               []Downtime
+	emitter                 *EventEmitter
+	mutex                   sync.Mutex
+	previousTaskDefinitions map[string]string
+	services                map[string]Status
+	status                  Status
+	tags                    map[string]string
+	taskDefinitions         []string
+	tasks                   map[TaskStage]map[string]Status
+}
+
+// Downtime is a window of time during which a service had no tasks running
+// because it was being recreated. A service that didn't recover was still
+// down at the end of the window, its deployment having failed.
+type Downtime struct {
+	Service   string    `json:"service"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Recovered bool      `json:"recovered"`
+}
+
+func NewDeployment(target *Target, imageTag string, emitter *EventEmitter) *Deployment {
+	return newDeploymentWithClock(target, imageTag, emitter, systemClock{})
+}
+
+// newDeploymentWithClock sets up a deployment that tells the time, its ID
+// included, with the clock.
+func newDeploymentWithClock(target *Target, imageTag string, emitter *EventEmitter, clock Clock) *Deployment {
+	return &Deployment{
+		ID:                      newDeploymentID(clock.Now()),
+		ImageTag:                imageTag,
+		Target:                  target,
+		baseLogger:              log.NewEntry(log.StandardLogger()),
+		clock:                   clock,
+		emitter:                 emitter,
+		previousTaskDefinitions: map[string]string{},
+		services:                map[string]Status{},
+		status:                  RunningStatus,
+		tasks: map[TaskStage]map[string]Status{
+			TaskStagePre:  {},
+			TaskStagePost: {},
+		},
+	}
+}
+
+// Status returns the overall status of the deployment.
+func (deployment *Deployment) Status() Status {
+	deployment.mutex.Lock()
+	defer deployment.mutex.Unlock()
+
+	return deployment.status
+}
+
+// ServiceStatuses returns the status of each service that has been deployed
+// so far.
+func (deployment *Deployment) ServiceStatuses() map[string]Status {
+	deployment.mutex.Lock()
+	defer deployment.mutex.Unlock()
+
+	return copyStatuses(deployment.services)
+}
+
+// TaskStatuses returns the status of each task in the stage that has been run
+// so far.
+func (deployment *Deployment) TaskStatuses(stage TaskStage) map[string]Status {
+	deployment.mutex.Lock()
+	defer deployment.mutex.Unlock()
+
+	return copyStatuses(deployment.tasks[stage])
+}
+
+// TaskDefinitions returns the ARNs of the task definitions that have been
+// registered so far, in the order they were registered.
+func (deployment *Deployment) TaskDefinitions() []string {
+	deployment.mutex.Lock()
+	defer deployment.mutex.Unlock()
+
+	return append([]string{}, deployment.taskDefinitions...)
+}
+
+// PreviousTaskDefinitions returns the ARNs of the task definitions that the
+// services used before they were updated, useful for rolling back.
+func (deployment *Deployment) PreviousTaskDefinitions() map[string]string {
+	deployment.mutex.Lock()
+	defer deployment.mutex.Unlock()
+
+	previous := make(map[string]string, len(deployment.previousTaskDefinitions))
+	for service, arn := range deployment.previousTaskDefinitions {
+		previous[service] = arn
+	}
+
+	return previous
+}
+
+// Downtimes returns the windows of time during which services were down so
+// far, ordered by service name.
+func (deployment *Deployment) Downtimes() []Downtime {
+	deployment.mutex.Lock()
+	defer deployment.mutex.Unlock()
+
+	downtimes := append([]Downtime{}, deployment.downtimes...)
+	sort.Slice(downtimes, func(i, j int) bool {
+		return downtimes[i].Service < downtimes[j].Service
+	})
+
+	return downtimes
+}
+
+// Start marks the beginning of the deployment.
+func (deployment *Deployment) Start() {
+	deployment.publish(&DeploymentStarted{EventMeta: EventMeta{Type: EventDeploymentStarted, Status: RunningStatus}})
+}
+
+// Complete sets the final status of the deployment, it can be called more
+// than once e.g. if something fails after the deployment has succeeded.
+func (deployment *Deployment) Complete(status Status) {
+	deployment.mutex.Lock()
+	defer deployment.mutex.Unlock()
+
+	deployment.status = status
+}
+
+// Finish marks the end of the deployment, it should only be called once
+// nothing else is left to be done.
+func (deployment *Deployment) Finish() {
+	deployment.publish(&DeploymentFinished{EventMeta: EventMeta{Type: EventDeploymentFinished, Status: deployment.Status()}})
+}
+
+// publish fills in the details of the deployment that are common to all
+// events and passes the event on to the observers.
+func (deployment *Deployment) publish(event DeploymentEvent) {
+	meta := event.Meta()
+	meta.Time = deployment.clock.Now().UTC()
+	meta.Cluster = deployment.Target.Cluster
+	meta.DeploymentID = deployment.ID
+	meta.ImageTag = deployment.ImageTag
+	if deployment.Target.Region != nil {
+		meta.Region = *deployment.Target.Region
+	}
+
+	deployment.emitter.Observe(event)
+}
+
+// logger sets up a logger with the details of the target.
+func (deployment *Deployment) logger() *log.Entry {
+	return deployment.Target.loggerFrom(deployment.baseLogger)
+}
+
+func (deployment *Deployment) recordDowntime(downtime Downtime) {
+	deployment.mutex.Lock()
+	defer deployment.mutex.Unlock()
+
+	deployment.downtimes = append(deployment.downtimes, downtime)
+}
+
+func (deployment *Deployment) recordPreviousTaskDefinition(service string, arn string) {
+	deployment.mutex.Lock()
+	defer deployment.mutex.Unlock()
+
+	deployment.previousTaskDefinitions[service] = arn
+}
+
+func (deployment *Deployment) recordService(name string, status Status) {
+	deployment.mutex.Lock()
+	defer deployment.mutex.Unlock()
+
+	deployment.services[name] = status
+}
+
+func (deployment *Deployment) recordTask(stage TaskStage, family string, status Status) {
+	deployment.mutex.Lock()
+	defer deployment.mutex.Unlock()
+
+	deployment.tasks[stage][family] = status
+}
+
+func (deployment *Deployment) recordTaskDefinition(arn string) {
+	deployment.mutex.Lock()
+	defer deployment.mutex.Unlock()
+
+	deployment.taskDefinitions = append(deployment.taskDefinitions, arn)
+}
+
+// Duration is how long the service was down for.
+func (downtime Downtime) Duration() time.Duration {
+	return downtime.End.Sub(downtime.Start)
+}
+
+func copyStatuses(statuses map[string]Status) map[string]Status {
+	copied := make(map[string]Status, len(statuses))
+	for name, status := range statuses {
+		copied[name] = status
+	}
+
+	return copied
+}
+
+// sortedStatusNames returns the names in the map in a stable order so that
+// whatever is generated from them is predictable.
+func sortedStatusNames(statuses map[string]Status) []string {
+	names := make([]string, 0, len(statuses))
+	for name := range statuses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// newDeploymentID makes up an ID that sorts in the order deployments started
+// e.g. 20230102T150405Z-5f3a9c.
+func newDeploymentID(now time.Time) string {
+	suffix := make([]byte, 3)
+	_, _ = rand.Read(suffix)
+
+	return fmt.Sprintf("%s-%s", now.UTC().Format("20060102T150405Z"), hex.EncodeToString(suffix))
+}
@@ -0,0 +1,269 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The keys of the tags holding the deployment metadata, set on the task
+// definitions registered and the services updated by a deployment.
+const (
+	TagCIRunURL     = "ecs-toolkit:ci-run-url"
+	TagDeployedAt   = "ecs-toolkit:deployed-at"
+	TagDeployedBy   = "ecs-toolkit:deployed-by"
+	TagDeploymentID = "ecs-toolkit:deployment-id"
+	TagGitCommit    = "ecs-toolkit:git-commit"
+	TagImageTag     = "ecs-toolkit:image-tag"
+
+	// TagServiceDeployment is only set on services, it holds the ID of the
+	// service deployment started by updating the service so that updates made
+	// outside of ecs-toolkit can be told apart.
+	TagServiceDeployment = "ecs-toolkit:service-deployment"
+)
+
+const (
+	// maxResourceTags is the most tags a resource can have.
+	maxResourceTags = 50
+
+	// maxTagKeyLength is the longest a resource tag key can be.
+	maxTagKeyLength = 128
+
+	// maxTagValueLength is the longest a resource tag value can be.
+	maxTagValueLength = 256
+)
+
+// ValidateTagKey checks that the key can be used for a resource tag, it must
+// be 1 to 128 letters, numbers, spaces or `_.:/=+-@` and not start with the
+// `aws:` prefix reserved by AWS.
+func ValidateTagKey(key string) error {
+	var validKeyRegex = regexp.MustCompile(`^[\pL\pZ\pN_.:/=+@-]+$`)
+
+	switch {
+	case key == "":
+		return errors.New("tag key should not be empty")
+	case len([]rune(key)) > maxTagKeyLength:
+		return fmt.Errorf("tag key %q should be no longer than %d characters", key, maxTagKeyLength)
+	case strings.HasPrefix(strings.ToLower(key), "aws:"):
+		return fmt.Errorf("tag key %q should not start with aws:", key)
+	case !validKeyRegex.MatchString(key):
+		return fmt.Errorf("tag key %q should only contain letters, numbers, spaces and _.:/=+-@", key)
+	}
+
+	return nil
+}
+
+// deploymentTags puts together the tags for the deployment, the metadata
+// first, then the tags in the config and finally the annotations, each taking
+// precedence over the ones before. It fails if the keys are invalid or there
+// are too many tags to set on a resource, so that it's known before anything
+// is changed.
+func (deployer *Deployer) deploymentTags(deployment *Deployment, annotations map[string]string) (map[string]string, error) {
+	tags := map[string]string{
+		TagDeploymentID: deployment.ID,
+		TagImageTag:     deployment.ImageTag,
+		TagDeployedBy:   deployedBy(),
+		TagDeployedAt:   deployer.clock.Now().UTC().Format(time.RFC3339),
+	}
+
+	if gitCommit := firstEnv("GITHUB_SHA", "CI_COMMIT_SHA", "CIRCLE_SHA1", "BITBUCKET_COMMIT", "GIT_COMMIT"); gitCommit != "" {
+		tags[TagGitCommit] = gitCommit
+	}
+
+	if ciRunURL := ciRunURL(); ciRunURL != "" {
+		tags[TagCIRunURL] = ciRunURL
+	}
+
+	for key, value := range deployer.config.Tags {
+		tags[key] = os.ExpandEnv(value)
+	}
+
+	for key, value := range annotations {
+		tags[key] = value
+	}
+
+	for key, value := range tags {
+		err := ValidateTagKey(key)
+		if err != nil {
+			return nil, err
+		}
+		tags[key] = tagValue(value)
+	}
+
+	// Services are tagged with the ID of their service deployment as well.
+	if count := len(tags) + 1; count > maxResourceTags {
+		return nil, fmt.Errorf("deployment has %d tags including its metadata, no more than %d are allowed", count, maxResourceTags)
+	}
+
+	return tags, nil
+}
+
+// tagService tags the updated service with the deployment's tags and the ID
+// of its primary service deployment. The service has already been updated by
+// then so failing to do so is only logged.
+func (deployer *Deployer) tagService(ctx context.Context, deployment *Deployment, service *types.Service, serviceSublogger *log.Entry) {
+	if service == nil || service.ServiceArn == nil {
+		return
+	}
+
+	tags := map[string]string{}
+	for key, value := range deployment.tags {
+		tags[key] = value
+	}
+	if serviceDeploymentID := primaryServiceDeploymentID(service); serviceDeploymentID != "" {
+		tags[TagServiceDeployment] = serviceDeploymentID
+	}
+	if len(tags) == 0 {
+		return
+	}
+
+	_, err := deployer.client.TagResource(ctx, &ecs.TagResourceInput{
+		ResourceArn: service.ServiceArn,
+		Tags:        ecsTags(tags),
+	})
+	if err != nil {
+		serviceSublogger.Warnf("unable to tag service with deployment metadata: %v", err)
+
+		return
+	}
+	serviceSublogger.Debug("tagged service with deployment metadata")
+}
+
+// primaryServiceDeploymentID returns the ID of the service deployment that's
+// rolling out or running the service's task definition.
+func primaryServiceDeploymentID(service *types.Service) string {
+	for _, serviceDeployment := range service.Deployments {
+		if serviceDeployment.Status != nil && *serviceDeployment.Status == "PRIMARY" && serviceDeployment.Id != nil {
+			return *serviceDeployment.Id
+		}
+	}
+
+	return ""
+}
+
+// mergeTags returns the current tags with the given ones added, replacing any
+// with the same key. The deployment metadata of the current tags is left out,
+// it describes the deployment that set it rather than this one. It fails if
+// there would be more tags than can be set on a resource.
+func mergeTags(current []types.Tag, tags map[string]string) ([]types.Tag, error) {
+	merged := []types.Tag{}
+	for _, tag := range current {
+		if tag.Key == nil || strings.HasPrefix(*tag.Key, "ecs-toolkit:") {
+			continue
+		}
+		if _, ok := tags[*tag.Key]; ok {
+			continue
+		}
+		merged = append(merged, tag)
+	}
+	merged = append(merged, ecsTags(tags)...)
+
+	if len(merged) > maxResourceTags {
+		return nil, fmt.Errorf("task definition would have %d tags, no more than %d are allowed", len(merged), maxResourceTags)
+	}
+
+	return merged, nil
+}
+
+// ecsTags turns the tags into ECS tags, sorted by key.
+func ecsTags(tags map[string]string) []types.Tag {
+	keys := []string{}
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	ecsTags := []types.Tag{}
+	for _, key := range keys {
+		key, value := key, tags[key]
+		ecsTags = append(ecsTags, types.Tag{Key: &key, Value: &value})
+	}
+
+	return ecsTags
+}
+
+// tagValue keeps to the characters and length allowed in resource tag
+// values, replacing anything else.
+func tagValue(value string) string {
+	var invalidCharactersRegex = regexp.MustCompile(`[^\pL\pZ\pN_.:/=+@-]`)
+
+	value = invalidCharactersRegex.ReplaceAllString(value, "-")
+	if runes := []rune(value); len(runes) > maxTagValueLength {
+		value = string(runes[:maxTagValueLength])
+	}
+
+	return value
+}
+
+// deployedBy identifies who's deploying, the user that triggered the CI run
+// if there's one otherwise the local user and host.
+func deployedBy() string {
+	if actor := firstEnv("GITHUB_ACTOR", "GITLAB_USER_LOGIN", "CIRCLE_USERNAME", "BITBUCKET_STEP_TRIGGERER_UUID", "BUILD_USER_ID"); actor != "" {
+		return actor
+	}
+
+	return localIdentity()
+}
+
+// localIdentity identifies the local user and host.
+func localIdentity() string {
+	username := "unknown"
+	if current, err := user.Current(); err == nil {
+		username = current.Username
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	return fmt.Sprintf("%s@%s", username, hostname)
+}
+
+// ciRunURL links to the CI run doing the deployment, if there's one.
+func ciRunURL() string {
+	if os.Getenv("GITHUB_RUN_ID") != "" {
+		return fmt.Sprintf("%s/%s/actions/runs/%s", os.Getenv("GITHUB_SERVER_URL"), os.Getenv("GITHUB_REPOSITORY"), os.Getenv("GITHUB_RUN_ID"))
+	}
+
+	return firstEnv("CI_JOB_URL", "CIRCLE_BUILD_URL", "BUILD_URL")
+}
+
+// firstEnv returns the value of the first of the environment variables that
+// is set.
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,454 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+type ChangeType string
+
+const (
+	ChangeTypeAdded    ChangeType = "added"
+	ChangeTypeModified ChangeType = "modified"
+	ChangeTypeRemoved  ChangeType = "removed"
+)
+
+type DiffServiceInput struct {
+	// The target the service is in. Defaults to the only target in the
+	// config, it must be set if the config has several targets.
+	Target *Target
+
+	// The name of the service in the config.
+	//
+	// This member is required.
+	Service string
+
+	// The docker image tag the next deployment would update the containers
+	// to.
+	//
+	// This member is required.
+	ImageTag string
+}
+
+// TaskDefinitionDiff lists the differences between two task definitions.
+type TaskDefinitionDiff struct {
+	// The task definition compared from.
+	From string
+
+	// The task definition compared to, empty if it hasn't been registered
+	// yet.
+	To string
+
+	Changes []TaskDefinitionChange
+}
+
+// TaskDefinitionChange is a difference in a field of a task definition or of
+// one of its containers.
+type TaskDefinitionChange struct {
+	Type ChangeType
+
+	// The name of the container the field is in, empty for fields of the
+	// task definition itself.
+	Container string
+
+	// The field that changed e.g. `image` or `environment.RAILS_ENV`, empty
+	// if the whole container was added or removed.
+	Field string
+
+	// The value before and after the change, empty if the field was added or
+	// removed respectively. Values other than strings are encoded as JSON.
+	Old string
+	New string
+}
+
+// DiffTaskDefinitions compares two task definitions, each given as a family
+// and revision (family:revision) or full ARN.
+func (deployer *Deployer) DiffTaskDefinitions(ctx context.Context, from string, to string) (*TaskDefinitionDiff, error) {
+	fromTaskDefinition, err := deployer.describeTaskDefinition(ctx, from)
+	if err != nil {
+		return nil, err
+	}
+
+	toTaskDefinition, err := deployer.describeTaskDefinition(ctx, to)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &TaskDefinitionDiff{
+		From:    *fromTaskDefinition.TaskDefinitionArn,
+		To:      *toTaskDefinition.TaskDefinitionArn,
+		Changes: diffTaskDefinitions(registerTaskDefinitionInput(fromTaskDefinition), registerTaskDefinitionInput(toTaskDefinition)),
+	}
+
+	return diff, nil
+}
+
+// DiffService compares the task definition the service currently uses with
+// the one the next deployment of the image tag would register.
+func (deployer *Deployer) DiffService(ctx context.Context, input *DiffServiceInput) (*TaskDefinitionDiff, error) {
+	target, err := deployer.target(input.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	var serviceConfig *Service
+	for index := range deployer.config.Services {
+		if deployer.config.Services[index].Name == input.Service {
+			serviceConfig = &deployer.config.Services[index]
+		}
+	}
+	if serviceConfig == nil {
+		return nil, errors.New("unable to diff service not in the config")
+	}
+	serviceSublogger := target.loggerFrom(deployer.logger).WithField("service", serviceConfig.Name)
+
+	service, err := deployer.describeService(ctx, &target.Cluster, serviceConfig.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceContainerUpdateable := make(map[string]bool)
+	for _, containerName := range serviceConfig.Containers {
+		serviceContainerUpdateable[containerName] = true
+	}
+
+	taskDefinitionInput := GenerateTaskDefinitionInput{
+		ImageTag:             &input.ImageTag,
+		TaskDefinition:       service.TaskDefinition,
+		UpdateableContainers: serviceContainerUpdateable,
+		TaskDefinitionFile:   serviceConfig.TaskDefinitionFile,
+		TemplateData:         NewTaskDefinitionTemplateData(target.Cluster, input.ImageTag),
+	}
+	currentTaskDefinition, registerTaskDefinitionParams, _, err := buildTaskDefinition(ctx, &taskDefinitionInput, deployer.client, serviceSublogger)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &TaskDefinitionDiff{
+		From:    *currentTaskDefinition.TaskDefinitionArn,
+		Changes: diffTaskDefinitions(registerTaskDefinitionInput(currentTaskDefinition), registerTaskDefinitionParams),
+	}
+
+	return diff, nil
+}
+
+func (deployer *Deployer) describeTaskDefinition(ctx context.Context, taskDefinition string) (*types.TaskDefinition, error) {
+	taskDefinitionResult, err := deployer.client.DescribeTaskDefinition(ctx, &ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: &taskDefinition,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return taskDefinitionResult.TaskDefinition, nil
+}
+
+// diffTaskDefinitions compares the fields of the task definitions first, then
+// those of their containers matched up by name. Tags are left out since every
+// deployment changes them, as are the defaults ECS fills in on registration.
+func diffTaskDefinitions(from *ecs.RegisterTaskDefinitionInput, to *ecs.RegisterTaskDefinitionInput) []TaskDefinitionChange {
+	from, to = normalizeTaskDefinition(from), normalizeTaskDefinition(to)
+	changes := diffFields("", flattenFields(from, "containerDefinitions", "tags"), flattenFields(to, "containerDefinitions", "tags"))
+
+	fromContainers := map[string]types.ContainerDefinition{}
+	for _, containerDefinition := range from.ContainerDefinitions {
+		fromContainers[*containerDefinition.Name] = containerDefinition
+	}
+
+	toContainers := map[string]bool{}
+	for _, containerDefinition := range to.ContainerDefinitions {
+		containerName := *containerDefinition.Name
+		toContainers[containerName] = true
+
+		fromContainer, ok := fromContainers[containerName]
+		if !ok {
+			changes = append(changes, TaskDefinitionChange{Type: ChangeTypeAdded, Container: containerName, New: *containerDefinition.Image})
+
+			continue
+		}
+		changes = append(changes, diffFields(containerName, flattenContainer(fromContainer), flattenContainer(containerDefinition))...)
+	}
+
+	for _, containerDefinition := range from.ContainerDefinitions {
+		if !toContainers[*containerDefinition.Name] {
+			changes = append(changes, TaskDefinitionChange{Type: ChangeTypeRemoved, Container: *containerDefinition.Name, Old: *containerDefinition.Image})
+		}
+	}
+
+	return changes
+}
+
+// normalizeTaskDefinition returns a copy of the task definition with the
+// defaults ECS fills in on registration set, so that a task definition that
+// leaves them out matches the one ECS describes once it's registered.
+func normalizeTaskDefinition(taskDefinition *ecs.RegisterTaskDefinitionInput) *ecs.RegisterTaskDefinitionInput {
+	normalized := *taskDefinition
+	normalized.Cpu = normalizeTaskSize(taskDefinition.Cpu, "vcpu")
+	normalized.Memory = normalizeTaskSize(taskDefinition.Memory, "gb")
+
+	// Ports are mapped to the same port on the host when the task has its
+	// own network interface or uses the host's.
+	samePorts := taskDefinition.NetworkMode == types.NetworkModeAwsvpc || taskDefinition.NetworkMode == types.NetworkModeHost
+
+	normalized.ContainerDefinitions = []types.ContainerDefinition{}
+	for _, containerDefinition := range taskDefinition.ContainerDefinitions {
+		if containerDefinition.Essential == nil {
+			essential := true
+			containerDefinition.Essential = &essential
+		}
+
+		portMappings := []types.PortMapping{}
+		for _, portMapping := range containerDefinition.PortMappings {
+			if portMapping.Protocol == "" {
+				portMapping.Protocol = types.TransportProtocolTcp
+			}
+			switch {
+			case portMapping.HostPort == nil && samePorts:
+				portMapping.HostPort = portMapping.ContainerPort
+			case portMapping.HostPort != nil && *portMapping.HostPort == 0 && !samePorts:
+				// A dynamic host port is described as 0.
+				portMapping.HostPort = nil
+			}
+			portMappings = append(portMappings, portMapping)
+		}
+		containerDefinition.PortMappings = portMappings
+
+		if containerDefinition.HealthCheck != nil {
+			healthCheck := *containerDefinition.HealthCheck
+			healthCheck.Interval = int32OrDefault(healthCheck.Interval, 30)
+			healthCheck.Retries = int32OrDefault(healthCheck.Retries, 3)
+			healthCheck.Timeout = int32OrDefault(healthCheck.Timeout, 5)
+			containerDefinition.HealthCheck = &healthCheck
+		}
+
+		normalized.ContainerDefinitions = append(normalized.ContainerDefinitions, containerDefinition)
+	}
+
+	return &normalized
+}
+
+// normalizeTaskSize turns a task size given in units e.g. `0.5 vCPU` or `1 GB`
+// into the CPU units or MiB that ECS describes it in.
+func normalizeTaskSize(size *string, unit string) *string {
+	if size == nil {
+		return nil
+	}
+
+	value := strings.ToLower(strings.TrimSpace(*size))
+	if !strings.HasSuffix(value, unit) {
+		return size
+	}
+
+	amount, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(value, unit)), 64)
+	if err != nil {
+		return size
+	}
+	normalized := strconv.Itoa(int(amount * 1024))
+
+	return &normalized
+}
+
+func int32OrDefault(value *int32, defaultValue int32) *int32 {
+	if value != nil {
+		return value
+	}
+
+	return &defaultValue
+}
+
+// diffFields compares flattened fields, sorted by name.
+func diffFields(container string, from map[string]string, to map[string]string) []TaskDefinitionChange {
+	fields := []string{}
+	for field := range from {
+		fields = append(fields, field)
+	}
+	for field := range to {
+		if _, ok := from[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	changes := []TaskDefinitionChange{}
+	for _, field := range fields {
+		oldValue, inFrom := from[field]
+		newValue, inTo := to[field]
+
+		switch {
+		case !inFrom:
+			changes = append(changes, TaskDefinitionChange{Type: ChangeTypeAdded, Container: container, Field: field, New: newValue})
+		case !inTo:
+			changes = append(changes, TaskDefinitionChange{Type: ChangeTypeRemoved, Container: container, Field: field, Old: oldValue})
+		case oldValue != newValue:
+			changes = append(changes, TaskDefinitionChange{Type: ChangeTypeModified, Container: container, Field: field, Old: oldValue, New: newValue})
+		}
+	}
+
+	return changes
+}
+
+// flattenContainer flattens the fields of the container, with environment
+// variables and secrets broken out by name so that changes to them stand out.
+func flattenContainer(containerDefinition types.ContainerDefinition) map[string]string {
+	fields := flattenFields(containerDefinition, "environment", "name", "secrets")
+	for _, variable := range containerDefinition.Environment {
+		if variable.Name != nil && variable.Value != nil {
+			fields["environment."+*variable.Name] = *variable.Value
+		}
+	}
+	for _, secret := range containerDefinition.Secrets {
+		if secret.Name != nil && secret.ValueFrom != nil {
+			fields["secrets."+*secret.Name] = *secret.ValueFrom
+		}
+	}
+
+	return fields
+}
+
+// flattenFields encodes each field of the struct, leaving out the ones
+// skipped and any that aren't set.
+func flattenFields(value interface{}, skip ...string) map[string]string {
+	fields := map[string]string{}
+	encodedFields, ok := encodeValue(reflect.ValueOf(value)).(map[string]interface{})
+	if !ok {
+		return fields
+	}
+
+	for name, encodedField := range encodedFields {
+		if containsString(skip, name) {
+			continue
+		}
+
+		// Strings read better without quotes.
+		if stringValue, ok := encodedField.(string); ok {
+			fields[name] = stringValue
+
+			continue
+		}
+
+		encoded, err := json.Marshal(encodedField)
+		if err != nil {
+			continue
+		}
+		fields[name] = string(encoded)
+	}
+
+	return fields
+}
+
+// encodeValue turns the value into one that encodes to JSON the way the ECS
+// API does, with field names starting in lower case e.g. `portMappings`.
+// Fields that aren't set are left out, returning nil if nothing is set.
+func encodeValue(value reflect.Value) interface{} {
+	switch value.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if value.IsNil() {
+			return nil
+		}
+
+		return encodeValue(value.Elem())
+	case reflect.Struct:
+		fields := map[string]interface{}{}
+		for index := 0; index < value.NumField(); index++ {
+			field := value.Type().Field(index)
+			if !field.IsExported() {
+				continue
+			}
+
+			// Scalars that aren't pointers are only set if they're not zero.
+			fieldValue := value.Field(index)
+			if fieldValue.Kind() != reflect.Pointer && fieldValue.IsZero() {
+				continue
+			}
+
+			encodedField := encodeValue(fieldValue)
+			if encodedField != nil {
+				fields[encodedFieldName(field.Name)] = encodedField
+			}
+		}
+		if len(fields) == 0 {
+			return nil
+		}
+
+		return fields
+	case reflect.Map:
+		// Map keys are data e.g. log options, so they're kept as they are.
+		entries := map[string]interface{}{}
+		iterator := value.MapRange()
+		for iterator.Next() {
+			entries[fmt.Sprint(iterator.Key().Interface())] = encodeValue(iterator.Value())
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+
+		return entries
+	case reflect.Slice, reflect.Array:
+		items := []interface{}{}
+		for index := 0; index < value.Len(); index++ {
+			items = append(items, encodeValue(value.Index(index)))
+		}
+		if len(items) == 0 {
+			return nil
+		}
+
+		return items
+	case reflect.Invalid:
+		return nil
+	default:
+		return value.Interface()
+	}
+}
+
+// encodedFieldName turns the name of a struct field into the one the ECS API
+// uses, which mostly just starts in lower case.
+func encodedFieldName(name string) string {
+	if name == "FSxWindowsFileServerVolumeConfiguration" {
+		return "fsxWindowsFileServerVolumeConfiguration"
+	}
+
+	return strings.ToLower(name[:1]) + name[1:]
+}
+
+// String describes the change on one line e.g.
+// `~ container rails image: app:1 -> app:2`.
+func (change TaskDefinitionChange) String() string {
+	name := change.Field
+	if change.Container != "" {
+		name = strings.TrimSpace(fmt.Sprintf("container %s %s", change.Container, change.Field))
+	}
+
+	switch change.Type {
+	case ChangeTypeAdded:
+		return fmt.Sprintf("+ %s: %s", name, change.New)
+	case ChangeTypeRemoved:
+		return fmt.Sprintf("- %s: %s", name, change.Old)
+	default:
+		return fmt.Sprintf("~ %s: %s -> %s", name, change.Old, change.New)
+	}
+}
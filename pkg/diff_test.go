@@ -0,0 +1,80 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+func TestDiffTaskDefinitionsIgnoresDefaults(t *testing.T) {
+	containerPort := int32(3000)
+	essential := true
+	interval, retries, timeout := int32(30), int32(3), int32(5)
+
+	// What's in the task definition file, leaving the defaults out.
+	rendered := &ecs.RegisterTaskDefinitionInput{
+		Family:      stringPtr("app-web-server"),
+		Cpu:         stringPtr("0.25 vCPU"),
+		Memory:      stringPtr("0.5 GB"),
+		NetworkMode: types.NetworkModeAwsvpc,
+		ContainerDefinitions: []types.ContainerDefinition{
+			{
+				Name:         stringPtr("rails"),
+				Image:        stringPtr("app:1"),
+				PortMappings: []types.PortMapping{{ContainerPort: &containerPort}},
+				HealthCheck:  &types.HealthCheck{Command: []string{"CMD", "true"}},
+			},
+		},
+	}
+
+	// What ECS describes once it's registered.
+	registered := &ecs.RegisterTaskDefinitionInput{
+		Family:      stringPtr("app-web-server"),
+		Cpu:         stringPtr("256"),
+		Memory:      stringPtr("512"),
+		NetworkMode: types.NetworkModeAwsvpc,
+		ContainerDefinitions: []types.ContainerDefinition{
+			{
+				Name:         stringPtr("rails"),
+				Image:        stringPtr("app:1"),
+				Essential:    &essential,
+				Environment:  []types.KeyValuePair{},
+				MountPoints:  []types.MountPoint{},
+				VolumesFrom:  []types.VolumeFrom{},
+				PortMappings: []types.PortMapping{{ContainerPort: &containerPort, HostPort: &containerPort, Protocol: types.TransportProtocolTcp}},
+				HealthCheck:  &types.HealthCheck{Command: []string{"CMD", "true"}, Interval: &interval, Retries: &retries, Timeout: &timeout},
+			},
+		},
+	}
+
+	if changes := diffTaskDefinitions(registered, rendered); len(changes) != 0 {
+		t.Errorf("expected no changes, got %v", changes)
+	}
+
+	rendered.ContainerDefinitions[0].Image = stringPtr("app:2")
+	changes := diffTaskDefinitions(registered, rendered)
+	if len(changes) != 1 || changes[0].Field != "image" {
+		t.Errorf("expected only the image to change, got %v", changes)
+	}
+
+	if rendered.ContainerDefinitions[0].Essential != nil || *rendered.Cpu != "0.25 vCPU" {
+		t.Error("expected the task definition not to be changed")
+	}
+}
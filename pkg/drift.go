@@ -0,0 +1,230 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+
+	dockerparser "github.com/novln/docker-parser"
+)
+
+type DriftType string
+
+const (
+	DriftTypeContainerMissing      DriftType = "container_missing"
+	DriftTypeImageTagsDiffer       DriftType = "image_tags_differ"
+	DriftTypeModifiedOutOfBand     DriftType = "modified_out_of_band"
+	DriftTypeServiceMissing        DriftType = "service_missing"
+	DriftTypeTaskDefinitionMissing DriftType = "task_definition_missing"
+)
+
+type DriftInput struct {
+	// The target to check. Defaults to the only target in the config, it must
+	// be set if the config has several targets.
+	Target *Target
+}
+
+type DriftResult struct {
+	// The differences found between the config and the cluster.
+	Drifts []Drift
+
+	// The services that have no record of being deployed by ecs-toolkit, so
+	// they couldn't be checked for changes made outside of it.
+	Unverified []string
+}
+
+// Drift is a difference between the config and the cluster.
+type Drift struct {
+	Type DriftType
+
+	// The service or the family of the task the drift is in.
+	Service string
+	Task    string
+
+	// The container the drift is in, if it's about a single container.
+	Container string
+
+	Message string
+}
+
+// Drift checks that the services and tasks in the config match what's in the
+// cluster i.e. they exist, their task definitions have all the containers in
+// the config, the containers of each service are on the same image tag and no
+// service has been updated outside of ecs-toolkit since it was last deployed.
+func (deployer *Deployer) Drift(ctx context.Context, input *DriftInput) (*DriftResult, error) {
+	target, err := deployer.target(input.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &DriftResult{Drifts: []Drift{}, Unverified: []string{}}
+	for index := range deployer.config.Services {
+		serviceConfig := &deployer.config.Services[index]
+
+		service, err := deployer.describeService(ctx, &target.Cluster, serviceConfig.Name)
+		var notFoundErr *ErrServiceNotFound
+		if errors.As(err, &notFoundErr) {
+			result.Drifts = append(result.Drifts, Drift{
+				Type:    DriftTypeServiceMissing,
+				Service: serviceConfig.Name,
+				Message: "service not found in the cluster",
+			})
+
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		taskDefinition, err := deployer.describeTaskDefinition(ctx, *service.TaskDefinition)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, drift := range containerDrifts(taskDefinition, serviceConfig.Containers) {
+			drift.Service = serviceConfig.Name
+			result.Drifts = append(result.Drifts, drift)
+		}
+
+		verified, drift, err := deployer.serviceDrift(ctx, service)
+		if err != nil {
+			return nil, err
+		}
+		if !verified {
+			result.Unverified = append(result.Unverified, serviceConfig.Name)
+		}
+		if drift != nil {
+			drift.Service = serviceConfig.Name
+			result.Drifts = append(result.Drifts, *drift)
+		}
+	}
+
+	for _, taskConfig := range append(append([]Task{}, deployer.config.Tasks.Pre...), deployer.config.Tasks.Post...) {
+		taskDefinition, err := deployer.describeTaskDefinition(ctx, taskConfig.Family)
+		var clientErr *types.ClientException
+		if errors.As(err, &clientErr) {
+			result.Drifts = append(result.Drifts, Drift{
+				Type:    DriftTypeTaskDefinitionMissing,
+				Task:    taskConfig.Family,
+				Message: fmt.Sprintf("task definition not found: %s", clientErr.ErrorMessage()),
+			})
+
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, drift := range containerDrifts(taskDefinition, taskConfig.Containers) {
+			if drift.Type == DriftTypeContainerMissing {
+				drift.Task = taskConfig.Family
+				result.Drifts = append(result.Drifts, drift)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// containerDrifts checks that the containers are all in the task definition
+// and on the same image tag.
+func containerDrifts(taskDefinition *types.TaskDefinition, containers []string) []Drift {
+	drifts := []Drift{}
+
+	containerImages := map[string]string{}
+	for _, containerDefinition := range taskDefinition.ContainerDefinitions {
+		if containerDefinition.Name != nil && containerDefinition.Image != nil {
+			containerImages[*containerDefinition.Name] = *containerDefinition.Image
+		}
+	}
+
+	imageTags := map[string][]string{}
+	for _, containerName := range containers {
+		image, ok := containerImages[containerName]
+		if !ok {
+			drifts = append(drifts, Drift{
+				Type:      DriftTypeContainerMissing,
+				Container: containerName,
+				Message:   fmt.Sprintf("container not found in task definition %s:%d", *taskDefinition.Family, taskDefinition.Revision),
+			})
+
+			continue
+		}
+
+		imageTag := image
+		if parsedImage, err := dockerparser.Parse(image); err == nil {
+			imageTag = parsedImage.Tag()
+		}
+		imageTags[imageTag] = append(imageTags[imageTag], containerName)
+	}
+
+	if len(imageTags) > 1 {
+		tags := []string{}
+		for imageTag, containerNames := range imageTags {
+			tags = append(tags, fmt.Sprintf("%s (%s)", imageTag, strings.Join(containerNames, ", ")))
+		}
+		sort.Strings(tags)
+
+		drifts = append(drifts, Drift{
+			Type:    DriftTypeImageTagsDiffer,
+			Message: fmt.Sprintf("containers on different image tags: %s", strings.Join(tags, ", ")),
+		})
+	}
+
+	return drifts
+}
+
+// serviceDrift checks that the service's primary deployment is the one
+// started the last time ecs-toolkit updated it. It isn't verified if
+// ecs-toolkit has never updated it.
+func (deployer *Deployer) serviceDrift(ctx context.Context, service *types.Service) (bool, *Drift, error) {
+	tagsResult, err := deployer.client.ListTagsForResource(ctx, &ecs.ListTagsForResourceInput{
+		ResourceArn: service.ServiceArn,
+	})
+	if err != nil {
+		return false, nil, err
+	}
+
+	deployedServiceDeploymentID := ""
+	for _, tag := range tagsResult.Tags {
+		if tag.Key != nil && *tag.Key == TagServiceDeployment && tag.Value != nil {
+			deployedServiceDeploymentID = *tag.Value
+		}
+	}
+	if deployedServiceDeploymentID == "" {
+		return false, nil, nil
+	}
+
+	serviceDeploymentID := primaryServiceDeploymentID(service)
+	if serviceDeploymentID == deployedServiceDeploymentID {
+		return true, nil, nil
+	}
+
+	drift := &Drift{
+		Type:    DriftTypeModifiedOutOfBand,
+		Message: fmt.Sprintf("service updated outside of ecs-toolkit, deployment %s replaced %s", serviceDeploymentID, deployedServiceDeploymentID),
+	}
+
+	return true, drift, nil
+}
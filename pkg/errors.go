@@ -0,0 +1,132 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrServiceNotFound is returned when a service in the config doesn't exist
+// in the cluster.
+type ErrServiceNotFound struct {
+	Cluster string
+	Service string
+}
+
+// ErrTaskFailed is returned when a pre-deployment or post-deployment task
+// stops with a container that exited with a non-zero exit code.
+type ErrTaskFailed struct {
+	Task          string
+	TaskNo        int
+	TaskID        string
+	StoppedReason string
+}
+
+// ErrStabilityTimeout is returned when a service doesn't become stable within
+// the maximum amount of time it's allowed to take.
+type ErrStabilityTimeout struct {
+	Service string
+	MaxWait time.Duration
+}
+
+// ErrCanaryAborted is returned when the canary of a service fails its health
+// checks or isn't promoted, the service itself is left as is.
+type ErrCanaryAborted struct {
+	Service       string
+	CanaryService string
+	Reason        string
+}
+
+// ErrVerificationFailed is returned when a smoke test of a service or the
+// application still fails after being retried.
+type ErrVerificationFailed struct {
+	URL    string
+	Reason string
+}
+
+// ErrTargetsUnhealthy is returned when the tasks of a service aren't healthy
+// targets of its load balancers within the maximum amount of time it's
+// allowed to take.
+type ErrTargetsUnhealthy struct {
+	Service  string
+	MaxWait  time.Duration
+	Problems []string
+}
+
+// ErrTaskDefinitionMismatch is returned when a service is stable but some of
+// its running tasks aren't of the task definition it was updated to, like
+// when another deployment has superseded it.
+type ErrTaskDefinitionMismatch struct {
+	Service           string
+	TaskDefinitionArn string
+	TaskIDs           []string
+}
+
+// ErrLocked is returned when the deployment lock is held by someone else.
+type ErrLocked struct {
+	Key       string
+	Owner     string
+	ExpiresAt time.Time
+}
+
+// ErrLockLost is returned when the deployment lock is no longer held by its
+// owner, like when it expired and someone else took it.
+type ErrLockLost struct {
+	Key string
+}
+
+func (err *ErrServiceNotFound) Error() string {
+	return fmt.Sprintf("service %s not found in cluster %s", err.Service, err.Cluster)
+}
+
+func (err *ErrTaskFailed) Error() string {
+	return fmt.Sprintf("prematurely stopped task [%d], reason: %s", err.TaskNo, strings.ToLower(err.StoppedReason))
+}
+
+func (err *ErrStabilityTimeout) Error() string {
+	return fmt.Sprintf("service %s not stable after %s", err.Service, err.MaxWait)
+}
+
+func (err *ErrCanaryAborted) Error() string {
+	return fmt.Sprintf("aborted canary %s of service %s: %s", err.CanaryService, err.Service, err.Reason)
+}
+
+func (err *ErrVerificationFailed) Error() string {
+	return fmt.Sprintf("verification check %s failed: %s", err.URL, err.Reason)
+}
+
+func (err *ErrTargetsUnhealthy) Error() string {
+	return fmt.Sprintf("load balancer targets of service %s not healthy after %s: %s", err.Service, err.MaxWait, strings.Join(err.Problems, "; "))
+}
+
+func (err *ErrTaskDefinitionMismatch) Error() string {
+	return fmt.Sprintf("service %s has running task(s) not of task definition %s: %s", err.Service, err.TaskDefinitionArn, strings.Join(err.TaskIDs, ", "))
+}
+
+func (err *ErrLocked) Error() string {
+	if err.ExpiresAt.IsZero() {
+		return fmt.Sprintf("deployment lock %s held by %s", err.Key, err.Owner)
+	}
+
+	return fmt.Sprintf("deployment lock %s held by %s until %s", err.Key, err.Owner, err.ExpiresAt.Format(time.RFC3339))
+}
+
+func (err *ErrLockLost) Error() string {
+	return fmt.Sprintf("deployment lock %s lost", err.Key)
+}
@@ -0,0 +1,479 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type EventType string
+
+type EventStage string
+
+// DeploymentEvent is implemented by all the events published during a
+// deployment. Use a type switch to get at the details of a specific event.
+type DeploymentEvent interface {
+	// Meta returns the details common to all events.
+	Meta() *EventMeta
+
+	// Summary describes the event in a sentence.
+	Summary() string
+}
+
+// DeploymentObserver is notified of every event published during a
+// deployment. It's called synchronously from several goroutines so it should
+// be quick and safe for concurrent use.
+type DeploymentObserver interface {
+	Observe(event DeploymentEvent)
+}
+
+// DeploymentObserverFunc allows the use of an ordinary function as an
+// observer.
+type DeploymentObserverFunc func(event DeploymentEvent)
+
+// EventEmitter passes on the events published during a deployment to all the
+// observers subscribed to it.
+type EventEmitter struct {
+	mutex     sync.RWMutex
+	observers []DeploymentObserver
+}
+
+// EventMeta holds the details common to all events.
+type EventMeta struct {
+	Type         EventType `json:"type"`
+	Time         time.Time `json:"time"`
+	DeploymentID string    `json:"deployment_id"`
+	Cluster      string    `json:"cluster"`
+	Region       string    `json:"region,omitempty"`
+	ImageTag     string    `json:"image_tag"`
+	Status       Status    `json:"status,omitempty"`
+}
+
+// DeploymentStarted is published when a deployment to a target starts.
+type DeploymentStarted struct {
+	EventMeta
+}
+
+// DeploymentFinished is published when a deployment to a target finishes,
+// the status is the outcome of the deployment.
+type DeploymentFinished struct {
+	EventMeta
+}
+
+// StageStarted is published when the rollout of the pre-deployment tasks,
+// services or post-deployment tasks starts.
+type StageStarted struct {
+	EventMeta
+
+	Stage EventStage `json:"stage"`
+}
+
+// StageCompleted is published when the rollout of the pre-deployment tasks,
+// services or post-deployment tasks completes, with a summary of the outcome.
+type StageCompleted struct {
+	EventMeta
+
+	Stage      EventStage `json:"stage"`
+	Total      int        `json:"total"`
+	Successful int        `json:"successful"`
+	Skipped    int        `json:"skipped"`
+	Failed     int        `json:"failed"`
+	Message    string     `json:"message,omitempty"`
+	Downtimes  []Downtime `json:"downtimes,omitempty"`
+}
+
+// TaskDefinitionRegistered is published when a new revision of the task
+// definition of a service or task is registered.
+type TaskDefinitionRegistered struct {
+	EventMeta
+
+	Stage             EventStage `json:"stage"`
+	Service           string     `json:"service,omitempty"`
+	Task              string     `json:"task,omitempty"`
+	Family            string     `json:"family"`
+	Revision          int32      `json:"revision"`
+	TaskDefinitionArn string     `json:"task_definition_arn"`
+}
+
+// TaskStarted is published for every task that's started when running a
+// pre-deployment or post-deployment task.
+type TaskStarted struct {
+	EventMeta
+
+	Stage             EventStage `json:"stage"`
+	Task              string     `json:"task"`
+	TaskNo            int        `json:"task_no"`
+	TaskID            string     `json:"task_id"`
+	TaskArn           string     `json:"task_arn"`
+	TaskDefinitionArn string     `json:"task_definition_arn"`
+}
+
+// TaskStateChanged is published whenever the last status, desired status or
+// health of a task being watched changes.
+type TaskStateChanged struct {
+	EventMeta
+
+	Stage         EventStage `json:"stage"`
+	Task          string     `json:"task"`
+	TaskNo        int        `json:"task_no"`
+	TaskID        string     `json:"task_id"`
+	LastStatus    string     `json:"last_status"`
+	DesiredStatus string     `json:"desired_status"`
+	HealthStatus  string     `json:"health_status"`
+}
+
+// TaskStopped is published when a task being watched stops, the status is
+// failed if any of its containers exited with a non-zero exit code.
+type TaskStopped struct {
+	EventMeta
+
+	Stage         EventStage `json:"stage"`
+	Task          string     `json:"task"`
+	TaskNo        int        `json:"task_no"`
+	TaskID        string     `json:"task_id"`
+	StoppedReason string     `json:"stopped_reason"`
+}
+
+// TaskFailed is published when a pre-deployment or post-deployment task could
+// not be run to completion.
+type TaskFailed struct {
+	EventMeta
+
+	Stage   EventStage `json:"stage"`
+	Task    string     `json:"task"`
+	Message string     `json:"message"`
+}
+
+// ServiceUpdated is published when a service has been updated to use the new
+// task definition.
+type ServiceUpdated struct {
+	EventMeta
+
+	Service           string `json:"service"`
+	TaskDefinitionArn string `json:"task_definition_arn"`
+}
+
+// DeploymentProgress is published for every deployment of a service each
+// time the rollout of a service is checked.
+type DeploymentProgress struct {
+	EventMeta
+
+	Service             string `json:"service"`
+	ServiceStatus       string `json:"service_status"`
+	ServiceDeploymentID string `json:"service_deployment_id"`
+	DeploymentStatus    string `json:"deployment_status"`
+	RolloutState        string `json:"rollout_state"`
+	RunningCount        int32  `json:"running_count"`
+	DesiredCount        int32  `json:"desired_count"`
+	PendingCount        int32  `json:"pending_count"`
+}
+
+// ServiceEvent is published for every new service event, like tasks being
+// started or failing to be placed, that comes up while a service is watched.
+type ServiceEvent struct {
+	EventMeta
+
+	Service   string    `json:"service"`
+	EventID   string    `json:"event_id"`
+	Message   string    `json:"message"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ServiceTaskStopped is published for every task of a failing deployment of a
+// service that has stopped, with why it stopped.
+type ServiceTaskStopped struct {
+	EventMeta
+
+	Service           string             `json:"service"`
+	TaskID            string             `json:"task_id"`
+	TaskArn           string             `json:"task_arn"`
+	TaskDefinitionArn string             `json:"task_definition_arn"`
+	StoppedReason     string             `json:"stopped_reason"`
+	StopCode          string             `json:"stop_code"`
+	Containers        []StoppedContainer `json:"containers"`
+}
+
+// StoppedContainer describes how a container of a stopped task exited.
+type StoppedContainer struct {
+	Name     string `json:"name"`
+	ExitCode *int32 `json:"exit_code,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// ServiceStable is published when a service has become stable after being
+// updated.
+type ServiceStable struct {
+	EventMeta
+
+	Service string `json:"service"`
+}
+
+// CanaryStarted is published when the new task definition of a service has
+// been rolled out to its canary service and the canary starts baking.
+type CanaryStarted struct {
+	EventMeta
+
+	Service           string `json:"service"`
+	CanaryService     string `json:"canary_service"`
+	TaskDefinitionArn string `json:"task_definition_arn"`
+
+	// How long the canary bakes for, in seconds.
+	BakeTimeSeconds int64 `json:"bake_time_seconds"`
+}
+
+// CanaryPromoted is published when a canary has baked without any problems
+// and the new task definition is being promoted to the main service.
+type CanaryPromoted struct {
+	EventMeta
+
+	Service       string `json:"service"`
+	CanaryService string `json:"canary_service"`
+}
+
+// CanaryAborted is published when a canary failed its health checks, or
+// wasn't promoted, and has been scaled back down.
+type CanaryAborted struct {
+	EventMeta
+
+	Service       string `json:"service"`
+	CanaryService string `json:"canary_service"`
+	Reason        string `json:"reason"`
+}
+
+// VerificationCompleted is published when the smoke tests of a service, or the
+// application if there's no service, have been run. The status is failed if
+// any of them failed.
+type VerificationCompleted struct {
+	EventMeta
+
+	Service string `json:"service,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	EventCanaryAborted            EventType = "canary.aborted"
+	EventCanaryPromoted           EventType = "canary.promoted"
+	EventCanaryStarted            EventType = "canary.started"
+	EventDeploymentFinished       EventType = "deployment.finished"
+	EventDeploymentProgress       EventType = "deployment.progress"
+	EventDeploymentStarted        EventType = "deployment.started"
+	EventServiceEvent             EventType = "service.event"
+	EventServiceStable            EventType = "service.stable"
+	EventServiceTaskStopped       EventType = "service.task_stopped"
+	EventServiceUpdated           EventType = "service.updated"
+	EventStageCompleted           EventType = "stage.completed"
+	EventStageStarted             EventType = "stage.started"
+	EventTaskDefinitionRegistered EventType = "task_definition.registered"
+	EventTaskFailed               EventType = "task.failed"
+	EventTaskStarted              EventType = "task.started"
+	EventTaskStateChanged         EventType = "task.state_changed"
+	EventTaskStopped              EventType = "task.stopped"
+	EventVerificationCompleted    EventType = "verification.completed"
+)
+
+const (
+	EventStagePostTasks EventStage = "post_tasks"
+	EventStagePreTasks  EventStage = "pre_tasks"
+	EventStageServices  EventStage = "services"
+)
+
+func NewEventEmitter() *EventEmitter {
+	return &EventEmitter{}
+}
+
+func (emitter *EventEmitter) Subscribe(observer DeploymentObserver) {
+	emitter.mutex.Lock()
+	defer emitter.mutex.Unlock()
+
+	emitter.observers = append(emitter.observers, observer)
+}
+
+// Observe passes the event on to all subscribed observers. It's safe to call
+// on a nil emitter i.e. when nothing is interested in the events.
+func (emitter *EventEmitter) Observe(event DeploymentEvent) {
+	if emitter == nil {
+		return
+	}
+
+	emitter.mutex.RLock()
+	defer emitter.mutex.RUnlock()
+
+	for _, observer := range emitter.observers {
+		observer.Observe(event)
+	}
+}
+
+func (observerFunc DeploymentObserverFunc) Observe(event DeploymentEvent) {
+	observerFunc(event)
+}
+
+func (meta *EventMeta) Meta() *EventMeta {
+	return meta
+}
+
+// Color is a hex color code that reflects the status of the event, useful for
+// chat messages.
+func (meta *EventMeta) Color() string {
+	switch meta.Status {
+	case FailedStatus:
+		return "d63333"
+	case SucceededStatus:
+		return "2eb886"
+	}
+
+	return "439fe0"
+}
+
+func (meta *EventMeta) target() string {
+	if meta.Region != "" {
+		return fmt.Sprintf("%s (%s)", meta.Cluster, meta.Region)
+	}
+
+	return meta.Cluster
+}
+
+func (event *DeploymentStarted) Summary() string {
+	return fmt.Sprintf("deployment of %s to %s started", event.ImageTag, event.target())
+}
+
+func (event *DeploymentFinished) Summary() string {
+	return fmt.Sprintf("deployment of %s to %s %s", event.ImageTag, event.target(), event.Status)
+}
+
+func (event *StageStarted) Summary() string {
+	return fmt.Sprintf("rollout of %s on %s started", event.Stage.description(), event.target())
+}
+
+func (event *StageCompleted) Summary() string {
+	summary := fmt.Sprintf("rollout of %s on %s %s - total: %d, successful: %d, skipped: %d, failed: %d", event.Stage.description(), event.target(), event.Status, event.Total, event.Successful, event.Skipped, event.Failed)
+	if event.Message != "" {
+		summary = fmt.Sprintf("%s: %s", summary, event.Message)
+	}
+	for _, downtime := range event.Downtimes {
+		summary = fmt.Sprintf("%s, %s down for %s", summary, downtime.Service, downtime.Duration().Round(time.Second))
+		if !downtime.Recovered {
+			summary = fmt.Sprintf("%s and counting", summary)
+		}
+	}
+
+	return summary
+}
+
+func (event *TaskDefinitionRegistered) Summary() string {
+	return fmt.Sprintf("registered task definition %s:%d on %s", event.Family, event.Revision, event.target())
+}
+
+func (event *TaskStarted) Summary() string {
+	return fmt.Sprintf("started task %s [%d] on %s", event.Task, event.TaskNo, event.target())
+}
+
+func (event *TaskStateChanged) Summary() string {
+	return fmt.Sprintf("task %s [%d] on %s is %s", event.Task, event.TaskNo, event.target(), strings.ToLower(event.LastStatus))
+}
+
+func (event *TaskStopped) Summary() string {
+	return fmt.Sprintf("task %s [%d] on %s stopped, %s: %s", event.Task, event.TaskNo, event.target(), event.Status, event.StoppedReason)
+}
+
+func (event *TaskFailed) Summary() string {
+	return fmt.Sprintf("task %s on %s failed: %s", event.Task, event.target(), event.Message)
+}
+
+func (event *ServiceUpdated) Summary() string {
+	return fmt.Sprintf("service %s on %s updated", event.Service, event.target())
+}
+
+func (event *DeploymentProgress) Summary() string {
+	return fmt.Sprintf("service %s on %s rollout: %d/%d (%d pending)", event.Service, event.target(), event.RunningCount, event.DesiredCount, event.PendingCount)
+}
+
+func (event *ServiceEvent) Summary() string {
+	return fmt.Sprintf("service %s on %s: %s", event.Service, event.target(), event.Message)
+}
+
+func (event *ServiceTaskStopped) Summary() string {
+	summary := fmt.Sprintf("task %s of service %s on %s stopped: %s", event.TaskID, event.Service, event.target(), event.StoppedReason)
+	if exitCodes := event.exitCodes(); exitCodes != "" {
+		summary = fmt.Sprintf("%s (%s)", summary, exitCodes)
+	}
+
+	return summary
+}
+
+// exitCodes lists the exit codes of the containers that have one.
+func (event *ServiceTaskStopped) exitCodes() string {
+	exitCodes := []string{}
+	for _, container := range event.Containers {
+		if container.ExitCode != nil {
+			exitCodes = append(exitCodes, fmt.Sprintf("%s: %d", container.Name, *container.ExitCode))
+		}
+	}
+
+	return strings.Join(exitCodes, ", ")
+}
+
+func (event *ServiceStable) Summary() string {
+	return fmt.Sprintf("service %s on %s is stable", event.Service, event.target())
+}
+
+func (event *CanaryStarted) Summary() string {
+	return fmt.Sprintf("canary %s of service %s on %s baking for %s", event.CanaryService, event.Service, event.target(), time.Duration(event.BakeTimeSeconds)*time.Second)
+}
+
+func (event *CanaryPromoted) Summary() string {
+	return fmt.Sprintf("canary %s of service %s on %s promoted", event.CanaryService, event.Service, event.target())
+}
+
+func (event *CanaryAborted) Summary() string {
+	return fmt.Sprintf("canary %s of service %s on %s aborted: %s", event.CanaryService, event.Service, event.target(), event.Reason)
+}
+
+func (event *VerificationCompleted) Summary() string {
+	subject := "application"
+	if event.Service != "" {
+		subject = "service " + event.Service
+	}
+
+	summary := fmt.Sprintf("verification of %s on %s %s", subject, event.target(), event.Status)
+	if event.Message != "" {
+		summary = fmt.Sprintf("%s: %s", summary, event.Message)
+	}
+
+	return summary
+}
+
+func (stage EventStage) description() string {
+	switch stage {
+	case EventStagePreTasks:
+		return "pre-deployment tasks"
+	case EventStagePostTasks:
+		return "post-deployment tasks"
+	}
+
+	return string(stage)
+}
+
+func taskStageEventStage(stage TaskStage) EventStage {
+	if stage == TaskStagePost {
+		return EventStagePostTasks
+	}
+
+	return EventStagePreTasks
+}
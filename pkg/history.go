@@ -0,0 +1,376 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+// DefaultHistoryLimit is how many revisions of a task definition are listed
+// unless set otherwise.
+const DefaultHistoryLimit = 10
+
+type HistoryInput struct {
+	// The target to list the history of. Defaults to the only target in the
+	// config, it must be set if the config has several targets.
+	Target *Target
+
+	// The services to list the history of. Defaults to all the services and
+	// tasks in the config, tasks are left out if it's set.
+	Services []string
+
+	// The number of most recent revisions to list for each family. Defaults
+	// to DefaultHistoryLimit.
+	Limit int
+}
+
+// FamilyHistory lists the most recent revisions of a task definition family
+// used by the services or tasks in the config, newest first. The revisions
+// the services currently run are always listed, even if they're older.
+type FamilyHistory struct {
+	// The family of the task definition.
+	Family string
+
+	// The services that use the family.
+	Services []string
+
+	// The stages of the tasks that use the family.
+	TaskStages []TaskStage
+
+	// The ARNs of the task definitions the services currently run, keyed by
+	// service name.
+	CurrentTaskDefinitions map[string]string
+
+	Revisions []TaskDefinitionRevision
+}
+
+// TaskDefinitionRevision is a revision of a task definition along with the
+// deployment that registered it, if any.
+type TaskDefinitionRevision struct {
+	TaskDefinitionArn string
+	Family            string
+	Revision          int32
+	RegisteredAt      time.Time
+	Status            types.TaskDefinitionStatus
+
+	// The images of the containers in the config, in the order they're
+	// defined in the task definition.
+	Images []ContainerImage
+
+	// The services currently running the revision.
+	Services []string
+
+	// The metadata of the deployment that registered the revision, read back
+	// from its tags. It's nil if the revision wasn't registered by a
+	// deployment.
+	Deployment *DeploymentMetadata
+}
+
+// ContainerImage is the image of a container in a task definition.
+type ContainerImage struct {
+	Container string
+	Image     string
+}
+
+// DeploymentMetadata describes a past deployment.
+type DeploymentMetadata struct {
+	DeploymentID string
+	ImageTag     string
+	GitCommit    string
+	CIRunURL     string
+	DeployedBy   string
+	DeployedAt   time.Time
+
+	// The rest of the tags, including the ones from the config and the
+	// annotations.
+	Tags map[string]string
+}
+
+// History lists the most recent revisions of the task definition families of
+// the services and tasks of the target, along with their images and the
+// deployments that registered them.
+func (deployer *Deployer) History(ctx context.Context, input *HistoryInput) ([]FamilyHistory, error) {
+	target, err := deployer.target(input.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := input.Limit
+	if limit <= 0 {
+		limit = DefaultHistoryLimit
+	}
+
+	serviceConfigs := []*Service{}
+	for index := range deployer.config.Services {
+		serviceConfig := &deployer.config.Services[index]
+		if len(input.Services) > 0 && !containsString(input.Services, serviceConfig.Name) {
+			continue
+		}
+		serviceConfigs = append(serviceConfigs, serviceConfig)
+	}
+
+	if len(serviceConfigs) < len(input.Services) {
+		return nil, errors.New("unable to list history of services not in the config")
+	}
+
+	// Several services and tasks can share a family so group them together,
+	// keeping the order of the config.
+	histories := []*FamilyHistory{}
+	historiesByFamily := map[string]*FamilyHistory{}
+	containers := map[string]map[string]bool{}
+	familyHistory := func(family string, containerNames []string) *FamilyHistory {
+		history, ok := historiesByFamily[family]
+		if !ok {
+			history = &FamilyHistory{Family: family, CurrentTaskDefinitions: map[string]string{}}
+			histories = append(histories, history)
+			historiesByFamily[family] = history
+			containers[family] = map[string]bool{}
+		}
+		for _, containerName := range containerNames {
+			containers[family][containerName] = true
+		}
+
+		return history
+	}
+
+	for _, serviceConfig := range serviceConfigs {
+		service, err := deployer.describeService(ctx, &target.Cluster, serviceConfig.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		family, _, err := parseTaskDefinitionArn(*service.TaskDefinition)
+		if err != nil {
+			return nil, err
+		}
+
+		history := familyHistory(family, serviceConfig.Containers)
+		history.Services = append(history.Services, serviceConfig.Name)
+		history.CurrentTaskDefinitions[serviceConfig.Name] = *service.TaskDefinition
+	}
+
+	if len(input.Services) == 0 {
+		for _, stage := range []TaskStage{TaskStagePre, TaskStagePost} {
+			taskConfigs := deployer.config.Tasks.Pre
+			if stage == TaskStagePost {
+				taskConfigs = deployer.config.Tasks.Post
+			}
+
+			for index := range taskConfigs {
+				taskConfig := &taskConfigs[index]
+				history := familyHistory(taskDefinitionFamily(taskConfig.Family), taskConfig.Containers)
+				if len(history.TaskStages) == 0 || history.TaskStages[len(history.TaskStages)-1] != stage {
+					history.TaskStages = append(history.TaskStages, stage)
+				}
+			}
+		}
+	}
+
+	results := []FamilyHistory{}
+	for _, history := range histories {
+		history.Revisions, err = deployer.taskDefinitionRevisions(ctx, history, containers[history.Family], limit)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, *history)
+	}
+
+	return results, nil
+}
+
+// taskDefinitionRevisions describes the most recent ACTIVE and INACTIVE
+// revisions of the family, newest first, along with the ones the services
+// currently run.
+func (deployer *Deployer) taskDefinitionRevisions(ctx context.Context, history *FamilyHistory, containers map[string]bool, limit int) ([]TaskDefinitionRevision, error) {
+	// Revisions can only be listed by one status at a time, since both lists
+	// are sorted the most recent revisions are at the top of one or the other.
+	arns := []string{}
+	for _, status := range []types.TaskDefinitionStatus{types.TaskDefinitionStatusActive, types.TaskDefinitionStatusInactive} {
+		statusArns, err := deployer.listTaskDefinitions(ctx, history.Family, status, limit)
+		if err != nil {
+			return nil, err
+		}
+		arns = append(arns, statusArns...)
+	}
+	sortTaskDefinitionArns(arns)
+	if len(arns) > limit {
+		arns = arns[:limit]
+	}
+
+	for _, currentArn := range history.CurrentTaskDefinitions {
+		if !containsString(arns, currentArn) {
+			arns = append(arns, currentArn)
+		}
+	}
+	sortTaskDefinitionArns(arns)
+
+	revisions := []TaskDefinitionRevision{}
+	for _, arn := range arns {
+		arn := arn
+		taskDefinitionResult, err := deployer.client.DescribeTaskDefinition(ctx, &ecs.DescribeTaskDefinitionInput{
+			TaskDefinition: &arn,
+			Include:        []types.TaskDefinitionField{types.TaskDefinitionFieldTags},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		taskDefinition := taskDefinitionResult.TaskDefinition
+		revision := TaskDefinitionRevision{
+			TaskDefinitionArn: arn,
+			Family:            *taskDefinition.Family,
+			Revision:          taskDefinition.Revision,
+			Status:            taskDefinition.Status,
+			Images:            []ContainerImage{},
+			Services:          []string{},
+			Deployment:        deploymentMetadata(taskDefinitionResult.Tags),
+		}
+		if taskDefinition.RegisteredAt != nil {
+			revision.RegisteredAt = taskDefinition.RegisteredAt.UTC()
+		}
+
+		for _, containerDefinition := range taskDefinition.ContainerDefinitions {
+			if containerDefinition.Name == nil || containerDefinition.Image == nil || !containers[*containerDefinition.Name] {
+				continue
+			}
+			revision.Images = append(revision.Images, ContainerImage{Container: *containerDefinition.Name, Image: *containerDefinition.Image})
+		}
+
+		for _, service := range history.Services {
+			if history.CurrentTaskDefinitions[service] == arn {
+				revision.Services = append(revision.Services, service)
+			}
+		}
+
+		revisions = append(revisions, revision)
+	}
+
+	return revisions, nil
+}
+
+// listTaskDefinitions lists the ARNs of the most recent revisions of the
+// family with the status, newest first. All of them are listed if the limit
+// isn't positive.
+func (deployer *Deployer) listTaskDefinitions(ctx context.Context, family string, status types.TaskDefinitionStatus, limit int) ([]string, error) {
+	if limit <= 0 {
+		limit = math.MaxInt
+	}
+
+	arns := []string{}
+	paginator := ecs.NewListTaskDefinitionsPaginator(deployer.client, &ecs.ListTaskDefinitionsInput{
+		FamilyPrefix: &family,
+		Sort:         types.SortOrderDesc,
+		Status:       status,
+	})
+	for paginator.HasMorePages() && len(arns) < limit {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		// The family is only a prefix so other families can be listed too.
+		for _, arn := range page.TaskDefinitionArns {
+			candidateFamily, _, err := parseTaskDefinitionArn(arn)
+			if err != nil || candidateFamily != family || len(arns) >= limit {
+				continue
+			}
+			arns = append(arns, arn)
+		}
+	}
+
+	return arns, nil
+}
+
+// parseTaskDefinitionArn returns the family and revision of the task
+// definition.
+func parseTaskDefinitionArn(taskDefinitionArn string) (string, int, error) {
+	var taskDefinitionRegex = regexp.MustCompile(`task-definition/([^:]+):(\d+)$`)
+	matches := taskDefinitionRegex.FindStringSubmatch(taskDefinitionArn)
+	if matches == nil {
+		return "", 0, fmt.Errorf("unable to parse task definition %s", taskDefinitionArn)
+	}
+	revision, _ := strconv.Atoi(matches[2])
+
+	return matches[1], revision, nil
+}
+
+// taskDefinitionFamily returns the family of a task definition given as a
+// family, family and revision (family:revision) or ARN.
+func taskDefinitionFamily(taskDefinition string) string {
+	if family, _, err := parseTaskDefinitionArn(taskDefinition); err == nil {
+		return family
+	}
+	family, _, _ := strings.Cut(taskDefinition, ":")
+
+	return family
+}
+
+// sortTaskDefinitionArns sorts the task definitions of a family by revision,
+// newest first.
+func sortTaskDefinitionArns(arns []string) {
+	sort.SliceStable(arns, func(i, j int) bool {
+		_, revisionI, _ := parseTaskDefinitionArn(arns[i])
+		_, revisionJ, _ := parseTaskDefinitionArn(arns[j])
+
+		return revisionI > revisionJ
+	})
+}
+
+// deploymentMetadata reads the deployment metadata back from the tags, it
+// returns nil if there's none.
+func deploymentMetadata(tags []types.Tag) *DeploymentMetadata {
+	metadata := &DeploymentMetadata{Tags: map[string]string{}}
+	for _, tag := range tags {
+		if tag.Key == nil || tag.Value == nil {
+			continue
+		}
+
+		switch *tag.Key {
+		case TagDeploymentID:
+			metadata.DeploymentID = *tag.Value
+		case TagImageTag:
+			metadata.ImageTag = *tag.Value
+		case TagGitCommit:
+			metadata.GitCommit = *tag.Value
+		case TagCIRunURL:
+			metadata.CIRunURL = *tag.Value
+		case TagDeployedBy:
+			metadata.DeployedBy = *tag.Value
+		case TagDeployedAt:
+			metadata.DeployedAt, _ = time.Parse(time.RFC3339, *tag.Value)
+		default:
+			metadata.Tags[*tag.Key] = *tag.Value
+		}
+	}
+
+	if metadata.DeploymentID == "" {
+		return nil
+	}
+
+	return metadata
+}
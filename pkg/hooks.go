@@ -0,0 +1,191 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// hookEnvironmentPrefix is prepended to the names of all the environment
+// variables that expose the deployment context to hooks.
+const hookEnvironmentPrefix = "ECS_TOOLKIT_"
+
+// RunHooks runs the hooks configured for the stage one after the other,
+// stopping at the first one that fails unless it's allowed to continue on
+// error. Hooks are local shell commands with the deployment context exposed to
+// them as environment variables, they're killed if the context is cancelled.
+func (config *Config) RunHooks(ctx context.Context, stage HookStage, deployment *Deployment) error {
+	clusterSublogger := deployment.logger().WithField("hook-stage", stage)
+
+	hooks := config.Hooks.forStage(stage)
+	if len(hooks) == 0 {
+		clusterSublogger.Debugf("skipping %s hooks, none found", stage)
+
+		return nil
+	}
+	clusterSublogger.Infof("running %s hooks", stage)
+
+	environment := append(os.Environ(), hookEnvironment(stage, deployment)...)
+	for index := range hooks {
+		hookNo := index + 1
+		hook := &hooks[index]
+
+		err := runHook(ctx, &hookNo, hook, environment, clusterSublogger)
+		if err != nil {
+			if hook.ContinueOnError != nil && *hook.ContinueOnError {
+				clusterSublogger.Warnf("ignoring failed hook [%d], continue on error set", hookNo)
+
+				continue
+			}
+
+			return fmt.Errorf("unable to run all %s hooks: %w", stage, err)
+		}
+	}
+	clusterSublogger.Infof("completed %s hooks", stage)
+
+	return nil
+}
+
+func runHook(ctx context.Context, hookNo *int, hook *Hook, environment []string, logger *log.Entry) error {
+	hookSublogger := logger
+	if hook.Name != nil {
+		hookSublogger = logger.WithField("hook", *hook.Name)
+	}
+
+	// Set maximum run time, on top of the deployment being cancelled.
+	hookCtx := ctx
+	if hook.Timeout != nil {
+		var cancel context.CancelFunc
+		hookCtx, cancel = context.WithTimeout(ctx, time.Duration(*hook.Timeout)*time.Second)
+		defer cancel()
+	}
+
+	shell, shellFlag := "sh", "-c"
+	if runtime.GOOS == "windows" {
+		shell, shellFlag = "cmd", "/C"
+	}
+
+	// Pass on everything the command prints out to the logs as it happens so
+	// that it's easy to follow along.
+	stdout := hookSublogger.WriterLevel(log.InfoLevel)
+	defer stdout.Close()
+	stderr := hookSublogger.WriterLevel(log.WarnLevel)
+	defer stderr.Close()
+
+	command := exec.CommandContext(hookCtx, shell, shellFlag, hook.Command)
+	command.Env = environment
+	command.Stdout = stdout
+	command.Stderr = stderr
+
+	hookSublogger.Infof("running hook [%d] ... command: %s", *hookNo, hook.Command)
+	err := command.Run()
+	if err != nil {
+		switch {
+		case hookCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil:
+			err = fmt.Errorf("timed out after %ds", *hook.Timeout)
+		case ctx.Err() != nil:
+			err = fmt.Errorf("cancelled: %w", ctx.Err())
+		}
+		hookSublogger.Errorf("unable to run hook [%d]: %v", *hookNo, err)
+
+		return err
+	}
+	hookSublogger.Infof("successfully ran hook [%d]", *hookNo)
+
+	return nil
+}
+
+func (hooks *Hooks) forStage(stage HookStage) []Hook {
+	switch stage {
+	case HookStageBeforeDeploy:
+		return hooks.BeforeDeploy
+	case HookStageAfterPreTasks:
+		return hooks.AfterPreTasks
+	case HookStageAfterServices:
+		return hooks.AfterServices
+	case HookStageAfterDeploy:
+		return hooks.AfterDeploy
+	case HookStageOnFailure:
+		return hooks.OnFailure
+	}
+
+	return nil
+}
+
+// hookEnvironment exposes the deployment context to hooks, for example:
+//
+//	ECS_TOOLKIT_HOOK_STAGE=after_services
+//	ECS_TOOLKIT_DEPLOYMENT_ID=20230102T150405Z-5f3a9c
+//	ECS_TOOLKIT_CLUSTER=example
+//	ECS_TOOLKIT_IMAGE_TAG=5a853f72
+//	ECS_TOOLKIT_STATUS=running
+//	ECS_TOOLKIT_TASK_DEFINITIONS=arn:...:task-definition/app-web-server:104
+//	ECS_TOOLKIT_SERVICES=app-web-server=succeeded
+//	ECS_TOOLKIT_SERVICE_APP_WEB_SERVER_STATUS=succeeded
+//	ECS_TOOLKIT_PRE_TASKS=app-database-migrate=succeeded
+//	ECS_TOOLKIT_PRE_TASK_APP_DATABASE_MIGRATE_STATUS=succeeded
+func hookEnvironment(stage HookStage, deployment *Deployment) []string {
+	environment := map[string]string{
+		"HOOK_STAGE":       string(stage),
+		"DEPLOYMENT_ID":    deployment.ID,
+		"CLUSTER":          deployment.Target.Cluster,
+		"IMAGE_TAG":        deployment.ImageTag,
+		"STATUS":           string(deployment.Status()),
+		"TASK_DEFINITIONS": strings.Join(deployment.TaskDefinitions(), " "),
+	}
+
+	if deployment.Target.Region != nil {
+		environment["REGION"] = *deployment.Target.Region
+	}
+
+	addStatuses := func(group string, item string, statuses map[string]Status) {
+		pairs := []string{}
+		for _, name := range sortedStatusNames(statuses) {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", name, statuses[name]))
+			environment[fmt.Sprintf("%s_%s_STATUS", item, environmentName(name))] = string(statuses[name])
+		}
+		environment[group] = strings.Join(pairs, " ")
+	}
+	addStatuses("SERVICES", "SERVICE", deployment.ServiceStatuses())
+	addStatuses("PRE_TASKS", "PRE_TASK", deployment.TaskStatuses(TaskStagePre))
+	addStatuses("POST_TASKS", "POST_TASK", deployment.TaskStatuses(TaskStagePost))
+
+	variables := []string{}
+	for name, value := range environment {
+		variables = append(variables, fmt.Sprintf("%s%s=%s", hookEnvironmentPrefix, name, value))
+	}
+
+	return variables
+}
+
+// environmentName turns a service name or task family into something that can
+// be used in an environment variable name e.g. app-web-server to
+// APP_WEB_SERVER.
+func environmentName(name string) string {
+	var invalidCharactersRegex = regexp.MustCompile(`[^A-Z0-9_]`)
+
+	return invalidCharactersRegex.ReplaceAllString(strings.ToUpper(name), "_")
+}
@@ -0,0 +1,203 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	elbtypes "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// serviceTarget is where a load balancer sends traffic to a task, the IP
+// address of the task or the ID of the instance it's on, and the port.
+type serviceTarget struct {
+	id   string
+	port int32
+}
+
+func (serviceTarget serviceTarget) String() string {
+	return fmt.Sprintf("%s:%d", serviceTarget.id, serviceTarget.port)
+}
+
+func (service *Service) waitForTargets() bool {
+	return service.WaitForTargets == nil || *service.WaitForTargets
+}
+
+// waitForTargetsHealthy waits for the tasks of the service's current task
+// definition to be registered and healthy in all of its target groups, ECS
+// can consider a service stable before then.
+func (deployer *Deployer) waitForTargetsHealthy(ctx context.Context, deployment *Deployment, watch *serviceWatch, serviceSublogger *log.Entry) error {
+	problems := []string{}
+	for {
+		service, tasks, err := deployer.pollServiceTasks(ctx, deployment, watch, types.DesiredStatusRunning)
+		if err != nil {
+			return err
+		}
+
+		// Only the tasks of the new deployment matter, the old ones are on
+		// their way out.
+		newTasks := []types.Task{}
+		for _, task := range tasks {
+			if *task.TaskDefinitionArn == *service.TaskDefinition {
+				newTasks = append(newTasks, task)
+			}
+		}
+
+		currentProblems := []string{}
+		for _, loadBalancer := range service.LoadBalancers {
+			// Classic load balancers don't have target groups, and without the
+			// container there's no telling which targets are the service's.
+			if loadBalancer.TargetGroupArn == nil || loadBalancer.ContainerName == nil || loadBalancer.ContainerPort == nil {
+				continue
+			}
+
+			targetProblems, err := deployer.checkTargetHealth(ctx, deployment, loadBalancer, newTasks)
+			if err != nil {
+				return err
+			}
+			currentProblems = append(currentProblems, targetProblems...)
+		}
+
+		if len(currentProblems) == 0 {
+			return nil
+		}
+
+		if strings.Join(currentProblems, "") != strings.Join(problems, "") {
+			for _, problem := range currentProblems {
+				serviceSublogger.Infof("waiting for load balancer target ... %s", problem)
+			}
+		}
+		problems = currentProblems
+
+		if deployer.clock.Now().After(watch.deadline) {
+			return &ErrTargetsUnhealthy{Service: watch.name, MaxWait: watch.maxWaitTime, Problems: problems}
+		}
+	}
+}
+
+// checkTargetHealth returns what's keeping the tasks from being healthy
+// targets of the load balancer's target group, if anything.
+func (deployer *Deployer) checkTargetHealth(ctx context.Context, deployment *Deployment, loadBalancer types.LoadBalancer, tasks []types.Task) ([]string, error) {
+	targets, err := deployer.taskTargets(ctx, deployment, loadBalancer, tasks)
+	if err != nil {
+		return nil, err
+	}
+
+	targetHealthResult, err := deployer.elbClient.DescribeTargetHealth(ctx, &elasticloadbalancingv2.DescribeTargetHealthInput{
+		TargetGroupArn: loadBalancer.TargetGroupArn,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	targetHealths := map[serviceTarget]*elbtypes.TargetHealth{}
+	for _, description := range targetHealthResult.TargetHealthDescriptions {
+		if description.Target == nil || description.Target.Id == nil || description.Target.Port == nil {
+			continue
+		}
+		targetHealths[serviceTarget{id: *description.Target.Id, port: *description.Target.Port}] = description.TargetHealth
+	}
+
+	targetGroup := *loadBalancer.TargetGroupArn
+	if index := strings.Index(targetGroup, "targetgroup/"); index >= 0 {
+		targetGroup = targetGroup[index:]
+	}
+
+	problems := []string{}
+	for _, target := range targets {
+		targetHealth, ok := targetHealths[target]
+		switch {
+		case !ok || targetHealth == nil:
+			problems = append(problems, fmt.Sprintf("target group: %s, target: %s, state: not registered", targetGroup, target))
+		case targetHealth.State != elbtypes.TargetHealthStateEnumHealthy:
+			problem := fmt.Sprintf("target group: %s, target: %s, state: %s", targetGroup, target, targetHealth.State)
+			if targetHealth.Reason != "" {
+				problem = fmt.Sprintf("%s, reason: %s", problem, targetHealth.Reason)
+			}
+			if targetHealth.Description != nil {
+				problem = fmt.Sprintf("%s (%s)", problem, strings.ToLower(*targetHealth.Description))
+			}
+			problems = append(problems, problem)
+		}
+	}
+	sort.Strings(problems)
+
+	return problems, nil
+}
+
+// taskTargets works out how the tasks are registered with the load balancer,
+// by IP address for tasks with their own network interface and by instance
+// otherwise.
+func (deployer *Deployer) taskTargets(ctx context.Context, deployment *Deployment, loadBalancer types.LoadBalancer, tasks []types.Task) ([]serviceTarget, error) {
+	targets := []serviceTarget{}
+	containerInstanceTargets := map[string][]int32{}
+	for _, task := range tasks {
+		for _, container := range task.Containers {
+			if container.Name == nil || *container.Name != *loadBalancer.ContainerName {
+				continue
+			}
+
+			if len(container.NetworkInterfaces) > 0 && container.NetworkInterfaces[0].PrivateIpv4Address != nil {
+				targets = append(targets, serviceTarget{id: *container.NetworkInterfaces[0].PrivateIpv4Address, port: *loadBalancer.ContainerPort})
+
+				continue
+			}
+
+			for _, networkBinding := range container.NetworkBindings {
+				if networkBinding.ContainerPort != nil && networkBinding.HostPort != nil && *networkBinding.ContainerPort == *loadBalancer.ContainerPort && task.ContainerInstanceArn != nil {
+					containerInstanceTargets[*task.ContainerInstanceArn] = append(containerInstanceTargets[*task.ContainerInstanceArn], *networkBinding.HostPort)
+				}
+			}
+		}
+	}
+
+	if len(containerInstanceTargets) == 0 {
+		return targets, nil
+	}
+
+	containerInstanceArns := []string{}
+	for arn := range containerInstanceTargets {
+		containerInstanceArns = append(containerInstanceArns, arn)
+	}
+	containerInstancesResult, err := deployer.client.DescribeContainerInstances(ctx, &ecs.DescribeContainerInstancesInput{
+		Cluster:            &deployment.Target.Cluster,
+		ContainerInstances: containerInstanceArns,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, containerInstance := range containerInstancesResult.ContainerInstances {
+		if containerInstance.Ec2InstanceId == nil {
+			continue
+		}
+
+		for _, port := range containerInstanceTargets[*containerInstance.ContainerInstanceArn] {
+			targets = append(targets, serviceTarget{id: *containerInstance.Ec2InstanceId, port: port})
+		}
+	}
+
+	return targets, nil
+}
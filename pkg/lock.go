@@ -0,0 +1,259 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultLockKey is the key of the deployment lock unless set otherwise.
+	DefaultLockKey = "default"
+
+	// DefaultLockTTL is how long the deployment lock is held for without
+	// being renewed unless set otherwise.
+	DefaultLockTTL = 5 * time.Minute
+)
+
+// Locker keeps more than one deployment of the same application to a cluster
+// from running at the same time. A lock that isn't renewed before it expires
+// can be taken over by someone else.
+type Locker interface {
+	// Acquire takes the lock for the lease's owner, failing with ErrLocked if
+	// someone else holds it. The lease's acquisition time is taken as the
+	// current time when checking whether the lock has expired, so that it
+	// follows the deployer's clock.
+	Acquire(ctx context.Context, lease *LockLease) error
+
+	// Renew extends the lease, failing with ErrLockLost if the owner no
+	// longer holds the lock.
+	Renew(ctx context.Context, lease *LockLease) error
+
+	// Release gives up the lock if the owner still holds it.
+	Release(ctx context.Context, lease *LockLease) error
+
+	// Status returns who holds the lock, or nil if no one does.
+	Status(ctx context.Context, cluster string, key string) (*LockLease, error)
+
+	// ForceRelease gives up the lock whoever holds it.
+	ForceRelease(ctx context.Context, cluster string, key string) error
+}
+
+// LockLease describes who holds the deployment lock and until when.
+type LockLease struct {
+	Cluster    string
+	Key        string
+	Owner      string
+	ImageTag   string
+	AcquiredAt time.Time
+	ExpiresAt  time.Time
+}
+
+// NewLocker sets up the backend of the deployment lock in the config using
+// clients created from the AWS config.
+func NewLocker(lock *Lock, awsCfg aws.Config) Locker {
+	switch lock.backend() {
+	case LockBackendDynamoDB:
+		return NewDynamoDBLocker(dynamodb.NewFromConfig(awsCfg), *lock.Table)
+	default:
+		return NewECSLocker(ecs.NewFromConfig(awsCfg))
+	}
+}
+
+func (lock *Lock) backend() LockBackend {
+	if lock.Backend != nil {
+		return LockBackend(*lock.Backend)
+	}
+
+	return LockBackendECS
+}
+
+// LockKey returns the key of the deployment lock, which identifies the
+// application within the cluster.
+func (lock *Lock) LockKey() string {
+	if lock.Key != nil {
+		return *lock.Key
+	}
+
+	return DefaultLockKey
+}
+
+func (lock *Lock) ttl() time.Duration {
+	if lock.TTL != nil {
+		return time.Duration(*lock.TTL) * time.Second
+	}
+
+	return DefaultLockTTL
+}
+
+func (lock *Lock) wait() time.Duration {
+	if lock.Wait != nil {
+		return time.Duration(*lock.Wait) * time.Second
+	}
+
+	return 0
+}
+
+// Expired returns whether the lease has run out at the given time.
+func (lease *LockLease) Expired(now time.Time) bool {
+	return !now.Before(lease.ExpiresAt)
+}
+
+// acquireLock takes the deployment lock of the target, waiting for as long as
+// allowed if someone else holds it.
+func (deployer *Deployer) acquireLock(ctx context.Context, target *Target, imageTag string) (*LockLease, error) {
+	lockConfig := deployer.config.Lock
+	lockSublogger := target.loggerFrom(deployer.logger).WithField("lock", lockConfig.LockKey())
+
+	deadline := deployer.clock.Now().Add(lockConfig.wait())
+	for {
+		now := deployer.clock.Now()
+		lease := &LockLease{
+			Cluster:    target.Cluster,
+			Key:        lockConfig.LockKey(),
+			Owner:      deployer.lockOwner,
+			ImageTag:   imageTag,
+			AcquiredAt: now.UTC(),
+			ExpiresAt:  now.Add(lockConfig.ttl()).UTC(),
+		}
+
+		lockSublogger.Debug("acquiring deployment lock")
+		err := deployer.locker.Acquire(ctx, lease)
+		if err == nil {
+			lockSublogger.Infof("acquired deployment lock as %s", lease.Owner)
+
+			return lease, nil
+		}
+
+		var lockedErr *ErrLocked
+		if !errors.As(err, &lockedErr) || !deployer.clock.Now().Before(deadline) {
+			return nil, err
+		}
+		lockSublogger.Infof("waiting for deployment lock held by %s", lockedErr.Owner)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-deployer.clock.After(deployer.pollInterval):
+		}
+	}
+}
+
+// holdLock takes the deployment lock of the target, if the config has one,
+// and keeps it until the returned function is called. The returned context is
+// cancelled if the lock is lost along the way.
+func (deployer *Deployer) holdLock(ctx context.Context, target *Target, imageTag string) (context.Context, func(), error) {
+	if deployer.config.Lock == nil {
+		return ctx, func() {}, nil
+	}
+
+	lease, err := deployer.acquireLock(ctx, target, imageTag)
+	if err != nil {
+		target.loggerFrom(deployer.logger).Errorf("unable to acquire deployment lock: %v", err)
+
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	stopRenewing := deployer.renewLock(ctx, cancel, lease)
+
+	return ctx, func() {
+		stopRenewing()
+		cancel()
+		deployer.releaseLock(lease)
+	}, nil
+}
+
+// renewLock keeps renewing the lease in the background until the returned
+// function is called. If the lock is lost the deployment is cancelled since
+// someone else could be deploying now.
+func (deployer *Deployer) renewLock(ctx context.Context, cancel context.CancelFunc, lease *LockLease) func() {
+	lockSublogger := deployer.logger.WithFields(log.Fields{"cluster": lease.Cluster, "lock": lease.Key})
+	ttl := deployer.config.Lock.ttl()
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-deployer.clock.After(ttl / 3):
+			}
+
+			lease.ExpiresAt = deployer.clock.Now().Add(ttl).UTC()
+			err := deployer.locker.Renew(ctx, lease)
+			if err == nil {
+				lockSublogger.Debugf("renewed deployment lock until %s", lease.ExpiresAt.Format(time.RFC3339))
+
+				continue
+			}
+
+			var lostErr *ErrLockLost
+			if errors.As(err, &lostErr) {
+				lockSublogger.Errorf("lost deployment lock, cancelling deployment: %v", err)
+				cancel()
+
+				return
+			}
+			lockSublogger.Warnf("unable to renew deployment lock: %v", err)
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// releaseLock gives up the lease, the deployment is over by then so failing
+// to do so is only logged. The lock expires on its own anyway.
+func (deployer *Deployer) releaseLock(lease *LockLease) {
+	lockSublogger := deployer.logger.WithFields(log.Fields{"cluster": lease.Cluster, "lock": lease.Key})
+
+	err := deployer.locker.Release(context.Background(), lease)
+	if err != nil {
+		lockSublogger.Warnf("unable to release deployment lock: %v", err)
+
+		return
+	}
+	lockSublogger.Info("released deployment lock")
+}
+
+// defaultLockOwner identifies who's deploying by user, host and process.
+func defaultLockOwner() string {
+	owner := fmt.Sprintf("%s:%d", localIdentity(), os.Getpid())
+
+	// Keep to the characters allowed in resource tags so that all backends
+	// can store it.
+	return regexp.MustCompile(`[^\w.:/=+@-]`).ReplaceAllString(owner, "-")
+}
@@ -0,0 +1,200 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DynamoDBLocker keeps the deployment lock in a DynamoDB table, taking it with
+// a conditional write so that only one deployment can ever hold it. The table
+// must have a string partition key named `lock_id`, the `expires_at` attribute
+// can be used as its time to live.
+type DynamoDBLocker struct {
+	client DynamoDBAPI
+	table  string
+}
+
+// NewDynamoDBLocker sets up a deployment lock kept in the DynamoDB table.
+func NewDynamoDBLocker(client DynamoDBAPI, table string) *DynamoDBLocker {
+	return &DynamoDBLocker{client: client, table: table}
+}
+
+func (locker *DynamoDBLocker) Acquire(ctx context.Context, lease *LockLease) error {
+	_, err := locker.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           &locker.table,
+		Item:                dynamoDBLockItem(lease),
+		ConditionExpression: aws.String("attribute_not_exists(lock_id) OR expires_at <= :now OR #owner = :owner"),
+		ExpressionAttributeNames: map[string]string{
+			"#owner": "owner",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now":   dynamoDBTime(lease.AcquiredAt),
+			":owner": &types.AttributeValueMemberS{Value: lease.Owner},
+		},
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		current, err := locker.Status(ctx, lease.Cluster, lease.Key)
+		if err != nil {
+			return err
+		}
+
+		lockedErr := &ErrLocked{Key: lease.Key}
+		if current != nil {
+			lockedErr.Owner = current.Owner
+			lockedErr.ExpiresAt = current.ExpiresAt
+		}
+
+		return lockedErr
+	}
+
+	return err
+}
+
+func (locker *DynamoDBLocker) Renew(ctx context.Context, lease *LockLease) error {
+	_, err := locker.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           &locker.table,
+		Key:                 dynamoDBLockKey(lease.Cluster, lease.Key),
+		UpdateExpression:    aws.String("SET expires_at = :expires_at"),
+		ConditionExpression: aws.String("#owner = :owner"),
+		ExpressionAttributeNames: map[string]string{
+			"#owner": "owner",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":expires_at": dynamoDBTime(lease.ExpiresAt),
+			":owner":      &types.AttributeValueMemberS{Value: lease.Owner},
+		},
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return &ErrLockLost{Key: lease.Key}
+	}
+
+	return err
+}
+
+func (locker *DynamoDBLocker) Release(ctx context.Context, lease *LockLease) error {
+	_, err := locker.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:           &locker.table,
+		Key:                 dynamoDBLockKey(lease.Cluster, lease.Key),
+		ConditionExpression: aws.String("#owner = :owner"),
+		ExpressionAttributeNames: map[string]string{
+			"#owner": "owner",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":owner": &types.AttributeValueMemberS{Value: lease.Owner},
+		},
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return &ErrLockLost{Key: lease.Key}
+	}
+
+	return err
+}
+
+func (locker *DynamoDBLocker) Status(ctx context.Context, cluster string, key string) (*LockLease, error) {
+	itemResult, err := locker.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      &locker.table,
+		Key:            dynamoDBLockKey(cluster, key),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(itemResult.Item) == 0 {
+		return nil, nil
+	}
+
+	lease := &LockLease{Cluster: cluster, Key: key}
+	if owner, ok := itemResult.Item["owner"].(*types.AttributeValueMemberS); ok {
+		lease.Owner = owner.Value
+	}
+	if imageTag, ok := itemResult.Item["image_tag"].(*types.AttributeValueMemberS); ok {
+		lease.ImageTag = imageTag.Value
+	}
+	if acquiredAt, ok := itemResult.Item["acquired_at"].(*types.AttributeValueMemberN); ok {
+		lease.AcquiredAt, err = parseDynamoDBTime(acquiredAt.Value)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse acquired_at: %v", err)
+		}
+	}
+	if expiresAt, ok := itemResult.Item["expires_at"].(*types.AttributeValueMemberN); ok {
+		lease.ExpiresAt, err = parseDynamoDBTime(expiresAt.Value)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse expires_at: %v", err)
+		}
+	}
+
+	return lease, nil
+}
+
+func (locker *DynamoDBLocker) ForceRelease(ctx context.Context, cluster string, key string) error {
+	_, err := locker.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: &locker.table,
+		Key:       dynamoDBLockKey(cluster, key),
+	})
+
+	return err
+}
+
+// dynamoDBLockKey identifies the lock of an application in a cluster, the
+// same table can hold the locks of several clusters.
+func dynamoDBLockKey(cluster string, key string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"lock_id": &types.AttributeValueMemberS{Value: cluster + "/" + key},
+	}
+}
+
+func dynamoDBLockItem(lease *LockLease) map[string]types.AttributeValue {
+	item := dynamoDBLockKey(lease.Cluster, lease.Key)
+	item["owner"] = &types.AttributeValueMemberS{Value: lease.Owner}
+	item["acquired_at"] = dynamoDBTime(lease.AcquiredAt)
+	item["expires_at"] = dynamoDBTime(lease.ExpiresAt)
+	if lease.ImageTag != "" {
+		item["image_tag"] = &types.AttributeValueMemberS{Value: lease.ImageTag}
+	}
+
+	return item
+}
+
+// dynamoDBTime stores times as seconds since the epoch, the format DynamoDB
+// expects for time to live attributes.
+func dynamoDBTime(t time.Time) *types.AttributeValueMemberN {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(t.Unix(), 10)}
+}
+
+func parseDynamoDBTime(value string) (time.Time, error) {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(seconds, 0).UTC(), nil
+}
@@ -0,0 +1,207 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+// ecsLockTagPrefix is the prefix of the cluster tags that hold deployment
+// locks, followed by the lock's key.
+const ecsLockTagPrefix = "ecs-toolkit:lock:"
+
+// ECSLocker keeps the deployment lock in a tag on the cluster, which needs no
+// extra infrastructure. Tags can't be written conditionally so the lock is
+// checked again after it's taken, two deployments starting at the exact same
+// time could still both get it. Use DynamoDBLocker where that matters.
+type ECSLocker struct {
+	client ECSAPI
+}
+
+// NewECSLocker sets up a deployment lock kept in cluster tags.
+func NewECSLocker(client ECSAPI) *ECSLocker {
+	return &ECSLocker{client: client}
+}
+
+func (locker *ECSLocker) Acquire(ctx context.Context, lease *LockLease) error {
+	current, err := locker.Status(ctx, lease.Cluster, lease.Key)
+	if err != nil {
+		return err
+	}
+	if current != nil && current.Owner != lease.Owner && !current.Expired(lease.AcquiredAt) {
+		return &ErrLocked{Key: lease.Key, Owner: current.Owner, ExpiresAt: current.ExpiresAt}
+	}
+
+	err = locker.tag(ctx, lease)
+	if err != nil {
+		return err
+	}
+
+	// Someone else may have taken the lock at the same time, whoever wrote
+	// last has it.
+	current, err = locker.Status(ctx, lease.Cluster, lease.Key)
+	if err != nil {
+		return err
+	}
+	if current == nil || current.Owner != lease.Owner {
+		owner := ""
+		if current != nil {
+			owner = current.Owner
+		}
+
+		return &ErrLocked{Key: lease.Key, Owner: owner}
+	}
+
+	return nil
+}
+
+func (locker *ECSLocker) Renew(ctx context.Context, lease *LockLease) error {
+	current, err := locker.Status(ctx, lease.Cluster, lease.Key)
+	if err != nil {
+		return err
+	}
+	if current == nil || current.Owner != lease.Owner {
+		return &ErrLockLost{Key: lease.Key}
+	}
+
+	return locker.tag(ctx, lease)
+}
+
+func (locker *ECSLocker) Release(ctx context.Context, lease *LockLease) error {
+	current, err := locker.Status(ctx, lease.Cluster, lease.Key)
+	if err != nil {
+		return err
+	}
+	if current == nil || current.Owner != lease.Owner {
+		return &ErrLockLost{Key: lease.Key}
+	}
+
+	return locker.ForceRelease(ctx, lease.Cluster, lease.Key)
+}
+
+func (locker *ECSLocker) Status(ctx context.Context, cluster string, key string) (*LockLease, error) {
+	clusterArn, err := locker.clusterArn(ctx, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	tagsResult, err := locker.client.ListTagsForResource(ctx, &ecs.ListTagsForResourceInput{ResourceArn: &clusterArn})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tag := range tagsResult.Tags {
+		if tag.Key == nil || tag.Value == nil || *tag.Key != ecsLockTagPrefix+key {
+			continue
+		}
+
+		lease, err := parseECSLockTag(*tag.Value)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse lock tag %s: %v", *tag.Key, err)
+		}
+		lease.Cluster = cluster
+		lease.Key = key
+
+		return lease, nil
+	}
+
+	return nil, nil
+}
+
+func (locker *ECSLocker) ForceRelease(ctx context.Context, cluster string, key string) error {
+	clusterArn, err := locker.clusterArn(ctx, cluster)
+	if err != nil {
+		return err
+	}
+
+	_, err = locker.client.UntagResource(ctx, &ecs.UntagResourceInput{
+		ResourceArn: &clusterArn,
+		TagKeys:     []string{ecsLockTagPrefix + key},
+	})
+
+	return err
+}
+
+func (locker *ECSLocker) tag(ctx context.Context, lease *LockLease) error {
+	clusterArn, err := locker.clusterArn(ctx, lease.Cluster)
+	if err != nil {
+		return err
+	}
+
+	tagKey := ecsLockTagPrefix + lease.Key
+	tagValue := fmt.Sprintf("owner=%s image_tag=%s acquired=%s expires=%s", lease.Owner, lease.ImageTag, lease.AcquiredAt.Format(time.RFC3339), lease.ExpiresAt.Format(time.RFC3339))
+	_, err = locker.client.TagResource(ctx, &ecs.TagResourceInput{
+		ResourceArn: &clusterArn,
+		Tags:        []types.Tag{{Key: &tagKey, Value: &tagValue}},
+	})
+
+	return err
+}
+
+// clusterArn looks up the ARN of the cluster since tags can only be set on
+// resources by ARN.
+func (locker *ECSLocker) clusterArn(ctx context.Context, cluster string) (string, error) {
+	if strings.HasPrefix(cluster, "arn:") {
+		return cluster, nil
+	}
+
+	clustersResult, err := locker.client.DescribeClusters(ctx, &ecs.DescribeClustersInput{Clusters: []string{cluster}})
+	if err != nil {
+		return "", err
+	}
+	if len(clustersResult.Clusters) == 0 || clustersResult.Clusters[0].ClusterArn == nil {
+		return "", fmt.Errorf("cluster %s not found", cluster)
+	}
+
+	return *clustersResult.Clusters[0].ClusterArn, nil
+}
+
+// parseECSLockTag reads a lease from a tag value like `owner=ci@runner:42
+// image_tag=5a853f72 acquired=2023-01-02T15:04:05Z expires=2023-01-02T15:09:05Z`.
+func parseECSLockTag(value string) (*LockLease, error) {
+	lease := &LockLease{}
+	for _, field := range strings.Fields(value) {
+		name, fieldValue, _ := strings.Cut(field, "=")
+
+		var err error
+		switch name {
+		case "owner":
+			lease.Owner = fieldValue
+		case "image_tag":
+			lease.ImageTag = fieldValue
+		case "acquired":
+			lease.AcquiredAt, err = time.Parse(time.RFC3339, fieldValue)
+		case "expires":
+			lease.ExpiresAt, err = time.Parse(time.RFC3339, fieldValue)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if lease.Owner == "" {
+		return nil, fmt.Errorf("no owner in %q", value)
+	}
+
+	return lease, nil
+}
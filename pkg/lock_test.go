@@ -0,0 +1,266 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// fakeDynamoDBClient stands in for a DynamoDB table keyed by `lock_id`. It
+// understands the condition expressions the lock uses: `attribute_not_exists`
+// along with `=` and `<=` comparisons joined by `OR`.
+type fakeDynamoDBClient struct {
+	mutex sync.Mutex
+	items map[string]map[string]dynamodbtypes.AttributeValue
+}
+
+func newFakeDynamoDBClient() *fakeDynamoDBClient {
+	return &fakeDynamoDBClient{items: map[string]map[string]dynamodbtypes.AttributeValue{}}
+}
+
+func (client *fakeDynamoDBClient) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	return &dynamodb.GetItemOutput{Item: client.items[fakeDynamoDBKey(params.Key)]}, nil
+}
+
+func (client *fakeDynamoDBClient) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	key := fakeDynamoDBKey(params.Item)
+	if !fakeDynamoDBCondition(params.ConditionExpression, params.ExpressionAttributeNames, params.ExpressionAttributeValues, client.items[key]) {
+		return nil, &dynamodbtypes.ConditionalCheckFailedException{}
+	}
+	client.items[key] = params.Item
+
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (client *fakeDynamoDBClient) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	key := fakeDynamoDBKey(params.Key)
+	item := client.items[key]
+	if item == nil || !fakeDynamoDBCondition(params.ConditionExpression, params.ExpressionAttributeNames, params.ExpressionAttributeValues, item) {
+		return nil, &dynamodbtypes.ConditionalCheckFailedException{}
+	}
+
+	// Only `SET name = :value, ...` is supported.
+	for _, assignment := range strings.Split(strings.TrimPrefix(*params.UpdateExpression, "SET "), ",") {
+		name, value, _ := strings.Cut(assignment, "=")
+		item[strings.TrimSpace(name)] = params.ExpressionAttributeValues[strings.TrimSpace(value)]
+	}
+
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (client *fakeDynamoDBClient) DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	key := fakeDynamoDBKey(params.Key)
+	if params.ConditionExpression != nil && !fakeDynamoDBCondition(params.ConditionExpression, params.ExpressionAttributeNames, params.ExpressionAttributeValues, client.items[key]) {
+		return nil, &dynamodbtypes.ConditionalCheckFailedException{}
+	}
+	delete(client.items, key)
+
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func fakeDynamoDBKey(item map[string]dynamodbtypes.AttributeValue) string {
+	return item["lock_id"].(*dynamodbtypes.AttributeValueMemberS).Value
+}
+
+// fakeDynamoDBCondition evaluates the condition against the item, which is
+// nil if there isn't one.
+func fakeDynamoDBCondition(expression *string, names map[string]string, values map[string]dynamodbtypes.AttributeValue, item map[string]dynamodbtypes.AttributeValue) bool {
+	if expression == nil {
+		return true
+	}
+
+	for _, clause := range strings.Split(*expression, " OR ") {
+		clause = strings.TrimSpace(clause)
+		if strings.HasPrefix(clause, "attribute_not_exists(") {
+			if item[strings.TrimSuffix(strings.TrimPrefix(clause, "attribute_not_exists("), ")")] == nil {
+				return true
+			}
+
+			continue
+		}
+
+		fields := strings.Fields(clause)
+		name := fields[0]
+		if alias, ok := names[name]; ok {
+			name = alias
+		}
+		current, ok := item[name]
+		if !ok {
+			continue
+		}
+
+		switch current := current.(type) {
+		case *dynamodbtypes.AttributeValueMemberS:
+			if fields[1] == "=" && current.Value == values[fields[2]].(*dynamodbtypes.AttributeValueMemberS).Value {
+				return true
+			}
+		case *dynamodbtypes.AttributeValueMemberN:
+			currentNumber, _ := strconv.ParseInt(current.Value, 10, 64)
+			number, _ := strconv.ParseInt(values[fields[2]].(*dynamodbtypes.AttributeValueMemberN).Value, 10, 64)
+			if (fields[1] == "=" && currentNumber == number) || (fields[1] == "<=" && currentNumber <= number) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func TestLockers(t *testing.T) {
+	start := time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC)
+	ttl := 5 * time.Minute
+	lease := func(owner string, acquiredAt time.Time) *LockLease {
+		return &LockLease{
+			Cluster:    "test",
+			Key:        DefaultLockKey,
+			Owner:      owner,
+			ImageTag:   "v2",
+			AcquiredAt: acquiredAt,
+			ExpiresAt:  acquiredAt.Add(ttl),
+		}
+	}
+
+	backends := []struct {
+		name      string
+		newLocker func() Locker
+	}{
+		{name: "ecs", newLocker: func() Locker { return NewECSLocker(newFakeECSClient()) }},
+		{name: "dynamodb", newLocker: func() Locker { return NewDynamoDBLocker(newFakeDynamoDBClient(), "locks") }},
+	}
+
+	testCases := []struct {
+		name string
+		run  func(t *testing.T, locker Locker)
+	}{
+		{
+			name: "contention",
+			run: func(t *testing.T, locker Locker) {
+				ctx := context.Background()
+				if err := locker.Acquire(ctx, lease("alice", start)); err != nil {
+					t.Fatalf("unable to acquire lock: %v", err)
+				}
+
+				var lockedErr *ErrLocked
+				err := locker.Acquire(ctx, lease("bob", start.Add(time.Minute)))
+				if !errors.As(err, &lockedErr) || lockedErr.Owner != "alice" {
+					t.Errorf("got error %v, want lock held by alice", err)
+				}
+			},
+		},
+		{
+			name: "expiry",
+			run: func(t *testing.T, locker Locker) {
+				ctx := context.Background()
+				alice := lease("alice", start)
+				if err := locker.Acquire(ctx, alice); err != nil {
+					t.Fatalf("unable to acquire lock: %v", err)
+				}
+
+				// Once the lease has run out by the clock, someone else can
+				// take the lock and the previous owner has lost it.
+				if err := locker.Acquire(ctx, lease("bob", alice.ExpiresAt)); err != nil {
+					t.Fatalf("unable to acquire expired lock: %v", err)
+				}
+
+				var lostErr *ErrLockLost
+				alice.ExpiresAt = alice.ExpiresAt.Add(ttl)
+				if err := locker.Renew(ctx, alice); !errors.As(err, &lostErr) {
+					t.Errorf("got error %v renewing, want lock lost", err)
+				}
+
+				current, err := locker.Status(ctx, "test", DefaultLockKey)
+				if err != nil || current == nil || current.Owner != "bob" {
+					t.Errorf("got lock %+v, %v, want held by bob", current, err)
+				}
+			},
+		},
+		{
+			name: "same owner",
+			run: func(t *testing.T, locker Locker) {
+				ctx := context.Background()
+				if err := locker.Acquire(ctx, lease("alice", start)); err != nil {
+					t.Fatalf("unable to acquire lock: %v", err)
+				}
+				if err := locker.Acquire(ctx, lease("alice", start.Add(time.Minute))); err != nil {
+					t.Errorf("unable to acquire lock again: %v", err)
+				}
+
+				renewed := lease("alice", start.Add(time.Minute))
+				renewed.ExpiresAt = renewed.ExpiresAt.Add(ttl)
+				if err := locker.Renew(ctx, renewed); err != nil {
+					t.Errorf("unable to renew lock: %v", err)
+				}
+			},
+		},
+		{
+			name: "release by non-owner",
+			run: func(t *testing.T, locker Locker) {
+				ctx := context.Background()
+				alice := lease("alice", start)
+				if err := locker.Acquire(ctx, alice); err != nil {
+					t.Fatalf("unable to acquire lock: %v", err)
+				}
+
+				var lostErr *ErrLockLost
+				if err := locker.Release(ctx, lease("bob", start)); !errors.As(err, &lostErr) {
+					t.Errorf("got error %v releasing as bob, want lock lost", err)
+				}
+				current, err := locker.Status(ctx, "test", DefaultLockKey)
+				if err != nil || current == nil || current.Owner != "alice" {
+					t.Errorf("got lock %+v, %v, want still held by alice", current, err)
+				}
+
+				if err := locker.Release(ctx, alice); err != nil {
+					t.Errorf("unable to release lock: %v", err)
+				}
+				current, err = locker.Status(ctx, "test", DefaultLockKey)
+				if err != nil || current != nil {
+					t.Errorf("got lock %+v, %v, want released", current, err)
+				}
+			},
+		},
+	}
+
+	for _, backend := range backends {
+		for _, testCase := range testCases {
+			t.Run(backend.name+"/"+testCase.name, func(t *testing.T) {
+				testCase.run(t, backend.newLocker())
+			})
+		}
+	}
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// LogObserver logs the progress of a deployment as it happens, it's what's
+// used on the command line.
+type LogObserver struct {
+	logger *log.Entry
+}
+
+func NewLogObserver(logger *log.Entry) *LogObserver {
+	return &LogObserver{logger: logger}
+}
+
+func (observer *LogObserver) Observe(event DeploymentEvent) {
+	clusterSublogger := observer.clusterLogger(event.Meta())
+
+	switch event := event.(type) {
+	case *StageStarted:
+		clusterSublogger.Infof("starting rollout %s", event.Stage.rolloutDescription())
+	case *StageCompleted:
+		report := "tasks"
+		if event.Stage == EventStageServices {
+			report = "services"
+		}
+		clusterSublogger.Infof("%s report - total: %d, successful: %d, skipped: %d, failed: %d", report, event.Total, event.Successful, event.Skipped, event.Failed)
+		for _, downtime := range event.Downtimes {
+			downtimeSublogger := clusterSublogger.WithField("service", downtime.Service)
+			if !downtime.Recovered {
+				downtimeSublogger.Errorf("downtime - from: %s, to: %s, duration: %s, service still down", downtime.Start.Format(time.RFC3339), downtime.End.Format(time.RFC3339), downtime.Duration().Round(time.Second))
+
+				continue
+			}
+			downtimeSublogger.Infof("downtime - from: %s, to: %s, duration: %s", downtime.Start.Format(time.RFC3339), downtime.End.Format(time.RFC3339), downtime.Duration().Round(time.Second))
+		}
+
+		if event.Status == SucceededStatus {
+			clusterSublogger.Infof("completed rollout %s", event.Stage.rolloutDescription())
+		}
+	case *TaskDefinitionRegistered:
+		logger := clusterSublogger.WithField("service", event.Service)
+		if event.Task != "" {
+			logger = clusterSublogger.WithField("task", event.Task)
+		}
+		logger.Infof("successfully registered new task definition %s:%d", event.Family, event.Revision)
+	case *TaskStarted:
+		taskSublogger := clusterSublogger.WithFields(log.Fields{"task": event.Task, "task-id": event.TaskID})
+		taskSublogger.Debugf("started task [%d] ... task definition: %s", event.TaskNo, event.TaskDefinitionArn)
+	case *TaskStateChanged:
+		taskSublogger := clusterSublogger.WithFields(log.Fields{"task": event.Task, "task-id": event.TaskID})
+		taskSublogger.Infof("watching task [%d] ... last status: %s, desired status: %s, health: %s", event.TaskNo, strings.ToLower(event.LastStatus), strings.ToLower(event.DesiredStatus), strings.ToLower(event.HealthStatus))
+	case *TaskStopped:
+		taskSublogger := clusterSublogger.WithFields(log.Fields{"task": event.Task, "task-id": event.TaskID})
+		if event.Status == FailedStatus {
+			taskSublogger.Errorf("prematurely stopped task [%d], reason: %s", event.TaskNo, strings.ToLower(event.StoppedReason))
+		} else {
+			taskSublogger.Infof("successfully stopped task [%d], reason: %s", event.TaskNo, strings.ToLower(event.StoppedReason))
+		}
+	case *ServiceUpdated:
+		clusterSublogger.WithField("service", event.Service).Info("updated service successfully")
+	case *DeploymentProgress:
+		deploymentSublogger := clusterSublogger.WithFields(log.Fields{"service": event.Service, "deployment-id": event.ServiceDeploymentID})
+		deploymentSublogger.Infof("watching ... service: %s, deployment: %s, rollout: %d/%d (%d pending)", strings.ToLower(event.ServiceStatus), strings.ToLower(event.DeploymentStatus), event.RunningCount, event.DesiredCount, event.PendingCount)
+	case *ServiceEvent:
+		clusterSublogger.WithField("service", event.Service).Infof("service event: %s", event.Message)
+	case *ServiceTaskStopped:
+		taskSublogger := clusterSublogger.WithFields(log.Fields{"service": event.Service, "task-id": event.TaskID})
+		taskSublogger.Warnf("task stopped, reason: %s, stop code: %s", strings.ToLower(event.StoppedReason), event.StopCode)
+		for _, container := range event.Containers {
+			containerSublogger := taskSublogger.WithField("container", container.Name)
+			switch {
+			case container.ExitCode != nil && container.Reason != "":
+				containerSublogger.Warnf("container exited, exit code: %d, reason: %s", *container.ExitCode, strings.ToLower(container.Reason))
+			case container.ExitCode != nil:
+				containerSublogger.Warnf("container exited, exit code: %d", *container.ExitCode)
+			case container.Reason != "":
+				containerSublogger.Warnf("container stopped, reason: %s", strings.ToLower(container.Reason))
+			}
+		}
+	case *ServiceStable:
+		clusterSublogger.WithField("service", event.Service).Info("service is stable")
+	case *VerificationCompleted:
+		logger := clusterSublogger
+		if event.Service != "" {
+			logger = clusterSublogger.WithField("service", event.Service)
+		}
+
+		if event.Status == FailedStatus {
+			logger.Errorf("verification failed: %s", event.Message)
+		} else {
+			logger.Info("verification passed")
+		}
+	case *CanaryStarted:
+		canarySublogger := clusterSublogger.WithFields(log.Fields{"service": event.Service, "canary": event.CanaryService})
+		canarySublogger.Infof("canary is stable, baking for %s", time.Duration(event.BakeTimeSeconds)*time.Second)
+	case *CanaryPromoted:
+		canarySublogger := clusterSublogger.WithFields(log.Fields{"service": event.Service, "canary": event.CanaryService})
+		canarySublogger.Info("promoting canary to service")
+	case *CanaryAborted:
+		canarySublogger := clusterSublogger.WithFields(log.Fields{"service": event.Service, "canary": event.CanaryService})
+		canarySublogger.Errorf("aborted canary: %s", event.Reason)
+	}
+}
+
+func (observer *LogObserver) clusterLogger(meta *EventMeta) *log.Entry {
+	fields := log.Fields{"cluster": meta.Cluster}
+	if meta.Region != "" {
+		fields["region"] = meta.Region
+	}
+
+	return observer.logger.WithFields(fields)
+}
+
+func (stage EventStage) rolloutDescription() string {
+	if stage == EventStageServices {
+		return "to services"
+	}
+
+	return "of " + stage.description()
+}
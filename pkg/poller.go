@@ -0,0 +1,477 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/aws/smithy-go"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// maxPollDelay is the longest the poller backs off to when throttled.
+	maxPollDelay = time.Minute
+
+	// maxServicesPerDescribe is the most services that can be described in
+	// one call.
+	maxServicesPerDescribe = 10
+
+	// maxTasksPerDescribe is the most tasks that can be described in one
+	// call.
+	maxTasksPerDescribe = 100
+)
+
+// poller checks on services and tasks on behalf of everything watching them.
+// Rather than each watcher describing its own service or task, requests are
+// gathered up and described together in as few calls as possible once every
+// poll interval, backing off when throttled.
+type poller struct {
+	client       ECSAPI
+	clock        Clock
+	delay        time.Duration
+	interval     time.Duration
+	logger       *log.Entry
+	mutex        sync.Mutex
+	running      bool
+	services     []*pollRequest
+	serviceTasks []*pollRequest
+	tasks        []*pollRequest
+}
+
+// pollRequest is a request for the latest profile of a service, a task or the
+// tasks of a service, the response is sent on the channel once it's been
+// described. Requests are dropped once their context is done.
+type pollRequest struct {
+	ctx             context.Context
+	cluster         string
+	name            string
+	desiredStatuses []types.DesiredStatus
+	response        chan pollResponse
+}
+
+type pollResponse struct {
+	service *types.Service
+	task    *types.Task
+	tasks   []types.Task
+	err     error
+}
+
+func newPoller(client ECSAPI, clock Clock, interval time.Duration, logger *log.Entry) *poller {
+	return &poller{
+		client:   client,
+		clock:    clock,
+		delay:    interval,
+		interval: interval,
+		logger:   logger,
+	}
+}
+
+// service waits for the next poll then returns the latest profile of the
+// service, or ErrServiceNotFound if it doesn't exist.
+func (poller *poller) service(ctx context.Context, cluster string, name string) (*types.Service, error) {
+	response, err := poller.wait(ctx, poller.enqueue(ctx, &poller.services, cluster, name))
+	if err != nil {
+		return nil, err
+	}
+
+	return response.service, response.err
+}
+
+// serviceWithTasks waits for the next poll then returns the latest profile of
+// the service along with its tasks with any of the desired statuses.
+func (poller *poller) serviceWithTasks(ctx context.Context, cluster string, name string, desiredStatuses ...types.DesiredStatus) (*types.Service, []types.Task, error) {
+	// Both requests are queued before waiting so that they're usually answered
+	// by the same poll.
+	serviceRequest := poller.enqueue(ctx, &poller.services, cluster, name)
+	tasksRequest := poller.enqueue(ctx, &poller.serviceTasks, cluster, name, desiredStatuses...)
+
+	serviceResponse, err := poller.wait(ctx, serviceRequest)
+	if err != nil {
+		return nil, nil, err
+	}
+	tasksResponse, err := poller.wait(ctx, tasksRequest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if serviceResponse.err != nil {
+		return nil, nil, serviceResponse.err
+	}
+
+	return serviceResponse.service, tasksResponse.tasks, tasksResponse.err
+}
+
+// task waits for the next poll then returns the latest profile of the task,
+// which is nil if it doesn't exist.
+func (poller *poller) task(ctx context.Context, cluster string, arn string) (*types.Task, error) {
+	response, err := poller.wait(ctx, poller.enqueue(ctx, &poller.tasks, cluster, arn))
+	if err != nil {
+		return nil, err
+	}
+
+	return response.task, response.err
+}
+
+func (poller *poller) enqueue(ctx context.Context, queue *[]*pollRequest, cluster string, name string, desiredStatuses ...types.DesiredStatus) *pollRequest {
+	request := &pollRequest{
+		ctx:             ctx,
+		cluster:         cluster,
+		name:            name,
+		desiredStatuses: desiredStatuses,
+		response:        make(chan pollResponse, 1),
+	}
+
+	// The poller only runs for as long as there's something to poll.
+	poller.mutex.Lock()
+	*queue = append(*queue, request)
+	if !poller.running {
+		poller.running = true
+
+		go poller.run()
+	}
+	poller.mutex.Unlock()
+
+	return request
+}
+
+func (poller *poller) wait(ctx context.Context, request *pollRequest) (pollResponse, error) {
+	select {
+	case <-ctx.Done():
+		return pollResponse{}, ctx.Err()
+	case response := <-request.response:
+		return response, nil
+	}
+}
+
+// run polls straight away then once every poll interval, for as long as there
+// are requests waiting.
+func (poller *poller) run() {
+	for {
+		poller.mutex.Lock()
+		services, serviceTasks, tasks := poller.services, poller.serviceTasks, poller.tasks
+		poller.services, poller.serviceTasks, poller.tasks = nil, nil, nil
+		if len(services) == 0 && len(serviceTasks) == 0 && len(tasks) == 0 {
+			poller.running = false
+			poller.mutex.Unlock()
+
+			return
+		}
+		poller.mutex.Unlock()
+
+		// Requests that have been given up on are dropped, and the describe
+		// calls are cancelled once no one is waiting on them any longer.
+		services, serviceTasks, tasks = pendingRequests(services), pendingRequests(serviceTasks), pendingRequests(tasks)
+		ctx, cancel := pollContext(services, serviceTasks, tasks)
+		throttledServices := poller.describe(ctx, services, maxServicesPerDescribe, poller.describeServices)
+		throttledServiceTasks, throttledTasks := poller.describeAllTasks(ctx, serviceTasks, tasks)
+		cancel()
+
+		// Requests that were throttled are tried again on the next poll, which
+		// is pushed back further each time until the throttling stops.
+		poller.mutex.Lock()
+		poller.services = append(throttledServices, poller.services...)
+		poller.serviceTasks = append(throttledServiceTasks, poller.serviceTasks...)
+		poller.tasks = append(throttledTasks, poller.tasks...)
+		poller.mutex.Unlock()
+
+		if len(throttledServices) > 0 || len(throttledServiceTasks) > 0 || len(throttledTasks) > 0 {
+			poller.delay = poller.delay * 2
+			if poller.delay > maxPollDelay {
+				poller.delay = maxPollDelay
+			}
+			poller.logger.Warnf("throttled by ecs, polling every %s", poller.delay)
+		} else if poller.delay > poller.interval {
+			poller.delay = poller.delay / 2
+			if poller.delay < poller.interval {
+				poller.delay = poller.interval
+			}
+			poller.logger.Debugf("no longer throttled by ecs, polling every %s", poller.delay)
+		}
+
+		<-poller.clock.After(poller.delay)
+	}
+}
+
+// describe splits the requests into batches per cluster, no larger than the
+// batch size, and describes each batch. It returns the requests that were
+// throttled.
+func (poller *poller) describe(ctx context.Context, requests []*pollRequest, batchSize int, describeBatch func(ctx context.Context, cluster string, names []string) (map[string]pollResponse, error)) []*pollRequest {
+	throttled := []*pollRequest{}
+
+	// Group the requests by cluster, more than one watcher can be waiting on
+	// the same service or task.
+	clusters := []string{}
+	requestsByCluster := map[string]map[string][]*pollRequest{}
+	for _, request := range requests {
+		if _, ok := requestsByCluster[request.cluster]; !ok {
+			clusters = append(clusters, request.cluster)
+			requestsByCluster[request.cluster] = map[string][]*pollRequest{}
+		}
+		requestsByCluster[request.cluster][request.name] = append(requestsByCluster[request.cluster][request.name], request)
+	}
+
+	for _, cluster := range clusters {
+		names := []string{}
+		for name := range requestsByCluster[cluster] {
+			names = append(names, name)
+		}
+
+		for start := 0; start < len(names); start += batchSize {
+			end := start + batchSize
+			if end > len(names) {
+				end = len(names)
+			}
+			batch := names[start:end]
+
+			responses, err := describeBatch(ctx, cluster, batch)
+			for _, name := range batch {
+				for _, request := range requestsByCluster[cluster][name] {
+					switch {
+					case isThrottlingError(err):
+						throttled = append(throttled, request)
+					case err != nil:
+						request.response <- pollResponse{err: err}
+					default:
+						request.response <- responses[name]
+					}
+				}
+			}
+		}
+	}
+
+	return throttled
+}
+
+// describeAllTasks lists the tasks of the services then describes them along
+// with the tasks being watched, so that they share the same describe calls.
+// It returns the service task requests and task requests that were
+// throttled.
+func (poller *poller) describeAllTasks(ctx context.Context, serviceTasks []*pollRequest, tasks []*pollRequest) ([]*pollRequest, []*pollRequest) {
+	throttledServiceTasks := []*pollRequest{}
+
+	// Each task of a service is described as if it was being watched on its
+	// own, the responses are then gathered back up for the service.
+	requests := append([]*pollRequest{}, tasks...)
+	taskRequestsByService := map[*pollRequest][]*pollRequest{}
+	for _, request := range serviceTasks {
+		taskArns, err := poller.listServiceTasks(ctx, request)
+		switch {
+		case isThrottlingError(err):
+			throttledServiceTasks = append(throttledServiceTasks, request)
+
+			continue
+		case err != nil:
+			request.response <- pollResponse{err: err}
+
+			continue
+		}
+
+		taskRequests := []*pollRequest{}
+		for _, taskArn := range taskArns {
+			taskRequests = append(taskRequests, &pollRequest{
+				ctx:      request.ctx,
+				cluster:  request.cluster,
+				name:     taskArn,
+				response: make(chan pollResponse, 1),
+			})
+		}
+		taskRequestsByService[request] = taskRequests
+		requests = append(requests, taskRequests...)
+	}
+
+	throttled := map[*pollRequest]bool{}
+	for _, request := range poller.describe(ctx, requests, maxTasksPerDescribe, poller.describeTasks) {
+		throttled[request] = true
+	}
+
+	throttledTasks := []*pollRequest{}
+	for _, request := range tasks {
+		if throttled[request] {
+			throttledTasks = append(throttledTasks, request)
+		}
+	}
+
+	for _, request := range serviceTasks {
+		taskRequests, ok := taskRequestsByService[request]
+		if !ok {
+			continue
+		}
+
+		response := pollResponse{tasks: []types.Task{}}
+		retry := false
+		for _, taskRequest := range taskRequests {
+			// The tasks are listed again on the next poll if any of them were
+			// throttled.
+			if throttled[taskRequest] {
+				retry = true
+
+				break
+			}
+
+			taskResponse := <-taskRequest.response
+			if taskResponse.err != nil {
+				response.err = taskResponse.err
+
+				break
+			}
+			if taskResponse.task != nil {
+				response.tasks = append(response.tasks, *taskResponse.task)
+			}
+		}
+
+		if retry {
+			throttledServiceTasks = append(throttledServiceTasks, request)
+
+			continue
+		}
+		request.response <- response
+	}
+
+	return throttledServiceTasks, throttledTasks
+}
+
+// listServiceTasks lists the ARNs of the service's tasks with any of the
+// desired statuses.
+func (poller *poller) listServiceTasks(ctx context.Context, request *pollRequest) ([]string, error) {
+	poller.logger.Tracef("listing tasks of service %s in cluster %s", request.name, request.cluster)
+
+	found := map[string]bool{}
+	taskArns := []string{}
+	for _, desiredStatus := range request.desiredStatuses {
+		paginator := ecs.NewListTasksPaginator(poller.client, &ecs.ListTasksInput{
+			Cluster:       &request.cluster,
+			DesiredStatus: desiredStatus,
+			ServiceName:   &request.name,
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return nil, err
+			}
+
+			// A task can be listed under more than one status if it stopped
+			// while being listed.
+			for _, taskArn := range page.TaskArns {
+				if !found[taskArn] {
+					found[taskArn] = true
+					taskArns = append(taskArns, taskArn)
+				}
+			}
+		}
+	}
+
+	return taskArns, nil
+}
+
+func (poller *poller) describeServices(ctx context.Context, cluster string, names []string) (map[string]pollResponse, error) {
+	poller.logger.Tracef("describing %d services in cluster %s", len(names), cluster)
+	serviceResult, err := poller.client.DescribeServices(ctx, &ecs.DescribeServicesInput{
+		Cluster:  &cluster,
+		Services: names,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	responses := map[string]pollResponse{}
+	for index := range serviceResult.Services {
+		service := &serviceResult.Services[index]
+
+		// A service that has been deleted is treated the same as one that
+		// never existed.
+		if *service.Status == "INACTIVE" {
+			continue
+		}
+		responses[*service.ServiceName] = pollResponse{service: service}
+	}
+
+	for _, name := range names {
+		if _, ok := responses[name]; !ok {
+			responses[name] = pollResponse{err: &ErrServiceNotFound{Cluster: cluster, Service: name}}
+		}
+	}
+
+	return responses, nil
+}
+
+func (poller *poller) describeTasks(ctx context.Context, cluster string, arns []string) (map[string]pollResponse, error) {
+	poller.logger.Tracef("describing %d tasks in cluster %s", len(arns), cluster)
+	taskResult, err := poller.client.DescribeTasks(ctx, &ecs.DescribeTasksInput{
+		Cluster: &cluster,
+		Tasks:   arns,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	responses := map[string]pollResponse{}
+	for index := range taskResult.Tasks {
+		task := &taskResult.Tasks[index]
+		responses[*task.TaskArn] = pollResponse{task: task}
+	}
+
+	return responses, nil
+}
+
+// pendingRequests leaves out the requests that have been given up on.
+func pendingRequests(requests []*pollRequest) []*pollRequest {
+	pending := []*pollRequest{}
+	for _, request := range requests {
+		if request.ctx.Err() == nil {
+			pending = append(pending, request)
+		}
+	}
+
+	return pending
+}
+
+// pollContext is cancelled once every one of the requests has been given up
+// on, there's no point in describing what no one is waiting for.
+func pollContext(requests ...[]*pollRequest) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		for _, queue := range requests {
+			for _, request := range queue {
+				select {
+				case <-ctx.Done():
+					return
+				case <-request.ctx.Done():
+				}
+			}
+		}
+		cancel()
+	}()
+
+	return ctx, cancel
+}
+
+func isThrottlingError(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode() == "ThrottlingException"
+	}
+
+	return false
+}
@@ -0,0 +1,446 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultPruneKeep is how many of the most recent active revisions of a
+	// task definition family are kept unless set otherwise.
+	DefaultPruneKeep = 20
+
+	// DefaultPruneMinAge is how old a revision of a task definition has to be
+	// before it's pruned unless set otherwise.
+	DefaultPruneMinAge = 24 * time.Hour
+
+	// maxTaskDefinitionsPerDelete is the most task definitions that can be
+	// deleted in one call.
+	maxTaskDefinitionsPerDelete = 10
+)
+
+type PruneInput struct {
+	// The target to prune. Defaults to the only target in the config, it must
+	// be set if the config has several targets.
+	Target *Target
+
+	// The number of most recent active revisions to keep in each family.
+	// Defaults to DefaultPruneKeep.
+	Keep int
+
+	// How long ago a revision must have been registered to be pruned.
+	MinAge time.Duration
+
+	// Whether to delete the revisions once they're deregistered, along with
+	// any older ones that were already inactive. Deleted revisions can't be
+	// used or described anymore.
+	Delete bool
+
+	// Whether to only work out what would be pruned, without changing
+	// anything.
+	DryRun bool
+
+	// The task definitions used by the other targets in the config, keyed by
+	// ARN. The targets the deployer's clients can reach are checked anyway,
+	// this must be set to prune a target when there are others with different
+	// AWS settings in the same region since they may share task definitions.
+	InUse map[string]bool
+}
+
+type PruneResult struct {
+	Families []PrunedFamily
+}
+
+// PrunedFamily lists the revisions of a task definition family that were
+// pruned, or would be in a dry run.
+type PrunedFamily struct {
+	Family string
+
+	// The ARNs of the revisions that were deregistered.
+	Deregistered []string
+
+	// The ARNs of the revisions that were deleted.
+	Deleted []string
+
+	// The ARNs of the revisions that would've been pruned but were left alone
+	// since a service or running task uses them.
+	InUse []string
+}
+
+// PruneInput sets up pruning of the target from the prune options in the
+// config, falling back to the defaults if they're not set.
+func (config *Config) PruneInput(target *Target) *PruneInput {
+	input := &PruneInput{Target: target, Keep: DefaultPruneKeep, MinAge: DefaultPruneMinAge}
+	if config.Prune == nil {
+		return input
+	}
+
+	if config.Prune.Keep != nil {
+		input.Keep = *config.Prune.Keep
+	}
+	if config.Prune.MinAge != nil {
+		input.MinAge = time.Duration(*config.Prune.MinAge) * time.Second
+	}
+	if config.Prune.Delete != nil {
+		input.Delete = *config.Prune.Delete
+	}
+
+	return input
+}
+
+func (prune *Prune) afterDeploy() bool {
+	return prune != nil && prune.AfterDeploy != nil && *prune.AfterDeploy
+}
+
+// validateAfterDeploy checks that pruning after a deployment can check every
+// target that could share its task definitions for revisions in use, which it
+// can only do for those reached with the same AWS settings or in another region.
+func (prune *Prune) validateAfterDeploy(targets []Target) error {
+	if !prune.afterDeploy() {
+		return nil
+	}
+
+	for index := range targets {
+		target := &targets[index]
+		for otherIndex := index + 1; otherIndex < len(targets); otherIndex++ {
+			otherTarget := &targets[otherIndex]
+			if !target.sameAWSSettings(otherTarget) && !target.otherRegion(otherTarget) {
+				return fmt.Errorf("prune after deploy can't be used with targets %s and %s, they have different aws settings", target.Cluster, otherTarget.Cluster)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Prune deregisters old revisions of the task definition families of the
+// services and tasks of the target, keeping the most recent ones as well as
+// any used by a service or running task in any of the targets in the config.
+func (deployer *Deployer) Prune(ctx context.Context, input *PruneInput) (*PruneResult, error) {
+	target, err := deployer.target(input.Target)
+	if err != nil {
+		return nil, err
+	}
+	clusterSublogger := target.loggerFrom(deployer.logger)
+
+	keep := input.Keep
+	if keep <= 0 {
+		keep = DefaultPruneKeep
+	}
+
+	families := []string{}
+	for index := range deployer.config.Services {
+		serviceConfig := &deployer.config.Services[index]
+		service, err := deployer.describeService(ctx, &target.Cluster, serviceConfig.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		family, _, err := parseTaskDefinitionArn(*service.TaskDefinition)
+		if err != nil {
+			return nil, err
+		}
+		if !containsString(families, family) {
+			families = append(families, family)
+		}
+	}
+
+	for _, taskConfig := range append(append([]Task{}, deployer.config.Tasks.Pre...), deployer.config.Tasks.Post...) {
+		family := taskDefinitionFamily(taskConfig.Family)
+		if !containsString(families, family) {
+			families = append(families, family)
+		}
+	}
+
+	clusterSublogger.Debug("fetching task definitions in use")
+	inUse := map[string]bool{}
+	for arn := range input.InUse {
+		inUse[arn] = true
+	}
+
+	// The same families are used by every target in the config, any that the
+	// deployer's clients can reach are checked while the rest must be passed
+	// in unless they're in another region.
+	checked := map[string]bool{}
+	targets := append([]Target{*target}, deployer.config.DeploymentTargets()...)
+	for index := range targets {
+		otherTarget := &targets[index]
+		switch {
+		case target.sameAWSSettings(otherTarget):
+			if checked[otherTarget.Cluster] {
+				continue
+			}
+			checked[otherTarget.Cluster] = true
+		case target.otherRegion(otherTarget):
+			continue
+		case input.InUse == nil:
+			return nil, fmt.Errorf("unable to check task definitions in use by target %s, it has different aws settings", otherTarget.Cluster)
+		default:
+			continue
+		}
+
+		targetInUse, err := deployer.TaskDefinitionsInUse(ctx, otherTarget)
+		if err != nil {
+			return nil, err
+		}
+		for arn := range targetInUse {
+			inUse[arn] = true
+		}
+	}
+
+	result := &PruneResult{}
+	for _, family := range families {
+		prunedFamily, err := deployer.pruneFamily(ctx, family, keep, inUse, input, clusterSublogger.WithField("family", family))
+		if err != nil {
+			return result, err
+		}
+		result.Families = append(result.Families, *prunedFamily)
+	}
+
+	return result, nil
+}
+
+// pruneFamily deregisters, and optionally deletes, the revisions of the
+// family past the ones to keep that are old enough and not in use.
+func (deployer *Deployer) pruneFamily(ctx context.Context, family string, keep int, inUse map[string]bool, input *PruneInput, logger *log.Entry) (*PrunedFamily, error) {
+	prunedFamily := &PrunedFamily{Family: family, Deregistered: []string{}, Deleted: []string{}, InUse: []string{}}
+
+	statuses := []types.TaskDefinitionStatus{types.TaskDefinitionStatusActive}
+	if input.Delete {
+		statuses = append(statuses, types.TaskDefinitionStatusInactive)
+	}
+
+	arns := []string{}
+	active := map[string]bool{}
+	for _, status := range statuses {
+		statusArns, err := deployer.listTaskDefinitions(ctx, family, status, 0)
+		if err != nil {
+			logger.Errorf("unable to list task definitions: %v", err)
+
+			return nil, err
+		}
+
+		for _, arn := range statusArns {
+			active[arn] = status == types.TaskDefinitionStatusActive
+		}
+		arns = append(arns, statusArns...)
+	}
+	sortTaskDefinitionArns(arns)
+
+	// Only revisions older than the ones kept are candidates, whether they're
+	// active or already inactive.
+	kept := 0
+	candidates := []string{}
+	for _, arn := range arns {
+		if kept < keep {
+			if active[arn] {
+				kept = kept + 1
+			}
+
+			continue
+		}
+		candidates = append(candidates, arn)
+	}
+
+	// Revisions are registered in order so once one is old enough, all the
+	// ones before it are too. This saves describing thousands of them.
+	cutoff := deployer.clock.Now().Add(-input.MinAge)
+	for len(candidates) > 0 && input.MinAge > 0 {
+		taskDefinitionResult, err := deployer.client.DescribeTaskDefinition(ctx, &ecs.DescribeTaskDefinitionInput{
+			TaskDefinition: &candidates[0],
+		})
+		if err != nil {
+			logger.Errorf("unable to fetch task definition profile: %v", err)
+
+			return nil, err
+		}
+
+		registeredAt := taskDefinitionResult.TaskDefinition.RegisteredAt
+		if registeredAt != nil && registeredAt.Before(cutoff) {
+			break
+		}
+		candidates = candidates[1:]
+	}
+
+	toDelete := []string{}
+	for _, arn := range candidates {
+		arn := arn
+		if inUse[arn] {
+			logger.Debugf("skipping task definition %s, in use", arn)
+			prunedFamily.InUse = append(prunedFamily.InUse, arn)
+
+			continue
+		}
+
+		if active[arn] {
+			if input.DryRun {
+				logger.Infof("would deregister task definition %s", arn)
+			} else {
+				logger.Debugf("deregistering task definition %s", arn)
+				_, err := deployer.client.DeregisterTaskDefinition(ctx, &ecs.DeregisterTaskDefinitionInput{
+					TaskDefinition: &arn,
+				})
+				if err != nil {
+					logger.Errorf("unable to deregister task definition %s: %v", arn, err)
+
+					return prunedFamily, err
+				}
+			}
+			prunedFamily.Deregistered = append(prunedFamily.Deregistered, arn)
+		}
+
+		if input.Delete {
+			toDelete = append(toDelete, arn)
+		}
+	}
+
+	for start := 0; start < len(toDelete); start += maxTaskDefinitionsPerDelete {
+		end := start + maxTaskDefinitionsPerDelete
+		if end > len(toDelete) {
+			end = len(toDelete)
+		}
+
+		if input.DryRun {
+			for _, arn := range toDelete[start:end] {
+				logger.Infof("would delete task definition %s", arn)
+			}
+			prunedFamily.Deleted = append(prunedFamily.Deleted, toDelete[start:end]...)
+
+			continue
+		}
+
+		deleteResult, err := deployer.client.DeleteTaskDefinitions(ctx, &ecs.DeleteTaskDefinitionsInput{
+			TaskDefinitions: toDelete[start:end],
+		})
+		if err != nil {
+			logger.Errorf("unable to delete task definitions: %v", err)
+
+			return prunedFamily, err
+		}
+
+		for _, failure := range deleteResult.Failures {
+			logger.Errorf("unable to delete task definition %s: %s", aws.ToString(failure.Arn), aws.ToString(failure.Reason))
+		}
+		if len(deleteResult.Failures) > 0 {
+			return prunedFamily, fmt.Errorf("unable to delete %d task definitions", len(deleteResult.Failures))
+		}
+
+		for _, taskDefinition := range deleteResult.TaskDefinitions {
+			prunedFamily.Deleted = append(prunedFamily.Deleted, *taskDefinition.TaskDefinitionArn)
+		}
+	}
+
+	if input.DryRun {
+		logger.Infof("would prune task definitions, deregister: %d, delete: %d, in use: %d", len(prunedFamily.Deregistered), len(prunedFamily.Deleted), len(prunedFamily.InUse))
+	} else {
+		logger.Infof("pruned task definitions, deregistered: %d, deleted: %d, in use: %d", len(prunedFamily.Deregistered), len(prunedFamily.Deleted), len(prunedFamily.InUse))
+	}
+
+	return prunedFamily, nil
+}
+
+// TaskDefinitionsInUse collects the task definitions used by the deployments
+// of every service in the target's cluster and by every task that's running or
+// about to, keyed by ARN.
+func (deployer *Deployer) TaskDefinitionsInUse(ctx context.Context, target *Target) (map[string]bool, error) {
+	inUse := map[string]bool{}
+	cluster := target.Cluster
+
+	serviceArns := []string{}
+	servicePaginator := ecs.NewListServicesPaginator(deployer.client, &ecs.ListServicesInput{
+		Cluster: &cluster,
+	})
+	for servicePaginator.HasMorePages() {
+		page, err := servicePaginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		serviceArns = append(serviceArns, page.ServiceArns...)
+	}
+
+	for start := 0; start < len(serviceArns); start += maxServicesPerDescribe {
+		end := start + maxServicesPerDescribe
+		if end > len(serviceArns) {
+			end = len(serviceArns)
+		}
+
+		serviceResult, err := deployer.client.DescribeServices(ctx, &ecs.DescribeServicesInput{
+			Cluster:  &cluster,
+			Services: serviceArns[start:end],
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, service := range serviceResult.Services {
+			if service.TaskDefinition != nil {
+				inUse[*service.TaskDefinition] = true
+			}
+			for _, deployment := range service.Deployments {
+				if deployment.TaskDefinition != nil {
+					inUse[*deployment.TaskDefinition] = true
+				}
+			}
+		}
+	}
+
+	taskArns := []string{}
+	taskPaginator := ecs.NewListTasksPaginator(deployer.client, &ecs.ListTasksInput{
+		Cluster:       &cluster,
+		DesiredStatus: types.DesiredStatusRunning,
+	})
+	for taskPaginator.HasMorePages() {
+		page, err := taskPaginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		taskArns = append(taskArns, page.TaskArns...)
+	}
+
+	tasks, err := deployer.describeTasks(ctx, cluster, taskArns)
+	if err != nil {
+		return nil, err
+	}
+	for _, task := range tasks {
+		if task.TaskDefinitionArn != nil {
+			inUse[*task.TaskDefinitionArn] = true
+		}
+	}
+
+	return inUse, nil
+}
+
+// pruneAfterDeploy prunes the target once the deployment is done, it has
+// already succeeded by then so failing to do so is only logged.
+func (deployer *Deployer) pruneAfterDeploy(ctx context.Context, deployment *Deployment) {
+	logger := deployment.logger()
+
+	logger.Info("pruning old task definitions")
+	_, err := deployer.Prune(ctx, deployer.config.PruneInput(deployment.Target))
+	if err != nil {
+		logger.Warnf("unable to prune old task definitions: %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// deployRecreate stops all the tasks of the service before updating it so
+// that two versions of the service never run at the same time. The service is
+// down from when it's scaled down until it's stable again, which is recorded
+// as its downtime.
+func (deployer *Deployer) deployRecreate(ctx context.Context, deployment *Deployment, serviceConfig *Service, service *types.Service, taskDefinition *string, serviceSublogger *log.Entry) (status Status, err error) {
+	downtimeStart := deployer.clock.Now()
+	watch := newServiceWatch(*service.ServiceName, downtimeStart, serviceConfig.maxWaitTime())
+
+	serviceSublogger.Infof("scaling down service from %d task(s) to recreate it", service.DesiredCount)
+	desiredCount := int32(0)
+	_, err = deployer.client.UpdateService(ctx, &ecs.UpdateServiceInput{
+		Service:      service.ServiceName,
+		Cluster:      service.ClusterArn,
+		DesiredCount: &desiredCount,
+	})
+	if err != nil {
+		serviceSublogger.Errorf("unable to scale down service: %v", err)
+
+		return FailedStatus, err
+	}
+
+	// The service is down from here on, the downtime is recorded whatever the
+	// outcome since it matters most when the service doesn't come back up.
+	defer func() {
+		downtime := Downtime{
+			Service:   serviceConfig.Name,
+			Start:     downtimeStart.UTC(),
+			End:       deployer.clock.Now().UTC(),
+			Recovered: err == nil,
+		}
+		deployment.recordDowntime(downtime)
+
+		if downtime.Recovered {
+			serviceSublogger.Infof("service recreated, down for %s", downtime.Duration().Round(time.Second))
+		} else {
+			serviceSublogger.Errorf("service not recreated, down for %s and counting", downtime.Duration().Round(time.Second))
+		}
+	}()
+
+	serviceSublogger.Info("waiting for all tasks to stop")
+	err = deployer.waitForServiceScaledDown(ctx, deployment, watch, serviceSublogger)
+	if err != nil {
+		serviceSublogger.Errorf("unable to wait for all tasks to stop, service left scaled down: %v", err)
+
+		return FailedStatus, err
+	}
+
+	// Updating the service restores the desired count it had before it was
+	// scaled down.
+	return deployer.updateService(ctx, deployment, serviceConfig, service, taskDefinition, serviceSublogger)
+}
+
+// waitForServiceScaledDown waits for the service to have no running or
+// pending tasks.
+func (deployer *Deployer) waitForServiceScaledDown(ctx context.Context, deployment *Deployment, watch *serviceWatch, serviceSublogger *log.Entry) error {
+	for {
+		service, err := deployer.pollService(ctx, deployment, watch)
+		if err != nil {
+			return err
+		}
+
+		if service.RunningCount == 0 && service.PendingCount == 0 {
+			return nil
+		}
+		serviceSublogger.Debugf("service not scaled down yet, running: %d, pending: %d", service.RunningCount, service.PendingCount)
+
+		if deployer.clock.Now().After(watch.deadline) {
+			return &ErrStabilityTimeout{Service: watch.name, MaxWait: watch.maxWaitTime}
+		}
+	}
+}
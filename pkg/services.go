@@ -20,8 +20,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"regexp"
+	"sort"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
@@ -30,87 +31,73 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func (config *Config) DeployServices(newContainerImageTag *string, client *ecs.Client) error {
-	clusterSublogger := log.WithFields(log.Fields{"cluster": config.Cluster})
+// deployServiceFunc deploys a single service, returning its status.
+type deployServiceFunc func(ctx context.Context, serviceConfig *Service, logger *log.Entry) (Status, error)
+
+// deployServices deploys the services in parallel using the given function
+// and reports on the outcome.
+func (deployer *Deployer) deployServices(ctx context.Context, deployment *Deployment, serviceConfigs []*Service, deployService deployServiceFunc) error {
+	clusterSublogger := deployment.logger()
 
 	// Get list of services to update from the config file but do not proceed if
 	// there are no services to update.
-	numberOfServices := len(config.Services)
+	numberOfServices := len(serviceConfigs)
 	if numberOfServices == 0 {
 		clusterSublogger.Warn("skipping rollout to services, none found")
 
 		return nil
 	}
-	clusterSublogger.Info("starting rollout to services")
+	deployment.publish(&StageStarted{EventMeta: EventMeta{Type: EventStageStarted, Status: RunningStatus}, Stage: EventStageServices})
 
 	// Process each service on in parallel to reduce the amount of time spent
 	// rolling them out and evaluate the status to provide a summary report
-	// after.
-	var (
-		failedCount  = 0
-		skippedCount = 0
-		wg           = sync.WaitGroup{}
-	)
-	for index := range config.Services {
-		wg.Add(1)
-
-		go func(serviceConfig *Service) {
-			defer wg.Done()
-
-			status, err := deployService(&config.Cluster, serviceConfig, newContainerImageTag, client, clusterSublogger)
-			if err != nil {
-				switch status {
-				case FailedStatus:
-					failedCount = failedCount + 1
-				case SkippedStatus:
-					skippedCount = skippedCount + 1
-				}
-			}
-		}(&config.Services[index])
-	}
-	wg.Wait()
-
-	successfulCount := numberOfServices - (failedCount + skippedCount)
-	clusterSublogger.Infof("services report - total: %d, successful: %d, skipped: %d, failed: %d", numberOfServices, successfulCount, skippedCount, failedCount)
+	// after. Each service has its own slot for its result so that they can be
+	// collected without any locking.
+	results := make([]itemResult, numberOfServices)
+	deployer.forEach(numberOfServices, func(index int) {
+		serviceConfig := serviceConfigs[index]
+
+		status, err := deployService(ctx, serviceConfig, clusterSublogger)
+		deployment.recordService(serviceConfig.Name, status)
+		results[index] = itemResult{name: serviceConfig.Name, status: status, err: err}
+	})
 
-	if failedCount > 0 {
+	stageCompleted := newStageCompleted(EventStageServices, results)
+	stageCompleted.Downtimes = deployment.Downtimes()
+	if stageCompleted.Failed > 0 {
 		err := fmt.Errorf("unable to deploy all services")
+		stageCompleted.Status = FailedStatus
+		stageCompleted.Message = err.Error()
+		deployment.publish(stageCompleted)
 
 		return err
 	}
 
-	clusterSublogger.Info("completed rollout to services")
+	deployment.publish(stageCompleted)
 
 	return nil
 }
 
-func deployService(cluster *string, serviceConfig *Service, newContainerImageTag *string, client *ecs.Client, logger *log.Entry) (Status, error) {
+func (deployer *Deployer) deployService(ctx context.Context, deployment *Deployment, serviceConfig *Service, logger *log.Entry) (Status, error) {
 	// Set up new logger with the service name.
 	serviceSublogger := logger.WithField("service", serviceConfig.Name)
 
 	// Fetch full profile of the service so that later we can reference its
-	// attributes i.e. task definitions.
-	serviceSublogger.Debug("fetching service profile")
-	serviceParams := &ecs.DescribeServicesInput{
-		Cluster:  cluster,
-		Services: []string{serviceConfig.Name},
-	}
-	serviceResult, err := client.DescribeServices(context.TODO(), serviceParams)
+	// attributes i.e. task definitions. If the service is not found then stop
+	// deploying to the service.
+	service, err := deployer.describeService(ctx, &deployment.Target.Cluster, serviceConfig.Name)
 	if err != nil {
+		var notFoundErr *ErrServiceNotFound
+		if errors.As(err, &notFoundErr) {
+			serviceSublogger.Errorf("skipping deploy: %v", err)
+
+			return SkippedStatus, err
+		}
 		serviceSublogger.Errorf("unable to fetch service profile: %v", err)
 
 		return FailedStatus, err
 	}
-
-	// If the service is not found then stop deploying to the service. We should
-	// also only ever receive one service.
-	if len(serviceResult.Services) == 0 {
-		err = errors.New("skipping deploy, service not found")
-		serviceSublogger.Error(err)
-
-		return SkippedStatus, err
-	}
-	service := serviceResult.Services[0]
+	deployment.recordPreviousTaskDefinition(serviceConfig.Name, *service.TaskDefinition)
 
 	// Store information on which containers should be updated.
 	taskContainerUpdateable := make(map[string]bool)
@@ -120,17 +107,66 @@ func deployService(cluster *string, serviceConfig *Service, newContainerImageTag
 
 	// Generate new task definition with the required changes.
 	taskDefinitionInput := GenerateTaskDefinitionInput{
-		ImageTag:             newContainerImageTag,
+		ImageTag:             &deployment.ImageTag,
 		TaskDefinition:       service.TaskDefinition,
 		UpdateableContainers: taskContainerUpdateable,
+		Tags:                 deployment.tags,
+		TaskDefinitionFile:   serviceConfig.TaskDefinitionFile,
+		TemplateData:         NewTaskDefinitionTemplateData(deployment.Target.Cluster, deployment.ImageTag),
 	}
-	newTaskDefinition, taskDefinitionUpdated, err := GenerateTaskDefinition(&taskDefinitionInput, client, serviceSublogger)
+	newTaskDefinition, taskDefinitionUpdated, err := GenerateTaskDefinition(ctx, &taskDefinitionInput, deployer.client, serviceSublogger)
 	if err != nil {
 		serviceSublogger.Errorf("error generating task definition")
 
 		return FailedStatus, err
 	}
 
+	// Set task definition. A task definition file that hasn't changed matches
+	// the revision the service runs rather than the latest in the family.
+	taskDefinition := &serviceConfig.Name
+	if serviceConfig.TaskDefinitionFile != nil {
+		taskDefinition = service.TaskDefinition
+	}
+	if taskDefinitionUpdated {
+		deployment.recordTaskDefinition(*newTaskDefinition.TaskDefinitionArn)
+		deployment.publish(&TaskDefinitionRegistered{
+			EventMeta:         EventMeta{Type: EventTaskDefinitionRegistered},
+			Stage:             EventStageServices,
+			Service:           serviceConfig.Name,
+			Family:            *newTaskDefinition.Family,
+			Revision:          newTaskDefinition.Revision,
+			TaskDefinitionArn: *newTaskDefinition.TaskDefinitionArn,
+		})
+
+		serviceSublogger.Info("updated task definition, using new one")
+		taskDefinition = newTaskDefinition.TaskDefinitionArn
+	} else if serviceConfig.TaskDefinitionFile != nil {
+		serviceSublogger.Info("no changes to task definition file, using current one")
+	} else {
+		serviceSublogger.Info("no changes to previous task definition, using latest")
+	}
+
+	var status Status
+	switch serviceConfig.strategy() {
+	case ServiceStrategyCanary:
+		status, err = deployer.deployCanary(ctx, deployment, serviceConfig, service, taskDefinition, serviceSublogger)
+	case ServiceStrategyRecreate:
+		status, err = deployer.deployRecreate(ctx, deployment, serviceConfig, service, taskDefinition, serviceSublogger)
+	default:
+		status, err = deployer.updateService(ctx, deployment, serviceConfig, service, taskDefinition, serviceSublogger)
+	}
+	if err != nil || serviceConfig.Verify == nil {
+		return status, err
+	}
+
+	// A stable service only means its tasks are running, make sure it's
+	// actually working.
+	return deployer.verifyService(ctx, deployment, serviceConfig, service, serviceSublogger)
+}
+
+// updateService updates the service to use the task definition then waits for
+// the rollout to complete and the service to be stable.
+func (deployer *Deployer) updateService(ctx context.Context, deployment *Deployment, serviceConfig *Service, service *types.Service, taskDefinition *string, serviceSublogger *log.Entry) (Status, error) {
 	// Prepare parameters for service.
 	updateServiceParams := &ecs.UpdateServiceInput{
 		Service:                       service.ServiceName,
@@ -148,108 +184,177 @@ func deployService(cluster *string, serviceConfig *Service, newContainerImageTag
 		PlatformVersion:               service.PlatformVersion,
 		PropagateTags:                 service.PropagateTags,
 		ServiceRegistries:             service.ServiceRegistries,
+		TaskDefinition:                taskDefinition,
 	}
 
-	// Set force.
-	if serviceConfig.Force != nil {
-		serviceSublogger.Debug("setting forced deploy")
+	// Apply the overrides in the config on top of the service's current
+	// settings.
+	if serviceConfig.DeploymentConfiguration != nil {
+		serviceSublogger.Debug("setting deployment configuration")
 
-		updateServiceParams.ForceNewDeployment = *serviceConfig.Force
+		updateServiceParams.DeploymentConfiguration = serviceConfig.DeploymentConfiguration.apply(service.DeploymentConfiguration)
 	}
 
-	// Set maximum wait time.
-	maxWaitTime := 15 * time.Minute
-	if serviceConfig.MaxWait != nil {
-		serviceSublogger.Debug("setting maximum wait time")
+	if serviceConfig.DesiredCount != nil {
+		serviceSublogger.Debug("setting desired count")
 
-		maxWaitTime = time.Duration(*serviceConfig.MaxWait) * time.Minute
+		updateServiceParams.DesiredCount = serviceConfig.DesiredCount
 	}
 
-	// Set task definition.
-	if taskDefinitionUpdated {
-		serviceSublogger.Info("updated task definition, using new one")
-		updateServiceParams.TaskDefinition = newTaskDefinition.TaskDefinitionArn
-	} else {
-		serviceSublogger.Info("no changes to previous task definition, using latest")
-		updateServiceParams.TaskDefinition = &serviceConfig.Name
+	if serviceConfig.HealthCheckGracePeriod != nil {
+		serviceSublogger.Debug("setting health check grace period")
+
+		updateServiceParams.HealthCheckGracePeriodSeconds = serviceConfig.HealthCheckGracePeriod
 	}
 
+	// Set force.
+	if serviceConfig.Force != nil {
+		serviceSublogger.Debug("setting forced deploy")
+
+		updateServiceParams.ForceNewDeployment = *serviceConfig.Force
+	}
+
+	// Set maximum wait time, service events from before the update don't
+	// concern this rollout.
+	watch := newServiceWatch(*service.ServiceName, deployer.clock.Now(), serviceConfig.maxWaitTime())
+
 	// Update service to reflect changes.
 	serviceSublogger.Debug("attempting to update service")
-	_, err = client.UpdateService(context.TODO(), updateServiceParams)
+	updateServiceResult, err := deployer.client.UpdateService(ctx, updateServiceParams)
 	if err != nil {
 		serviceSublogger.Errorf("unable to update service: %v", err)
 
 		return FailedStatus, err
 	}
-	serviceSublogger.Info("updated service successfully")
+	serviceUpdated := &ServiceUpdated{
+		EventMeta: EventMeta{Type: EventServiceUpdated},
+		Service:   serviceConfig.Name,
+	}
+	if updateServiceResult.Service != nil && updateServiceResult.Service.TaskDefinition != nil {
+		serviceUpdated.TaskDefinitionArn = *updateServiceResult.Service.TaskDefinition
+	}
+	deployment.publish(serviceUpdated)
+	deployer.tagService(ctx, deployment, updateServiceResult.Service, serviceSublogger)
 
 	// Watch service deployment until all have a final status.
 	serviceSublogger.Info("watch service rollout progress")
-	watchService(cluster, &service, client, serviceSublogger)
+	err = deployer.watchService(ctx, deployment, watch, serviceSublogger)
+	if err != nil {
+		serviceSublogger.Errorf("unable to watch service rollout progress: %v", err)
+
+		return FailedStatus, err
+	}
 
 	// Make sure we wait for the service to be stable.
 	serviceSublogger.Info("checking if service is stable")
-	waiter := ecs.NewServicesStableWaiter(client)
-	err = waiter.Wait(context.TODO(), serviceParams, maxWaitTime, func(o *ecs.ServicesStableWaiterOptions) {
-		o.MinDelay = 5 * time.Second
-		o.MaxDelay = 120 * time.Second
-		o.LogWaitAttempts = log.IsLevelEnabled(log.DebugLevel) || log.IsLevelEnabled(log.TraceLevel)
-	})
+	err = deployer.waitForServiceStable(ctx, deployment, watch, serviceSublogger)
 	if err != nil {
 		serviceSublogger.Errorf("unable to check if service is stable: %v", err)
 
 		return FailedStatus, err
+	}
+
+	// A stable service can still have tasks that aren't receiving traffic from
+	// its load balancers yet.
+	if deployer.elbClient != nil && len(service.LoadBalancers) > 0 && serviceConfig.waitForTargets() {
+		serviceSublogger.Info("checking if load balancer targets are healthy")
+		err = deployer.waitForTargetsHealthy(ctx, deployment, watch, serviceSublogger)
+		if err != nil {
+			serviceSublogger.Errorf("unable to check if load balancer targets are healthy: %v", err)
 
+			return FailedStatus, err
+		}
 	}
 
-	serviceSublogger.Info("service is stable")
+	// A stable service isn't necessarily running what it was updated to, a
+	// deployment that came after this one could have replaced it.
+	if serviceUpdated.TaskDefinitionArn != "" {
+		serviceSublogger.Info("checking if running tasks use the new task definition")
+		err = deployer.checkServiceTaskDefinition(ctx, deployment, watch, serviceUpdated.TaskDefinitionArn)
+		if err != nil {
+			serviceSublogger.Errorf("unable to confirm running tasks use the new task definition: %v", err)
+
+			return FailedStatus, err
+		}
+	}
+
+	deployment.publish(&ServiceStable{EventMeta: EventMeta{Type: EventServiceStable, Status: SucceededStatus}, Service: serviceConfig.Name})
 
 	return SucceededStatus, nil
 }
 
-func watchService(cluster *string, service *types.Service, client *ecs.Client, serviceSublogger *log.Entry) {
-	ticker := time.NewTicker(time.Second * 3).C
+// serviceWatch keeps track of what has been reported about a service while
+// its rollout is being watched, so that nothing is reported twice.
+type serviceWatch struct {
+	name         string
+	since        time.Time
+	deadline     time.Time
+	maxWaitTime  time.Duration
+	events       map[string]bool
+	stoppedTasks map[string]bool
+	failedTasks  map[string]int32
+}
+
+func newServiceWatch(name string, since time.Time, maxWaitTime time.Duration) *serviceWatch {
+	return &serviceWatch{
+		name:         name,
+		since:        since,
+		deadline:     since.Add(maxWaitTime),
+		maxWaitTime:  maxWaitTime,
+		events:       map[string]bool{},
+		stoppedTasks: map[string]bool{},
+		failedTasks:  map[string]int32{},
+	}
+}
 
+func (deployer *Deployer) watchService(ctx context.Context, deployment *Deployment, watch *serviceWatch, serviceSublogger *log.Entry) error {
 	for {
-		serviceParams := &ecs.DescribeServicesInput{
-			Cluster:  cluster,
-			Services: []string{*service.ServiceName},
-		}
-		serviceResult, err := client.DescribeServices(context.TODO(), serviceParams)
+		service, err := deployer.pollService(ctx, deployment, watch)
 		if err != nil {
-			serviceSublogger.Errorf("unable to fetch service profile: %v", err)
-
-			break
+			return err
 		}
 
-		// If the service is not found then stop watching the service. We should
-		// also only ever receive one service anyway.
-		if len(serviceResult.Services) == 0 {
-			serviceSublogger.Error("stopped watching, service not found")
-
-			break
-		}
-		service := serviceResult.Services[0]
-
 		// PRIMARY - the most recent deployment of a service. ACTIVE - a service
 		// deployment that still has running tasks, but are in the process of
 		// being replaced with a new PRIMARY deployment. INACTIVE - A deployment
 		// that has been completely replaced.
 		hasCompletedPrimary := false
 		hasActiveDeployment := false
-		for _, deployment := range service.Deployments {
-			// Set up logger with the deployment identifier.
-			deploymentSublogger := serviceSublogger.WithField("deployment-id", *deployment.Id)
-			deploymentSublogger.Infof("watching ... service: %s, deployment: %s, rollout: %d/%d (%d pending)", strings.ToLower(*service.Status), strings.ToLower(*deployment.Status), deployment.RunningCount, deployment.DesiredCount, deployment.PendingCount)
-
-			if (*deployment.Status == "PRIMARY") && (deployment.RolloutState == types.DeploymentRolloutStateCompleted) {
+		failingTaskDefinitions := []string{}
+		for _, serviceDeployment := range service.Deployments {
+			deployment.publish(&DeploymentProgress{
+				EventMeta:           EventMeta{Type: EventDeploymentProgress, Status: RunningStatus},
+				Service:             *service.ServiceName,
+				ServiceStatus:       *service.Status,
+				ServiceDeploymentID: *serviceDeployment.Id,
+				DeploymentStatus:    *serviceDeployment.Status,
+				RolloutState:        string(serviceDeployment.RolloutState),
+				RunningCount:        serviceDeployment.RunningCount,
+				DesiredCount:        serviceDeployment.DesiredCount,
+				PendingCount:        serviceDeployment.PendingCount,
+			})
+
+			if (*serviceDeployment.Status == "PRIMARY") && (serviceDeployment.RolloutState == types.DeploymentRolloutStateCompleted) {
 				hasCompletedPrimary = true
 			}
 
-			if *deployment.Status == "ACTIVE" {
+			if *serviceDeployment.Status == "ACTIVE" {
 				hasActiveDeployment = true
 			}
+
+			// More failed tasks than last time means the deployment is failing,
+			// the reasons are in the tasks that stopped.
+			if serviceDeployment.FailedTasks > watch.failedTasks[*serviceDeployment.Id] && serviceDeployment.TaskDefinition != nil {
+				watch.failedTasks[*serviceDeployment.Id] = serviceDeployment.FailedTasks
+				failingTaskDefinitions = append(failingTaskDefinitions, *serviceDeployment.TaskDefinition)
+			}
+		}
+
+		if len(failingTaskDefinitions) > 0 {
+			err = deployer.reportStoppedTasks(ctx, deployment, watch, failingTaskDefinitions)
+			if err != nil {
+				serviceSublogger.Warnf("unable to fetch stopped tasks: %v", err)
+			}
 		}
 
 		// A service has an ACTIVE deployment if it is still being rolled out.
@@ -259,9 +364,329 @@ func watchService(cluster *string, service *types.Service, client *ecs.Client, s
 		if hasCompletedPrimary && !hasActiveDeployment {
 			serviceSublogger.Debugf("primary deployment completed, no active deployment")
 
-			break
+			return nil
 		}
 
-		<-ticker
+		if deployer.clock.Now().After(watch.deadline) {
+			return &ErrStabilityTimeout{Service: watch.name, MaxWait: watch.maxWaitTime}
+		}
 	}
 }
+
+// waitForServiceStable waits for the service to only have one deployment with
+// all of its tasks running, the same way the services stable waiter does.
+func (deployer *Deployer) waitForServiceStable(ctx context.Context, deployment *Deployment, watch *serviceWatch, serviceSublogger *log.Entry) error {
+	for {
+		service, err := deployer.pollService(ctx, deployment, watch)
+		if err != nil {
+			return err
+		}
+
+		switch *service.Status {
+		case "DRAINING":
+			return fmt.Errorf("service is %s", strings.ToLower(*service.Status))
+		}
+
+		if len(service.Deployments) == 1 && service.RunningCount == service.DesiredCount {
+			return nil
+		}
+		serviceSublogger.Debugf("service not stable yet, deployments: %d, running: %d/%d", len(service.Deployments), service.RunningCount, service.DesiredCount)
+
+		if deployer.clock.Now().After(watch.deadline) {
+			return &ErrStabilityTimeout{Service: watch.name, MaxWait: watch.maxWaitTime}
+		}
+	}
+}
+
+// checkServiceTaskDefinition makes sure all the running tasks of the service
+// are of the given task definition.
+func (deployer *Deployer) checkServiceTaskDefinition(ctx context.Context, deployment *Deployment, watch *serviceWatch, taskDefinitionArn string) error {
+	tasks, err := deployer.describeServiceTasks(ctx, deployment.Target.Cluster, watch.name, types.DesiredStatusRunning)
+	if err != nil {
+		return err
+	}
+
+	// Get task ID from ARN since it's not available.
+	var resourceIDRegex = regexp.MustCompile(`[^:/]*$`)
+	taskIDs := []string{}
+	for _, task := range tasks {
+		if task.TaskDefinitionArn != nil && *task.TaskDefinitionArn != taskDefinitionArn {
+			taskIDs = append(taskIDs, resourceIDRegex.FindString(*task.TaskArn))
+		}
+	}
+	if len(taskIDs) > 0 {
+		sort.Strings(taskIDs)
+
+		return &ErrTaskDefinitionMismatch{Service: watch.name, TaskDefinitionArn: taskDefinitionArn, TaskIDs: taskIDs}
+	}
+
+	return nil
+}
+
+// pollService fetches the service being watched and publishes the service
+// events that have come up since the watch began.
+func (deployer *Deployer) pollService(ctx context.Context, deployment *Deployment, watch *serviceWatch) (*types.Service, error) {
+	service, err := deployer.poller.service(ctx, deployment.Target.Cluster, watch.name)
+	if err != nil {
+		return nil, err
+	}
+	publishServiceEvents(deployment, watch, service)
+
+	return service, nil
+}
+
+// pollServiceTasks is like pollService but also fetches the service's tasks
+// with any of the desired statuses as part of the same poll.
+func (deployer *Deployer) pollServiceTasks(ctx context.Context, deployment *Deployment, watch *serviceWatch, desiredStatuses ...types.DesiredStatus) (*types.Service, []types.Task, error) {
+	service, tasks, err := deployer.poller.serviceWithTasks(ctx, deployment.Target.Cluster, watch.name, desiredStatuses...)
+	if err != nil {
+		return nil, nil, err
+	}
+	publishServiceEvents(deployment, watch, service)
+
+	return service, tasks, nil
+}
+
+// publishServiceEvents publishes the events of the service that have come up
+// since the watch began, each event is only published once.
+func publishServiceEvents(deployment *Deployment, watch *serviceWatch, service *types.Service) {
+	// Service events are listed newest first.
+	for index := len(service.Events) - 1; index >= 0; index-- {
+		serviceEvent := service.Events[index]
+		if serviceEvent.Id == nil || serviceEvent.Message == nil || watch.events[*serviceEvent.Id] {
+			continue
+		}
+		if serviceEvent.CreatedAt == nil || serviceEvent.CreatedAt.Before(watch.since) {
+			continue
+		}
+		watch.events[*serviceEvent.Id] = true
+
+		deployment.publish(&ServiceEvent{
+			EventMeta: EventMeta{Type: EventServiceEvent, Status: RunningStatus},
+			Service:   watch.name,
+			EventID:   *serviceEvent.Id,
+			Message:   *serviceEvent.Message,
+			CreatedAt: serviceEvent.CreatedAt.UTC(),
+		})
+	}
+}
+
+// reportStoppedTasks publishes why the tasks of the given task definitions
+// that stopped since the watch began did so, each task is only reported once.
+func (deployer *Deployer) reportStoppedTasks(ctx context.Context, deployment *Deployment, watch *serviceWatch, taskDefinitionArns []string) error {
+	tasks, err := deployer.describeServiceTasks(ctx, deployment.Target.Cluster, watch.name, types.DesiredStatusStopped)
+	if err != nil {
+		return err
+	}
+
+	stoppedTasks := []types.Task{}
+	for _, task := range tasks {
+		if task.TaskArn == nil || task.TaskDefinitionArn == nil || watch.stoppedTasks[*task.TaskArn] {
+			continue
+		}
+		if task.StoppedAt != nil && task.StoppedAt.Before(watch.since) {
+			continue
+		}
+
+		for _, taskDefinitionArn := range taskDefinitionArns {
+			if *task.TaskDefinitionArn == taskDefinitionArn {
+				stoppedTasks = append(stoppedTasks, task)
+
+				break
+			}
+		}
+	}
+	sort.Slice(stoppedTasks, func(i, j int) bool {
+		if stoppedTasks[i].StoppedAt == nil || stoppedTasks[j].StoppedAt == nil {
+			return *stoppedTasks[i].TaskArn < *stoppedTasks[j].TaskArn
+		}
+
+		return stoppedTasks[i].StoppedAt.Before(*stoppedTasks[j].StoppedAt)
+	})
+
+	// Get task ID from ARN since it's not available.
+	var resourceIDRegex = regexp.MustCompile(`[^:/]*$`)
+	for _, task := range stoppedTasks {
+		watch.stoppedTasks[*task.TaskArn] = true
+
+		serviceTaskStopped := &ServiceTaskStopped{
+			EventMeta:         EventMeta{Type: EventServiceTaskStopped, Status: FailedStatus},
+			Service:           watch.name,
+			TaskID:            resourceIDRegex.FindString(*task.TaskArn),
+			TaskArn:           *task.TaskArn,
+			TaskDefinitionArn: *task.TaskDefinitionArn,
+			StopCode:          string(task.StopCode),
+		}
+		if task.StoppedReason != nil {
+			serviceTaskStopped.StoppedReason = *task.StoppedReason
+		}
+		for _, container := range task.Containers {
+			stoppedContainer := StoppedContainer{ExitCode: container.ExitCode}
+			if container.Name != nil {
+				stoppedContainer.Name = *container.Name
+			}
+			if container.Reason != nil {
+				stoppedContainer.Reason = *container.Reason
+			}
+			serviceTaskStopped.Containers = append(serviceTaskStopped.Containers, stoppedContainer)
+		}
+		deployment.publish(serviceTaskStopped)
+	}
+
+	return nil
+}
+
+// strategy returns how the service should be deployed, which is a rolling
+// update by the service's deployment controller unless set otherwise.
+func (service *Service) strategy() ServiceStrategy {
+	if service.Strategy != nil {
+		return ServiceStrategy(*service.Strategy)
+	}
+
+	return ServiceStrategyRolling
+}
+
+// maxWaitTime returns how long to wait for the service to be stable, which
+// is 15 minutes unless set otherwise.
+func (service *Service) maxWaitTime() time.Duration {
+	if service.MaxWait != nil {
+		return time.Duration(*service.MaxWait) * time.Minute
+	}
+
+	return 15 * time.Minute
+}
+
+// apply overrides the current deployment configuration of a service with the
+// settings that are set, leaving the current one as is.
+func (deploymentConfiguration *DeploymentConfiguration) apply(current *types.DeploymentConfiguration) *types.DeploymentConfiguration {
+	applied := &types.DeploymentConfiguration{}
+	if current != nil {
+		*applied = *current
+	}
+
+	if deploymentConfiguration.Alarms != nil {
+		applied.Alarms = &types.DeploymentAlarms{
+			AlarmNames: deploymentConfiguration.Alarms.Names,
+			Enable:     deploymentConfiguration.Alarms.Enable,
+			Rollback:   deploymentConfiguration.Alarms.Rollback,
+		}
+	}
+
+	if deploymentConfiguration.CircuitBreaker != nil {
+		applied.DeploymentCircuitBreaker = &types.DeploymentCircuitBreaker{
+			Enable:   deploymentConfiguration.CircuitBreaker.Enable,
+			Rollback: deploymentConfiguration.CircuitBreaker.Rollback,
+		}
+	}
+
+	if deploymentConfiguration.MaximumPercent != nil {
+		applied.MaximumPercent = deploymentConfiguration.MaximumPercent
+	}
+
+	if deploymentConfiguration.MinimumHealthyPercent != nil {
+		applied.MinimumHealthyPercent = deploymentConfiguration.MinimumHealthyPercent
+	}
+
+	return applied
+}
+
+// describeService fetches the full profile of the service, returning
+// ErrServiceNotFound if it doesn't exist.
+func (deployer *Deployer) describeService(ctx context.Context, cluster *string, name string) (*types.Service, error) {
+	serviceParams := &ecs.DescribeServicesInput{
+		Cluster:  cluster,
+		Services: []string{name},
+	}
+	serviceResult, err := deployer.client.DescribeServices(ctx, serviceParams)
+	if err != nil {
+		return nil, err
+	}
+
+	// We should only ever receive one service. A service that has been deleted
+	// is treated the same as one that never existed.
+	if len(serviceResult.Services) == 0 || *serviceResult.Services[0].Status == "INACTIVE" {
+		return nil, &ErrServiceNotFound{Cluster: *cluster, Service: name}
+	}
+
+	return &serviceResult.Services[0], nil
+}
+
+// describeServiceTasks fetches the full profile of the service's tasks with
+// any of the desired statuses.
+func (deployer *Deployer) describeServiceTasks(ctx context.Context, cluster string, serviceName string, desiredStatuses ...types.DesiredStatus) ([]types.Task, error) {
+	taskArns := []string{}
+	for _, desiredStatus := range desiredStatuses {
+		paginator := ecs.NewListTasksPaginator(deployer.client, &ecs.ListTasksInput{
+			Cluster:       &cluster,
+			DesiredStatus: desiredStatus,
+			ServiceName:   &serviceName,
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return nil, err
+			}
+			taskArns = append(taskArns, page.TaskArns...)
+		}
+	}
+
+	return deployer.describeTasks(ctx, cluster, taskArns)
+}
+
+// describeTasks fetches the full profile of the tasks, in batches of as many
+// as can be described at once.
+func (deployer *Deployer) describeTasks(ctx context.Context, cluster string, taskArns []string) ([]types.Task, error) {
+	tasks := []types.Task{}
+	for start := 0; start < len(taskArns); start += maxTasksPerDescribe {
+		end := start + maxTasksPerDescribe
+		if end > len(taskArns) {
+			end = len(taskArns)
+		}
+
+		taskResult, err := deployer.client.DescribeTasks(ctx, &ecs.DescribeTasksInput{
+			Cluster: &cluster,
+			Tasks:   taskArns[start:end],
+		})
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, taskResult.Tasks...)
+	}
+
+	return tasks, nil
+}
+
+// previousTaskDefinition finds the active revision of the task definition's
+// family that came before it.
+func (deployer *Deployer) previousTaskDefinition(ctx context.Context, taskDefinitionArn string) (string, error) {
+	family, revision, err := parseTaskDefinitionArn(taskDefinitionArn)
+	if err != nil {
+		return "", err
+	}
+
+	paginator := ecs.NewListTaskDefinitionsPaginator(deployer.client, &ecs.ListTaskDefinitionsInput{
+		FamilyPrefix: &family,
+		Sort:         types.SortOrderDesc,
+		Status:       types.TaskDefinitionStatusActive,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return "", err
+		}
+
+		// The family is only a prefix so other families can be listed too.
+		for _, arn := range page.TaskDefinitionArns {
+			candidateFamily, candidateRevision, err := parseTaskDefinitionArn(arn)
+			if err != nil || candidateFamily != family {
+				continue
+			}
+
+			if candidateRevision < revision {
+				return arn, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("no active revision of %s before %d", family, revision)
+}
@@ -20,6 +20,7 @@ type Status string
 
 const (
 	FailedStatus    Status = "failed"
+	RunningStatus   Status = "running"
 	SkippedStatus   Status = "skipped"
 	SucceededStatus Status = "succeeded"
 )
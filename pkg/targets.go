@@ -0,0 +1,202 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"errors"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DeployTargetFunc deploys the application to a single target, it's expected
+// to log its own errors.
+type DeployTargetFunc func(target *Target, logger *log.Entry) error
+
+// DeploymentTargets returns the targets that the application should be
+// deployed to. A config with just a cluster is treated as a single target.
+func (config *Config) DeploymentTargets() []Target {
+	if len(config.Targets) > 0 {
+		return config.Targets
+	}
+
+	return []Target{{Cluster: config.Cluster}}
+}
+
+// DeploymentTargetRollout returns how the application should be rolled out
+// to the targets, which is sequentially unless set otherwise.
+func (config *Config) DeploymentTargetRollout() TargetRollout {
+	if config.TargetRollout != nil {
+		return TargetRollout(*config.TargetRollout)
+	}
+
+	return TargetRolloutSequential
+}
+
+func (config *Config) DeployTargets(deployTarget DeployTargetFunc) error {
+	targets := config.DeploymentTargets()
+	rollout := config.DeploymentTargetRollout()
+	numberOfTargets := len(targets)
+
+	// There's no need for a separate report if there's only one target since
+	// the reports of its tasks and services are enough.
+	if numberOfTargets == 1 {
+		return deployTarget(&targets[0], targets[0].logger())
+	}
+	log.Infof("starting %s rollout to %d targets", rollout, numberOfTargets)
+
+	// Sequential rollouts go target by target, halting on the first failure so
+	// that a bad release doesn't reach any other region. Parallel rollouts go
+	// to all the targets at once to reduce the amount of time spent.
+	statuses := make([]Status, numberOfTargets)
+	switch rollout {
+	case TargetRolloutParallel:
+		wg := sync.WaitGroup{}
+		for index := range targets {
+			wg.Add(1)
+
+			go func(index int) {
+				defer wg.Done()
+
+				statuses[index] = deployTargetStatus(&targets[index], deployTarget)
+			}(index)
+		}
+		wg.Wait()
+	default:
+		halted := false
+		for index := range targets {
+			if halted {
+				targets[index].logger().Warn("skipping rollout to target, halted after previous failure")
+				statuses[index] = SkippedStatus
+
+				continue
+			}
+
+			statuses[index] = deployTargetStatus(&targets[index], deployTarget)
+			if statuses[index] == FailedStatus {
+				halted = true
+			}
+		}
+	}
+
+	// Report on each target separately then summarise.
+	var (
+		failedCount  = 0
+		skippedCount = 0
+	)
+	for index, status := range statuses {
+		targets[index].logger().Infof("target [%d] report - status: %s", index+1, status)
+
+		switch status {
+		case FailedStatus:
+			failedCount = failedCount + 1
+		case SkippedStatus:
+			skippedCount = skippedCount + 1
+		}
+	}
+
+	successfulCount := numberOfTargets - (failedCount + skippedCount)
+	log.Infof("targets report - total: %d, successful: %d, skipped: %d, failed: %d", numberOfTargets, successfulCount, skippedCount, failedCount)
+
+	if failedCount > 0 || skippedCount > 0 {
+		err := errors.New("unable to deploy to all targets")
+
+		return err
+	}
+
+	log.Infof("completed %s rollout to %d targets", rollout, numberOfTargets)
+
+	return nil
+}
+
+func deployTargetStatus(target *Target, deployTarget DeployTargetFunc) Status {
+	logger := target.logger()
+	logger.Info("starting rollout to target")
+
+	err := deployTarget(target, logger)
+	if err != nil {
+		logger.Errorf("unable to complete rollout to target: %v", err)
+
+		return FailedStatus
+	}
+	logger.Info("completed rollout to target")
+
+	return SucceededStatus
+}
+
+// AWSConfig returns the AWS options with the target's own settings taking
+// precedence over the ones shared by all targets.
+func (target *Target) AWSConfig(awsConfig AWS) AWS {
+	if target.Region != nil {
+		awsConfig.Region = target.Region
+	}
+
+	if target.Profile != nil {
+		awsConfig.Profile = target.Profile
+	}
+
+	if target.RoleARN != nil {
+		awsConfig.RoleARN = target.RoleARN
+	}
+
+	if target.ExternalID != nil {
+		awsConfig.ExternalID = target.ExternalID
+	}
+
+	if target.SessionName != nil {
+		awsConfig.SessionName = target.SessionName
+	}
+
+	return awsConfig
+}
+
+// sameAWSSettings is whether the other target is reached with the same AWS
+// settings, and so the same clients.
+func (target *Target) sameAWSSettings(other *Target) bool {
+	return equalStringPtrs(target.Region, other.Region) &&
+		equalStringPtrs(target.Profile, other.Profile) &&
+		equalStringPtrs(target.RoleARN, other.RoleARN) &&
+		equalStringPtrs(target.ExternalID, other.ExternalID)
+}
+
+// otherRegion is whether the other target is known to be in another region.
+func (target *Target) otherRegion(other *Target) bool {
+	return target.Region != nil && other.Region != nil && *target.Region != *other.Region
+}
+
+func equalStringPtrs(a *string, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return *a == *b
+}
+
+func (target *Target) logger() *log.Entry {
+	return target.loggerFrom(log.NewEntry(log.StandardLogger()))
+}
+
+// loggerFrom sets up a logger with the details of the target on top of the
+// given one.
+func (target *Target) loggerFrom(logger *log.Entry) *log.Entry {
+	fields := log.Fields{"cluster": target.Cluster}
+	if target.Region != nil {
+		fields["region"] = *target.Region
+	}
+
+	return logger.WithFields(fields)
+}
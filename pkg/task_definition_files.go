@@ -0,0 +1,371 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"gopkg.in/yaml.v3"
+
+	dockerparser "github.com/novln/docker-parser"
+	log "github.com/sirupsen/logrus"
+)
+
+type TaskDefinitionFormat string
+
+const (
+	TaskDefinitionFormatJSON TaskDefinitionFormat = "json"
+	TaskDefinitionFormatYAML TaskDefinitionFormat = "yaml"
+)
+
+// TaskDefinitionTemplateData is what task definition files are rendered with
+// as Go templates e.g. `{{ .ImageTag }}` or `{{ .Env.DATABASE_SECRET_ARN }}`.
+type TaskDefinitionTemplateData struct {
+	// The docker image tag being deployed.
+	ImageTag string
+
+	// The cluster being deployed to.
+	Cluster string
+
+	// The environment variables ecs-toolkit is running with. Rendering fails
+	// if the template uses one that isn't set.
+	Env map[string]string
+}
+
+type ExportTaskDefinitionInput struct {
+	// The task definition to export. Could be the family for the latest
+	// ACTIVE revision, family and revision (family:revision) or full Amazon
+	// Resource Name (ARN) of the task definition.
+	//
+	// This member is required.
+	TaskDefinition string
+
+	// The format to export the task definition in. Defaults to JSON.
+	Format TaskDefinitionFormat
+}
+
+type RegisterTaskDefinitionFileInput struct {
+	// The contents of the task definition file, as written by
+	// ExportTaskDefinition.
+	//
+	// This member is required.
+	Data []byte
+
+	// The format of the task definition file. Defaults to JSON.
+	Format TaskDefinitionFormat
+
+	// The docker image tag to update the containers to before registering
+	// the task definition, the images are left as they are if not set.
+	ImageTag string
+
+	// The containers whose image tag should be updated. Defaults to all the
+	// containers in the task definition.
+	Containers []string
+}
+
+// TaskDefinitionFormatFor works out the format of a task definition file
+// from its extension, defaulting to JSON.
+func TaskDefinitionFormatFor(path string) TaskDefinitionFormat {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return TaskDefinitionFormatYAML
+	default:
+		return TaskDefinitionFormatJSON
+	}
+}
+
+// ExportTaskDefinition writes out the parts of the task definition that can
+// be registered again, in the format the ECS API takes them, so that it can
+// be kept in version control and registered with RegisterTaskDefinitionFile.
+// Tags set by ecs-toolkit or reserved by AWS are left out.
+func (deployer *Deployer) ExportTaskDefinition(ctx context.Context, input *ExportTaskDefinitionInput) ([]byte, error) {
+	taskDefinitionResult, err := deployer.client.DescribeTaskDefinition(ctx, &ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: &input.TaskDefinition,
+		Include: []types.TaskDefinitionField{
+			types.TaskDefinitionFieldTags,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	taskDefinition := registerTaskDefinitionInput(taskDefinitionResult.TaskDefinition)
+	for _, tag := range taskDefinitionResult.Tags {
+		if tag.Key == nil || strings.HasPrefix(*tag.Key, "ecs-toolkit:") || strings.HasPrefix(*tag.Key, "aws:") {
+			continue
+		}
+		taskDefinition.Tags = append(taskDefinition.Tags, tag)
+	}
+
+	return MarshalTaskDefinition(taskDefinition, input.Format)
+}
+
+// RegisterTaskDefinitionFile registers a new revision of the task definition
+// in the file, updating the image tag of its containers first if one is
+// given.
+func (deployer *Deployer) RegisterTaskDefinitionFile(ctx context.Context, input *RegisterTaskDefinitionFileInput) (*types.TaskDefinition, error) {
+	taskDefinition, err := UnmarshalTaskDefinition(input.Data, input.Format)
+	if err != nil {
+		return nil, err
+	}
+	taskDefinitionSublogger := deployer.logger.WithField("family", *taskDefinition.Family)
+
+	if input.ImageTag != "" {
+		containers := input.Containers
+		if len(containers) == 0 {
+			for _, containerDefinition := range taskDefinition.ContainerDefinitions {
+				containers = append(containers, *containerDefinition.Name)
+			}
+		}
+
+		for _, containerName := range containers {
+			found := false
+			for index, containerDefinition := range taskDefinition.ContainerDefinitions {
+				if *containerDefinition.Name != containerName {
+					continue
+				}
+				found = true
+
+				newContainerImage, err := replaceImageTag(*containerDefinition.Image, input.ImageTag)
+				if err != nil {
+					return nil, err
+				}
+				taskDefinition.ContainerDefinitions[index].Image = &newContainerImage
+				taskDefinitionSublogger.WithField("container", containerName).Infof("new container image: %s", newContainerImage)
+			}
+			if !found {
+				return nil, fmt.Errorf("container %s not in the task definition", containerName)
+			}
+		}
+	}
+
+	taskDefinitionSublogger.Info("registering task definition")
+	registerTaskDefinitionResult, err := deployer.client.RegisterTaskDefinition(ctx, taskDefinition)
+	if err != nil {
+		return nil, err
+	}
+
+	return registerTaskDefinitionResult.TaskDefinition, nil
+}
+
+// MarshalTaskDefinition encodes the task definition the way the ECS API and
+// the AWS CLI take it, leaving out any fields that aren't set.
+func MarshalTaskDefinition(taskDefinition *ecs.RegisterTaskDefinitionInput, format TaskDefinitionFormat) ([]byte, error) {
+	encoded := encodeValue(reflect.ValueOf(taskDefinition))
+
+	if format == TaskDefinitionFormatYAML {
+		var data bytes.Buffer
+		encoder := yaml.NewEncoder(&data)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(encoded); err != nil {
+			return nil, err
+		}
+
+		return data.Bytes(), nil
+	}
+
+	data, err := json.MarshalIndent(encoded, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(data, '\n'), nil
+}
+
+// UnmarshalTaskDefinition decodes the task definition, failing on fields the
+// ECS API doesn't know about so that typos don't go unnoticed.
+func UnmarshalTaskDefinition(data []byte, format TaskDefinitionFormat) (*ecs.RegisterTaskDefinitionInput, error) {
+	// YAML is decoded as is and encoded to JSON, to be decoded like JSON
+	// into the task definition.
+	if format == TaskDefinitionFormatYAML {
+		var decoded interface{}
+		if err := yaml.Unmarshal(data, &decoded); err != nil {
+			return nil, fmt.Errorf("unable to parse task definition: %w", err)
+		}
+
+		jsonData, err := json.Marshal(decoded)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse task definition: %w", err)
+		}
+		data = jsonData
+	}
+
+	taskDefinition := &ecs.RegisterTaskDefinitionInput{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(taskDefinition); err != nil {
+		return nil, fmt.Errorf("unable to parse task definition: %w", err)
+	}
+
+	if taskDefinition.Family == nil || *taskDefinition.Family == "" {
+		return nil, errors.New("task definition has no family")
+	}
+
+	if len(taskDefinition.ContainerDefinitions) == 0 {
+		return nil, errors.New("task definition has no container definitions")
+	}
+
+	for _, containerDefinition := range taskDefinition.ContainerDefinitions {
+		if containerDefinition.Name == nil || containerDefinition.Image == nil {
+			return nil, errors.New("task definition has a container definition without a name or image")
+		}
+	}
+
+	return taskDefinition, nil
+}
+
+// NewTaskDefinitionTemplateData sets up the data to render task definition
+// files with for a deployment of the image tag to the cluster.
+func NewTaskDefinitionTemplateData(cluster string, imageTag string) *TaskDefinitionTemplateData {
+	env := map[string]string{}
+	for _, variable := range os.Environ() {
+		name, value, _ := strings.Cut(variable, "=")
+		env[name] = value
+	}
+
+	return &TaskDefinitionTemplateData{
+		ImageTag: imageTag,
+		Cluster:  cluster,
+		Env:      env,
+	}
+}
+
+// RenderTaskDefinitionFile renders the task definition file as a Go template
+// and decodes the result, in the format its extension calls for.
+func RenderTaskDefinitionFile(path string, data *TaskDefinitionTemplateData) (*ecs.RegisterTaskDefinitionInput, error) {
+	templateText, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read task definition file: %w", err)
+	}
+
+	taskDefinitionTemplate, err := template.New(filepath.Base(path)).
+		Option("missingkey=error").
+		Funcs(template.FuncMap{"json": templateJSON}).
+		Parse(string(templateText))
+	if err != nil {
+		return nil, fmt.Errorf("invalid task definition template: %w", err)
+	}
+
+	var rendered bytes.Buffer
+	err = taskDefinitionTemplate.Execute(&rendered, data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to render task definition template: %w", err)
+	}
+
+	return UnmarshalTaskDefinition(rendered.Bytes(), TaskDefinitionFormatFor(path))
+}
+
+// buildTaskDefinitionFromFile works out the new revision of the task
+// definition by rendering the task definition file, returning the current
+// task definition, if there's one, and the changes to the container images.
+func buildTaskDefinitionFromFile(ctx context.Context, input *GenerateTaskDefinitionInput, client ECSAPI, logger *log.Entry) (*types.TaskDefinition, *ecs.RegisterTaskDefinitionInput, []ContainerImageChange, error) {
+	logger.Infof("rendering new task definition from %s", *input.TaskDefinitionFile)
+	registerTaskDefinitionParams, err := RenderTaskDefinitionFile(*input.TaskDefinitionFile, input.TemplateData)
+	if err != nil {
+		logger.Errorf("unable to render task definition file: %v", err)
+
+		return nil, nil, nil, err
+	}
+
+	// The current task definition is only needed to tell what changed, it
+	// may not exist yet if the file is for a new family.
+	logger.Debug("fetching task definition profile")
+	taskDefinitionResult, err := client.DescribeTaskDefinition(ctx, &ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: input.TaskDefinition,
+	})
+	var clientErr *types.ClientException
+	if err != nil && !errors.As(err, &clientErr) {
+		logger.Errorf("unable to fetch task definition profile: %v", err)
+
+		return nil, nil, nil, err
+	}
+
+	var currentTaskDefinition *types.TaskDefinition
+	currentContainerImages := map[string]string{}
+	if err == nil {
+		currentTaskDefinition = taskDefinitionResult.TaskDefinition
+		for _, containerDefinition := range currentTaskDefinition.ContainerDefinitions {
+			if containerDefinition.Name != nil && containerDefinition.Image != nil {
+				currentContainerImages[*containerDefinition.Name] = *containerDefinition.Image
+			}
+		}
+	}
+
+	if len(registerTaskDefinitionParams.Tags) >= 1 || len(input.Tags) >= 1 {
+		registerTaskDefinitionParams.Tags, err = mergeTags(registerTaskDefinitionParams.Tags, input.Tags)
+		if err != nil {
+			logger.Errorf("unable to tag new task definition: %v", err)
+
+			return nil, nil, nil, err
+		}
+	}
+
+	changes := []ContainerImageChange{}
+	for i, containerDefinition := range registerTaskDefinitionParams.ContainerDefinitions {
+		containerName := *containerDefinition.Name
+		containerSublogger := logger.WithField("container", containerName)
+
+		newContainerImage := *containerDefinition.Image
+		if input.UpdateableContainers[containerName] {
+			newContainerImage, err = replaceImageTag(newContainerImage, *input.ImageTag)
+			if err != nil {
+				containerSublogger.Errorf("unable to update container image tag: %v", err)
+
+				return nil, nil, nil, err
+			}
+			registerTaskDefinitionParams.ContainerDefinitions[i].Image = &newContainerImage
+		}
+
+		oldContainerImage := currentContainerImages[containerName]
+		if oldContainerImage != newContainerImage {
+			changes = append(changes, ContainerImageChange{
+				Container: containerName,
+				OldImage:  oldContainerImage,
+				NewImage:  newContainerImage,
+			})
+			containerSublogger.Infof("new container image: %s", newContainerImage)
+		}
+	}
+
+	renderedTaskDefinition := &types.TaskDefinition{ContainerDefinitions: registerTaskDefinitionParams.ContainerDefinitions}
+	for _, containerName := range missingContainers(renderedTaskDefinition, input.UpdateableContainers) {
+		logger.WithField("container", containerName).Warn("skipping container image tag update, not in the task definition")
+	}
+
+	return currentTaskDefinition, registerTaskDefinitionParams, changes, nil
+}
+
+// replaceImageTag swaps the tag of the image for the given one.
+func replaceImageTag(image string, imageTag string) (string, error) {
+	parsedImage, err := dockerparser.Parse(image)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse container image %s: %w", image, err)
+	}
+
+	return strings.Replace(image, parsedImage.Tag(), imageTag, 1), nil
+}
@@ -18,7 +18,7 @@ package pkg
 
 import (
 	"context"
-	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
@@ -48,9 +48,74 @@ type GenerateTaskDefinitionInput struct {
 	//
 	// This member is required.
 	UpdateableContainers map[string]bool
+
+	// Tags to set on the new task definition on top of the ones copied from
+	// the current one, replacing any with the same key.
+	Tags map[string]string
+
+	// The task definition file to render and register instead of copying the
+	// current task definition, which is then only used to tell whether
+	// anything changed. The containers on the list still have their image tag
+	// updated.
+	TaskDefinitionFile *string
+
+	// What the task definition file is rendered with.
+	TemplateData *TaskDefinitionTemplateData
+}
+
+// ContainerImageChange is a change to the image of a container in a task
+// definition.
+type ContainerImageChange struct {
+	// The name of the container.
+	Container string
+
+	// The image the container currently uses.
+	OldImage string
+
+	// The image the container will use.
+	NewImage string
 }
 
-func GenerateTaskDefinition(input *GenerateTaskDefinitionInput, client *ecs.Client, logger *log.Entry) (*types.TaskDefinition, bool, error) {
+func GenerateTaskDefinition(ctx context.Context, input *GenerateTaskDefinitionInput, client ECSAPI, logger *log.Entry) (*types.TaskDefinition, bool, error) {
+	currentTaskDefinition, registerTaskDefinitionParams, changes, err := buildTaskDefinition(ctx, input, client, logger)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// If task definition wasn't updated there's no need to update the service.
+	// A rendered task definition can change in more ways than its container
+	// images, so it's compared with the current one as a whole.
+	unchanged := len(changes) == 0
+	if input.TaskDefinitionFile != nil {
+		unchanged = currentTaskDefinition != nil && len(diffTaskDefinitions(registerTaskDefinitionInput(currentTaskDefinition), registerTaskDefinitionParams)) == 0
+	}
+	if unchanged {
+		logger.Warn("skipping registering new task definition, no changes")
+
+		return nil, false, nil
+	}
+
+	// Register a new updated version of the task definition i.e. with new
+	// container image tags.
+	logger.Info("registering new task definition")
+	registerTaskDefinitionResult, err := client.RegisterTaskDefinition(ctx, registerTaskDefinitionParams)
+	if err != nil {
+		logger.Errorf("unable to register new task definition: %v", err)
+
+		return nil, false, err
+	}
+
+	return registerTaskDefinitionResult.TaskDefinition, true, nil
+}
+
+// buildTaskDefinition works out the new revision of the task definition
+// without registering it, returning the current task definition and the
+// changes to the container images.
+func buildTaskDefinition(ctx context.Context, input *GenerateTaskDefinitionInput, client ECSAPI, logger *log.Entry) (*types.TaskDefinition, *ecs.RegisterTaskDefinitionInput, []ContainerImageChange, error) {
+	if input.TaskDefinitionFile != nil {
+		return buildTaskDefinitionFromFile(ctx, input, client, logger)
+	}
+
 	// Fetch full profile of the latest task definition.
 	logger.Debug("fetching task definition profile")
 	taskDefinitionParams := &ecs.DescribeTaskDefinitionInput{
@@ -59,44 +124,32 @@ func GenerateTaskDefinition(input *GenerateTaskDefinitionInput, client *ecs.Clie
 			types.TaskDefinitionFieldTags,
 		},
 	}
-	taskDefinitionResult, err := client.DescribeTaskDefinition(context.TODO(), taskDefinitionParams)
+	taskDefinitionResult, err := client.DescribeTaskDefinition(ctx, taskDefinitionParams)
 	if err != nil {
 		logger.Errorf("unable to fetch task definition profile: %v", err)
 
-		return nil, false, err
+		return nil, nil, nil, err
 	}
 
 	// Copy details of the task definition to use a foundation for the new
 	// version of the task definition.
 	logger.Infof("building new task definition from %s:%d", *taskDefinitionResult.TaskDefinition.Family, taskDefinitionResult.TaskDefinition.Revision)
-	registerTaskDefinitionParams := &ecs.RegisterTaskDefinitionInput{
-		ContainerDefinitions:    taskDefinitionResult.TaskDefinition.ContainerDefinitions,
-		Family:                  taskDefinitionResult.TaskDefinition.Family,
-		Cpu:                     taskDefinitionResult.TaskDefinition.Cpu,
-		EphemeralStorage:        taskDefinitionResult.TaskDefinition.EphemeralStorage,
-		ExecutionRoleArn:        taskDefinitionResult.TaskDefinition.ExecutionRoleArn,
-		InferenceAccelerators:   taskDefinitionResult.TaskDefinition.InferenceAccelerators,
-		IpcMode:                 taskDefinitionResult.TaskDefinition.IpcMode,
-		Memory:                  taskDefinitionResult.TaskDefinition.Memory,
-		NetworkMode:             taskDefinitionResult.TaskDefinition.NetworkMode,
-		PidMode:                 taskDefinitionResult.TaskDefinition.PidMode,
-		PlacementConstraints:    taskDefinitionResult.TaskDefinition.PlacementConstraints,
-		ProxyConfiguration:      taskDefinitionResult.TaskDefinition.ProxyConfiguration,
-		RequiresCompatibilities: taskDefinitionResult.TaskDefinition.RequiresCompatibilities,
-		RuntimePlatform:         taskDefinitionResult.TaskDefinition.RuntimePlatform,
-		TaskRoleArn:             taskDefinitionResult.TaskDefinition.TaskRoleArn,
-		Volumes:                 taskDefinitionResult.TaskDefinition.Volumes,
-	}
+	registerTaskDefinitionParams := registerTaskDefinitionInput(taskDefinitionResult.TaskDefinition)
 
 	// Copy tags only if they exist else it will error out if you pass in an
 	// empty list of tags.
-	if len(taskDefinitionResult.Tags) >= 1 {
-		registerTaskDefinitionParams.Tags = taskDefinitionResult.Tags
+	if len(taskDefinitionResult.Tags) >= 1 || len(input.Tags) >= 1 {
+		registerTaskDefinitionParams.Tags, err = mergeTags(taskDefinitionResult.Tags, input.Tags)
+		if err != nil {
+			logger.Errorf("unable to tag new task definition: %v", err)
+
+			return nil, nil, nil, err
+		}
 	}
 
 	// For the new revision of the task definition update the image tag of
 	// each container (where applicable).
-	taskDefinitionUpdated := false
+	changes := []ContainerImageChange{}
 	for i, containerDefinition := range registerTaskDefinitionParams.ContainerDefinitions {
 		containerName := *containerDefinition.Name
 		containerSublogger := logger.WithField("container", containerName)
@@ -115,7 +168,7 @@ func GenerateTaskDefinition(input *GenerateTaskDefinitionInput, client *ecs.Clie
 		if err != nil {
 			containerSublogger.Errorf("unable to parse current container image %s: %v", oldContainerImage, err)
 
-			return nil, false, err
+			return nil, nil, nil, err
 		}
 		oldContainerImageTag := parsedImage.Tag()
 		newContainerImageTag := input.ImageTag
@@ -129,32 +182,69 @@ func GenerateTaskDefinition(input *GenerateTaskDefinitionInput, client *ecs.Clie
 			continue
 		}
 
-		*registerTaskDefinitionParams.ContainerDefinitions[i].Image = newContainerImage
-		taskDefinitionUpdated = true
+		// Update a copy of the image so that the current task definition isn't
+		// changed along with the new one.
+		registerTaskDefinitionParams.ContainerDefinitions[i].Image = &newContainerImage
+		changes = append(changes, ContainerImageChange{
+			Container: containerName,
+			OldImage:  oldContainerImage,
+			NewImage:  newContainerImage,
+		})
 		containerSublogger.Debugf("container image registry: %s", parsedImage.Registry())
 		containerSublogger.Debugf("container image name: %s", parsedImage.ShortName())
 		containerSublogger.Infof("old container image tag: %s", oldContainerImageTag)
 		containerSublogger.Infof("new container image tag: %s", *newContainerImageTag)
 	}
 
-	// If task definition wasn't updated there's no need to update the service.
-	if !taskDefinitionUpdated {
-		logger.Warn("skipping registering new task definition, no changes")
-
-		return nil, false, err
+	// Containers on the list that aren't in the task definition are most
+	// likely misspelt, so call them out rather than skip them silently.
+	for _, containerName := range missingContainers(taskDefinitionResult.TaskDefinition, input.UpdateableContainers) {
+		logger.WithField("container", containerName).Warn("skipping container image tag update, not in the task definition")
 	}
 
-	// Register a new updated version of the task definition i.e. with new
-	// container image tags.
-	logger.Info("registering new task definition")
-	registerTaskDefinitionResult, err := client.RegisterTaskDefinition(context.TODO(), registerTaskDefinitionParams)
-	if err != nil {
-		logger.Errorf("unable to register new task definition: %v", err)
+	return taskDefinitionResult.TaskDefinition, registerTaskDefinitionParams, changes, nil
+}
 
-		return nil, false, err
+// missingContainers lists the containers that aren't in the task definition,
+// sorted by name.
+func missingContainers(taskDefinition *types.TaskDefinition, containers map[string]bool) []string {
+	found := map[string]bool{}
+	for _, containerDefinition := range taskDefinition.ContainerDefinitions {
+		if containerDefinition.Name != nil {
+			found[*containerDefinition.Name] = true
+		}
 	}
-	newTaskDefinition := fmt.Sprintf("%s:%d", *registerTaskDefinitionResult.TaskDefinition.Family, registerTaskDefinitionResult.TaskDefinition.Revision)
-	logger.Infof("successfully registered new task definition %s", newTaskDefinition)
 
-	return registerTaskDefinitionResult.TaskDefinition, taskDefinitionUpdated, nil
+	missing := []string{}
+	for containerName, ok := range containers {
+		if ok && !found[containerName] {
+			missing = append(missing, containerName)
+		}
+	}
+	sort.Strings(missing)
+
+	return missing
+}
+
+// registerTaskDefinitionInput copies the details of the task definition that
+// can be registered again, the rest are set by ECS on registration.
+func registerTaskDefinitionInput(taskDefinition *types.TaskDefinition) *ecs.RegisterTaskDefinitionInput {
+	return &ecs.RegisterTaskDefinitionInput{
+		ContainerDefinitions:    append([]types.ContainerDefinition{}, taskDefinition.ContainerDefinitions...),
+		Family:                  taskDefinition.Family,
+		Cpu:                     taskDefinition.Cpu,
+		EphemeralStorage:        taskDefinition.EphemeralStorage,
+		ExecutionRoleArn:        taskDefinition.ExecutionRoleArn,
+		InferenceAccelerators:   taskDefinition.InferenceAccelerators,
+		IpcMode:                 taskDefinition.IpcMode,
+		Memory:                  taskDefinition.Memory,
+		NetworkMode:             taskDefinition.NetworkMode,
+		PidMode:                 taskDefinition.PidMode,
+		PlacementConstraints:    taskDefinition.PlacementConstraints,
+		ProxyConfiguration:      taskDefinition.ProxyConfiguration,
+		RequiresCompatibilities: taskDefinition.RequiresCompatibilities,
+		RuntimePlatform:         taskDefinition.RuntimePlatform,
+		TaskRoleArn:             taskDefinition.TaskRoleArn,
+		Volumes:                 taskDefinition.Volumes,
+	}
 }
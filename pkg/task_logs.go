@@ -0,0 +1,260 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	logstypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type TaskLogsOptions struct {
+	// The client to use when fetching container log events from CloudWatch
+	// Logs.
+	//
+	// This member is required.
+	Client LogsAPI
+
+	// The number of most recent log lines of each container to include in the
+	// report when a task stops prematurely.
+	Tail int
+}
+
+// containerLogSource holds the awslogs log driver options of a container that
+// are needed to locate the log stream of a specific task.
+type containerLogSource struct {
+	container    string
+	group        string
+	region       string
+	streamPrefix string
+}
+
+// taskLogStream follows the log stream of a single container in a task,
+// keeping the most recent lines around for reporting.
+type taskLogStream struct {
+	client    LogsAPI
+	source    containerLogSource
+	stream    string
+	taskNo    int
+	nextToken *string
+	tail      int
+	lines     []string
+	logger    *log.Entry
+}
+
+// taskLogStreamer polls the log streams of all containers in a task until it
+// is stopped.
+type taskLogStreamer struct {
+	ctx      context.Context
+	streams  []*taskLogStream
+	done     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func taskLogSources(taskDefinition *types.TaskDefinition, logger *log.Entry) []containerLogSource {
+	sources := []containerLogSource{}
+	for _, containerDefinition := range taskDefinition.ContainerDefinitions {
+		containerName := *containerDefinition.Name
+		containerSublogger := logger.WithField("container", containerName)
+
+		// Only containers using the awslogs log driver ship their logs to
+		// CloudWatch Logs, anything else can't be streamed.
+		logConfiguration := containerDefinition.LogConfiguration
+		if logConfiguration == nil || logConfiguration.LogDriver != types.LogDriverAwslogs {
+			containerSublogger.Debug("skipping container logs, not using awslogs log driver")
+
+			continue
+		}
+
+		// Without a stream prefix the log stream names are not tied to the task
+		// ID so there's no way to tell which stream belongs to which task.
+		options := logConfiguration.Options
+		if options["awslogs-group"] == "" || options["awslogs-stream-prefix"] == "" {
+			containerSublogger.Warn("skipping container logs, awslogs group or stream prefix not set")
+
+			continue
+		}
+
+		sources = append(sources, containerLogSource{
+			container:    containerName,
+			group:        options["awslogs-group"],
+			region:       options["awslogs-region"],
+			streamPrefix: options["awslogs-stream-prefix"],
+		})
+	}
+
+	return sources
+}
+
+// startTaskLogStreamer fetches the logs of the task's containers once every
+// interval until it's stopped or the context is cancelled.
+func startTaskLogStreamer(ctx context.Context, taskLogs *TaskLogsOptions, sources []containerLogSource, clock Clock, interval time.Duration, taskNo *int, taskID string, logger *log.Entry) *taskLogStreamer {
+	streamer := &taskLogStreamer{
+		ctx:  ctx,
+		done: make(chan struct{}),
+	}
+
+	for _, source := range sources {
+		streamer.streams = append(streamer.streams, &taskLogStream{
+			client: taskLogs.Client,
+			source: source,
+			stream: fmt.Sprintf("%s/%s/%s", source.streamPrefix, source.container, taskID),
+			taskNo: *taskNo,
+			tail:   taskLogs.Tail,
+			logger: logger.WithField("container", source.container),
+		})
+	}
+
+	streamer.wg.Add(1)
+	go func() {
+		defer streamer.wg.Done()
+
+		for {
+			streamer.fetch()
+
+			select {
+			case <-streamer.done:
+				return
+			case <-ctx.Done():
+				return
+			case <-clock.After(interval):
+			}
+		}
+	}()
+
+	return streamer
+}
+
+// stop ends polling of the log streams and does one last fetch to pick up any
+// log events that were ingested after the task stopped. It's safe to call more
+// than once and on a nil streamer i.e. when logs aren't being streamed.
+func (streamer *taskLogStreamer) stop() {
+	if streamer == nil {
+		return
+	}
+
+	streamer.stopOnce.Do(func() {
+		close(streamer.done)
+		streamer.wg.Wait()
+		streamer.fetch()
+	})
+}
+
+func (streamer *taskLogStreamer) fetch() {
+	for _, stream := range streamer.streams {
+		stream.fetch(streamer.ctx)
+	}
+}
+
+// report logs the most recent log lines of each container, which is useful
+// context when a task has stopped prematurely.
+func (streamer *taskLogStreamer) report(taskNo *int, logger *log.Entry) {
+	if streamer == nil {
+		return
+	}
+
+	for _, stream := range streamer.streams {
+		containerSublogger := logger.WithField("container", stream.source.container)
+		if len(stream.lines) == 0 {
+			containerSublogger.Errorf("stopped task [%d] container [%s] ... no log lines found", *taskNo, stream.source.container)
+
+			continue
+		}
+
+		containerSublogger.Errorf("stopped task [%d] container [%s] ... last %d log lines:", *taskNo, stream.source.container, len(stream.lines))
+		for _, line := range stream.lines {
+			containerSublogger.Errorf("  %s", line)
+		}
+	}
+}
+
+func (stream *taskLogStream) fetch(ctx context.Context) {
+	// Use the region of the log group if it has been set, it's not necessarily
+	// the same as the region the tasks are running in.
+	optFns := []func(*cloudwatchlogs.Options){}
+	if stream.source.region != "" {
+		optFns = append(optFns, func(o *cloudwatchlogs.Options) {
+			o.Region = stream.source.region
+		})
+	}
+
+	for {
+		logEventsParams := &cloudwatchlogs.GetLogEventsInput{
+			LogGroupName:  &stream.source.group,
+			LogStreamName: &stream.stream,
+			NextToken:     stream.nextToken,
+			StartFromHead: aws.Bool(true),
+		}
+		logEventsResult, err := stream.client.GetLogEvents(ctx, logEventsParams, optFns...)
+		if err != nil {
+			// The log stream is only created once the container has started so
+			// it's expected to be missing for a while.
+			var notFoundErr *logstypes.ResourceNotFoundException
+			if errors.As(err, &notFoundErr) {
+				stream.logger.Tracef("log stream %s not found yet", stream.stream)
+
+				return
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			stream.logger.Warnf("unable to fetch container logs: %v", err)
+
+			return
+		}
+
+		for _, event := range logEventsResult.Events {
+			line := strings.TrimRight(aws.ToString(event.Message), "\r\n")
+			stream.logger.Infof("task [%d] container [%s] | %s", stream.taskNo, stream.source.container, line)
+			stream.record(line)
+		}
+
+		// Once there are no more log events the same token is returned, which
+		// is an indicator that we've caught up with the stream.
+		token := logEventsResult.NextForwardToken
+		if len(logEventsResult.Events) == 0 || aws.ToString(token) == aws.ToString(stream.nextToken) {
+			stream.nextToken = token
+
+			return
+		}
+		stream.nextToken = token
+	}
+}
+
+// record keeps the line as one of the most recent lines of the container,
+// discarding the oldest line once the tail is full.
+func (stream *taskLogStream) record(line string) {
+	if stream.tail <= 0 {
+		return
+	}
+
+	stream.lines = append(stream.lines, line)
+	if len(stream.lines) > stream.tail {
+		stream.lines = stream.lines[len(stream.lines)-stream.tail:]
+	}
+}
@@ -23,7 +23,6 @@ import (
 	"strconv"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
 	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
@@ -31,15 +30,23 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func (config *Config) DeployTasks(newContainerImageTag *string, stage TaskStage, client *ecs.Client) error {
-	clusterSublogger := log.WithFields(log.Fields{"cluster": config.Cluster})
+// watchedTask identifies a task started when running a pre-deployment or
+// post-deployment task.
+type watchedTask struct {
+	family string
+	stage  EventStage
+	taskNo int
+}
+
+func (deployer *Deployer) deployTasks(ctx context.Context, deployment *Deployment, stage TaskStage) error {
+	clusterSublogger := deployment.logger()
 
 	configTasks := []Task{}
 	switch stage {
 	case TaskStagePre:
-		configTasks = config.Tasks.Pre
+		configTasks = deployer.config.Tasks.Pre
 	case TaskStagePost:
-		configTasks = config.Tasks.Post
+		configTasks = deployer.config.Tasks.Post
 	}
 
 	// Get list of tasks to update from the config file but do not proceed if
@@ -50,56 +57,46 @@ func (config *Config) DeployTasks(newContainerImageTag *string, stage TaskStage,
 
 		return nil
 	}
-	clusterSublogger.Infof("starting rollout of %s-deployment tasks", stage)
+	eventStage := taskStageEventStage(stage)
+	deployment.publish(&StageStarted{EventMeta: EventMeta{Type: EventStageStarted, Status: RunningStatus}, Stage: eventStage})
 
 	// Process each service on in parallel to reduce the amount of time spent
 	// rolling them out and evaluate the status to provide a summary report
 	// after. Tasks are short-lived deployment steps that are pre-requisites to
 	// the deployment. It's worth noting that all tasks must complete before the
-	// deployment starts.
-	var (
-		failedCount  = 0
-		skippedCount = 0
-		wg           = sync.WaitGroup{}
-	)
-	for index := range configTasks {
-		wg.Add(1)
-
-		go func(taskConfig *Task) {
-			defer wg.Done()
-
-			status, err := deployTask(&config.Cluster, taskConfig, newContainerImageTag, client, clusterSublogger)
-			if err != nil {
-				if err != nil {
-					switch status {
-					case FailedStatus:
-						failedCount = failedCount + 1
-					case SkippedStatus:
-						skippedCount = skippedCount + 1
-					}
-				}
-			}
-		}(&configTasks[index])
-	}
-	wg.Wait()
-
-	successfulCount := numberOfTasks - (failedCount + skippedCount)
-	clusterSublogger.Infof("tasks report - total: %d, successful: %d, skipped: %d, failed: %d", numberOfTasks, successfulCount, skippedCount, failedCount)
+	// deployment starts. Each task has its own slot for its result so that they
+	// can be collected without any locking.
+	results := make([]itemResult, numberOfTasks)
+	deployer.forEach(numberOfTasks, func(index int) {
+		taskConfig := &configTasks[index]
+
+		status, err := deployer.deployTask(ctx, deployment, eventStage, taskConfig, clusterSublogger)
+		deployment.recordTask(stage, taskConfig.Family, status)
+		if err != nil && status == FailedStatus {
+			deployment.publish(&TaskFailed{EventMeta: EventMeta{Type: EventTaskFailed, Status: FailedStatus}, Stage: eventStage, Task: taskConfig.Family, Message: err.Error()})
+		}
+		results[index] = itemResult{name: taskConfig.Family, status: status, err: err}
+	})
 
-	if failedCount > 0 {
+	stageCompleted := newStageCompleted(eventStage, results)
+	if stageCompleted.Failed > 0 {
 		err := fmt.Errorf("unable to deploy all %s-deployment tasks", stage)
+		stageCompleted.Status = FailedStatus
+		stageCompleted.Message = err.Error()
+		deployment.publish(stageCompleted)
 
 		return err
 	}
 
-	clusterSublogger.Infof("completed rollout of %s-deployment tasks", stage)
+	deployment.publish(stageCompleted)
 
 	return nil
 }
 
-func deployTask(cluster *string, taskConfig *Task, newContainerImageTag *string, client *ecs.Client, logger *log.Entry) (Status, error) {
+func (deployer *Deployer) deployTask(ctx context.Context, deployment *Deployment, stage EventStage, taskConfig *Task, logger *log.Entry) (Status, error) {
 	// Set up new logger with the task family.
 	taskSublogger := logger.WithField("task", taskConfig.Family)
+	cluster := &deployment.Target.Cluster
 
 	// Store information on which containers should be updated.
 	taskContainerUpdateable := make(map[string]bool)
@@ -109,16 +106,30 @@ func deployTask(cluster *string, taskConfig *Task, newContainerImageTag *string,
 
 	// Generate new task definition with the required changes.
 	taskDefinitionInput := GenerateTaskDefinitionInput{
-		ImageTag:             newContainerImageTag,
+		ImageTag:             &deployment.ImageTag,
 		TaskDefinition:       &taskConfig.Family,
 		UpdateableContainers: taskContainerUpdateable,
+		Tags:                 deployment.tags,
+		TaskDefinitionFile:   taskConfig.TaskDefinitionFile,
+		TemplateData:         NewTaskDefinitionTemplateData(deployment.Target.Cluster, deployment.ImageTag),
 	}
-	newTaskDefinition, taskDefinitionUpdated, err := GenerateTaskDefinition(&taskDefinitionInput, client, taskSublogger)
+	newTaskDefinition, taskDefinitionUpdated, err := GenerateTaskDefinition(ctx, &taskDefinitionInput, deployer.client, taskSublogger)
 	if err != nil {
 		taskSublogger.Errorf("error generating task definition")
 
 		return FailedStatus, err
 	}
+	if taskDefinitionUpdated {
+		deployment.recordTaskDefinition(*newTaskDefinition.TaskDefinitionArn)
+		deployment.publish(&TaskDefinitionRegistered{
+			EventMeta:         EventMeta{Type: EventTaskDefinitionRegistered},
+			Stage:             stage,
+			Task:              taskConfig.Family,
+			Family:            *newTaskDefinition.Family,
+			Revision:          newTaskDefinition.Revision,
+			TaskDefinitionArn: *newTaskDefinition.TaskDefinitionArn,
+		})
+	}
 
 	// Prepare parameters for task.
 	taskSublogger.Info("preparing running task parameters")
@@ -189,7 +200,7 @@ func deployTask(cluster *string, taskConfig *Task, newContainerImageTag *string,
 
 	// Starts task(s) using the specified parameters.
 	taskSublogger.Debugf("attempting to run new task, desired count: %d", taskConfig.Count)
-	runTaskResult, err := client.RunTask(context.TODO(), runTaskParams)
+	runTaskResult, err := deployer.client.RunTask(ctx, runTaskParams)
 	if err != nil {
 		taskSublogger.Errorf("unable to run new task, desired count: %d: %v", taskConfig.Count, err)
 
@@ -197,6 +208,23 @@ func deployTask(cluster *string, taskConfig *Task, newContainerImageTag *string,
 	}
 	taskSublogger.Infof("running new task, desired count: %d", taskConfig.Count)
 
+	// Find out where the containers of the task ship their logs to so that they
+	// can be streamed while watching the tasks. All tasks share the same task
+	// definition so this only needs to be done once.
+	logSources := []containerLogSource{}
+	if deployer.taskLogs != nil && len(runTaskResult.Tasks) > 0 {
+		taskSublogger.Debug("fetching task definition profile for container logs")
+		taskDefinitionParams := &ecs.DescribeTaskDefinitionInput{
+			TaskDefinition: runTaskResult.Tasks[0].TaskDefinitionArn,
+		}
+		taskDefinitionResult, err := deployer.client.DescribeTaskDefinition(ctx, taskDefinitionParams)
+		if err != nil {
+			taskSublogger.Warnf("unable to fetch task definition profile, container logs will not be streamed: %v", err)
+		} else {
+			logSources = taskLogSources(taskDefinitionResult.TaskDefinition, taskSublogger)
+		}
+	}
+
 	// Watch each task on its own asynchronously. The number of tasks depends on
 	// the count that was set. All tasks should be watched.
 	numberOfTasks := len(runTaskResult.Tasks)
@@ -209,7 +237,8 @@ func deployTask(cluster *string, taskConfig *Task, newContainerImageTag *string,
 		go func(taskNo int, waitedOnTask types.Task) {
 			defer wg.Done()
 
-			err := watchTask(cluster, &taskNo, &waitedOnTask, client, taskSublogger)
+			watched := &watchedTask{family: taskConfig.Family, stage: stage, taskNo: taskNo}
+			err := deployer.watchTask(ctx, deployment, watched, &waitedOnTask, logSources, taskSublogger)
 			if err != nil {
 				taskWatchErrors <- err
 			}
@@ -220,7 +249,7 @@ func deployTask(cluster *string, taskConfig *Task, newContainerImageTag *string,
 
 	failedCount := len(taskWatchErrors)
 	if failedCount > 0 {
-		err := fmt.Errorf("unable to run all tasks")
+		err := fmt.Errorf("unable to run all tasks, %d of %d failed: %w", failedCount, numberOfTasks, <-taskWatchErrors)
 
 		return FailedStatus, err
 	}
@@ -230,37 +259,67 @@ func deployTask(cluster *string, taskConfig *Task, newContainerImageTag *string,
 	return SucceededStatus, nil
 }
 
-func watchTask(cluster *string, taskNo *int, task *types.Task, client *ecs.Client, logger *log.Entry) error {
-	ticker := time.NewTicker(time.Second * 3).C
+func (deployer *Deployer) watchTask(ctx context.Context, deployment *Deployment, watchedTask *watchedTask, task *types.Task, logSources []containerLogSource, logger *log.Entry) error {
+	taskNo := &watchedTask.taskNo
+
+	// Get task ID from ARN since it's not available.
+	var resourceIDRegex = regexp.MustCompile(`[^:/]*$`)
+	taskID := resourceIDRegex.FindString(*task.TaskArn)
+
+	// Set up new logger with the task identifier.
+	taskSublogger := logger.WithField("task-id", taskID)
+
+	deployment.publish(&TaskStarted{
+		EventMeta:         EventMeta{Type: EventTaskStarted, Status: RunningStatus},
+		Stage:             watchedTask.stage,
+		Task:              watchedTask.family,
+		TaskNo:            *taskNo,
+		TaskID:            taskID,
+		TaskArn:           *task.TaskArn,
+		TaskDefinitionArn: *task.TaskDefinitionArn,
+	})
+
+	// Stream the logs of the containers in the task, if any, for as long as the
+	// task is being watched.
+	var logStreamer *taskLogStreamer
+	if deployer.taskLogs != nil && len(logSources) > 0 {
+		logStreamer = startTaskLogStreamer(ctx, deployer.taskLogs, logSources, deployer.clock, deployer.pollInterval, taskNo, taskID, taskSublogger)
+	}
+	defer logStreamer.stop()
 
+	// Only publish state changes rather than on every check since a task can
+	// stay in the same state for a long time.
+	lastState := ""
 	for {
-		taskParams := &ecs.DescribeTasksInput{
-			Cluster: cluster,
-			Tasks:   []string{*task.TaskArn},
-		}
-		taskResult, err := client.DescribeTasks(context.TODO(), taskParams)
+		task, err := deployer.poller.task(ctx, deployment.Target.Cluster, *task.TaskArn)
 		if err != nil {
-			logger.Errorf("unable to fetch task profile: %v", err)
+			taskSublogger.Errorf("unable to fetch task profile: %v", err)
 
 			return err
 		}
 
 		// If the task is not found or it has been deleted then stop watching
-		// the task. We should also only ever receive one task.
-		if len(taskResult.Tasks) == 0 {
-			logger.Info("stopped watching, task not found")
+		// the task.
+		if task == nil {
+			taskSublogger.Info("stopped watching, task not found")
 
 			break
 		}
-		task := taskResult.Tasks[0]
 
-		// Get task ID from ARN since it's not available.
-		var resourceIDRegex = regexp.MustCompile(`[^:/]*$`)
-		taskID := resourceIDRegex.FindString(*task.TaskArn)
-
-		// Set up new logger with the task identifier.
-		taskSublogger := logger.WithField("task-id", taskID)
-		taskSublogger.Infof("watching task [%d] ... last status: %s, desired status: %s, health: %s", *taskNo, strings.ToLower(*task.LastStatus), strings.ToLower(*task.DesiredStatus), strings.ToLower(string(task.HealthStatus)))
+		state := fmt.Sprintf("%s/%s/%s", *task.LastStatus, *task.DesiredStatus, task.HealthStatus)
+		if state != lastState {
+			deployment.publish(&TaskStateChanged{
+				EventMeta:     EventMeta{Type: EventTaskStateChanged, Status: RunningStatus},
+				Stage:         watchedTask.stage,
+				Task:          watchedTask.family,
+				TaskNo:        *taskNo,
+				TaskID:        taskID,
+				LastStatus:    *task.LastStatus,
+				DesiredStatus: *task.DesiredStatus,
+				HealthStatus:  string(task.HealthStatus),
+			})
+			lastState = state
+		}
 
 		// When a task is started it can pass through several states before it
 		// finishes on its own or is stopped manually. The expectation here is
@@ -295,19 +354,37 @@ func watchTask(cluster *string, taskNo *int, task *types.Task, client *ecs.Clien
 				taskSublogger.Debugf("stopped task [%d] container [%s] ... exit code: %s, reason: %s", *taskNo, containerName, containerExitCode, containerReason)
 			}
 
-			exitMessage := fmt.Sprintf("stopped task [%d], reason: %s", *taskNo, strings.ToLower(string(*task.StoppedReason)))
-			if nonZeroExit {
-				err := fmt.Errorf("prematurely %s", exitMessage)
-				taskSublogger.Error(err)
+			// Catch up with any remaining container logs now that the task has
+			// stopped so that they're part of the report.
+			logStreamer.stop()
+
+			taskStopped := &TaskStopped{
+				EventMeta: EventMeta{Type: EventTaskStopped, Status: SucceededStatus},
+				Stage:     watchedTask.stage,
+				Task:      watchedTask.family,
+				TaskNo:    *taskNo,
+				TaskID:    taskID,
+			}
+			if task.StoppedReason != nil {
+				taskStopped.StoppedReason = *task.StoppedReason
+			}
 
-				return err
+			if nonZeroExit {
+				taskStopped.Status = FailedStatus
+				deployment.publish(taskStopped)
+				logStreamer.report(taskNo, taskSublogger)
+
+				return &ErrTaskFailed{
+					Task:          watchedTask.family,
+					TaskNo:        *taskNo,
+					TaskID:        taskID,
+					StoppedReason: taskStopped.StoppedReason,
+				}
 			}
-			taskSublogger.Infof("successfully %s", exitMessage)
+			deployment.publish(taskStopped)
 
 			break
 		}
-
-		<-ticker
 	}
 
 	return nil
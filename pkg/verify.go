@@ -0,0 +1,268 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultVerifyRetries is how many times a failed check is retried unless
+	// set otherwise.
+	defaultVerifyRetries = 3
+
+	// defaultVerifyTimeout is how long a check can take unless set otherwise.
+	defaultVerifyTimeout = 10 * time.Second
+
+	// maxVerifyBodySize is the most of a response body that's read when
+	// checking it.
+	maxVerifyBodySize = 1 << 20
+)
+
+// verifyHTTPClient makes the requests of the checks, each one is bounded by the
+// check's timeout on its request context.
+var verifyHTTPClient = &http.Client{}
+
+func (verify *Verify) rollback() bool {
+	return verify.Rollback != nil && *verify.Rollback
+}
+
+func (check *VerifyCheck) retries() int {
+	if check.Retries != nil {
+		return *check.Retries
+	}
+
+	return defaultVerifyRetries
+}
+
+func (check *VerifyCheck) timeout() time.Duration {
+	if check.Timeout != nil {
+		return time.Duration(*check.Timeout) * time.Second
+	}
+
+	return defaultVerifyTimeout
+}
+
+// verifyService runs the smoke tests of a service once it's stable. If they
+// fail and rollback is set the service is rolled back to the task definition
+// it used before, either way the service has failed.
+func (deployer *Deployer) verifyService(ctx context.Context, deployment *Deployment, serviceConfig *Service, service *types.Service, serviceSublogger *log.Entry) (Status, error) {
+	serviceSublogger.Info("verifying service")
+	err := deployer.verify(ctx, serviceConfig.Verify, serviceSublogger)
+	deployment.publish(newVerificationCompleted(serviceConfig.Name, err))
+	if err == nil {
+		return SucceededStatus, nil
+	}
+
+	if serviceConfig.Verify.rollback() {
+		serviceSublogger.Infof("rolling back to task definition %s", *service.TaskDefinition)
+
+		var rollbackErr error
+		switch serviceConfig.strategy() {
+		case ServiceStrategyRecreate:
+			_, rollbackErr = deployer.deployRecreate(ctx, deployment, serviceConfig, service, service.TaskDefinition, serviceSublogger)
+		default:
+			_, rollbackErr = deployer.updateService(ctx, deployment, serviceConfig, service, service.TaskDefinition, serviceSublogger)
+		}
+		if rollbackErr != nil {
+			serviceSublogger.Errorf("unable to roll back service: %v", rollbackErr)
+		}
+	}
+
+	return FailedStatus, err
+}
+
+// verifyApplication runs the smoke tests of the application once all the
+// services are stable. If they fail and rollback is set all the services are
+// rolled back to the task definitions they used before.
+func (deployer *Deployer) verifyApplication(ctx context.Context, deployment *Deployment) error {
+	clusterSublogger := deployment.logger()
+
+	clusterSublogger.Info("verifying application")
+	err := deployer.verify(ctx, deployer.config.Verify, clusterSublogger)
+	deployment.publish(newVerificationCompleted("", err))
+	if err == nil {
+		return nil
+	}
+
+	previousTaskDefinitions := deployment.PreviousTaskDefinitions()
+	if deployer.config.Verify.rollback() && len(previousTaskDefinitions) > 0 {
+		clusterSublogger.Info("rolling back services")
+
+		// The deployment already holds the lock, taking it again through
+		// Rollback would release it as soon as the rollback is done.
+		serviceConfigs := []*Service{}
+		for index := range deployer.config.Services {
+			serviceConfig := &deployer.config.Services[index]
+			if _, ok := previousTaskDefinitions[serviceConfig.Name]; ok {
+				serviceConfigs = append(serviceConfigs, serviceConfig)
+			}
+		}
+		_, rollbackErr := deployer.rollback(ctx, deployment.Target, serviceConfigs, previousTaskDefinitions)
+		if rollbackErr != nil {
+			clusterSublogger.Errorf("unable to roll back services: %v", rollbackErr)
+		}
+	}
+
+	return err
+}
+
+// verify runs the checks one after the other, stopping at the first one that
+// still fails after being retried.
+func (deployer *Deployer) verify(ctx context.Context, verify *Verify, logger *log.Entry) error {
+	for index := range verify.Checks {
+		check := &verify.Checks[index]
+		checkSublogger := logger.WithField("check", check.URL)
+
+		var err error
+		for attempt := 0; attempt <= check.retries(); attempt++ {
+			if attempt > 0 {
+				checkSublogger.Warnf("check failed, retrying [%d/%d]: %v", attempt, check.retries(), err)
+
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-deployer.clock.After(deployer.pollInterval):
+				}
+			}
+
+			err = check.run(ctx)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return &ErrVerificationFailed{URL: check.URL, Reason: err.Error()}
+		}
+		checkSublogger.Debug("check passed")
+	}
+
+	return nil
+}
+
+// run makes the request and checks the response against what's expected.
+func (check *VerifyCheck) run(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, check.timeout())
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, check.URL, nil)
+	if err != nil {
+		return err
+	}
+	for name, value := range check.Headers {
+		request.Header.Set(name, value)
+	}
+
+	response, err := verifyHTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxVerifyBodySize))
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case check.Status != nil && response.StatusCode != *check.Status:
+		return fmt.Errorf("expected status %d, got %d", *check.Status, response.StatusCode)
+	case check.Status == nil && (response.StatusCode < 200 || response.StatusCode > 299):
+		return fmt.Errorf("expected successful status, got %d", response.StatusCode)
+	}
+
+	if check.Body != nil && !strings.Contains(string(body), *check.Body) {
+		return fmt.Errorf("expected body to contain %q", *check.Body)
+	}
+
+	if check.JSONPath != nil {
+		value, err := jsonPathValue(body, *check.JSONPath)
+		if err != nil {
+			return err
+		}
+
+		if value != *check.JSONValue {
+			return fmt.Errorf("expected %s to be %q, got %q", *check.JSONPath, *check.JSONValue, value)
+		}
+	}
+
+	return nil
+}
+
+// jsonPathValue looks up the value at a path like `$.data.items.0.status` in
+// a JSON document. Strings are returned as is while anything else is returned
+// as JSON.
+func jsonPathValue(document []byte, path string) (string, error) {
+	var value interface{}
+	err := json.Unmarshal(document, &value)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse body as json: %v", err)
+	}
+
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if path != "" {
+		for _, key := range strings.Split(path, ".") {
+			switch current := value.(type) {
+			case map[string]interface{}:
+				value = current[key]
+			case []interface{}:
+				index, err := strconv.Atoi(key)
+				if err != nil || index < 0 || index >= len(current) {
+					return "", fmt.Errorf("no index %s in %s", key, path)
+				}
+				value = current[index]
+			default:
+				return "", fmt.Errorf("no key %s in %s", key, path)
+			}
+		}
+	}
+
+	if text, ok := value.(string); ok {
+		return text, nil
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	return string(encoded), nil
+}
+
+func newVerificationCompleted(service string, err error) *VerificationCompleted {
+	verificationCompleted := &VerificationCompleted{
+		EventMeta: EventMeta{Type: EventVerificationCompleted, Status: SucceededStatus},
+		Service:   service,
+	}
+	if err != nil {
+		verificationCompleted.Status = FailedStatus
+		verificationCompleted.Message = err.Error()
+	}
+
+	return verificationCompleted
+}
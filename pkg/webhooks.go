@@ -0,0 +1,301 @@
+/*
+Copyright 2023 King'ori Maina
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// WebhookEventHeader is the header that carries the type of the event.
+	WebhookEventHeader = "X-Ecs-Toolkit-Event"
+
+	// WebhookSignatureHeader is the header that carries the HMAC-SHA256
+	// signature of the payload, hex encoded and prefixed with `sha256=`.
+	WebhookSignatureHeader = "X-Ecs-Toolkit-Signature"
+)
+
+// webhookDefaultEvents are the events sent to a webhook that doesn't list the
+// events it's interested in, the rest are too chatty for most webhooks.
+var webhookDefaultEvents = []EventType{
+	EventDeploymentStarted,
+	EventDeploymentFinished,
+	EventStageStarted,
+	EventStageCompleted,
+	EventServiceStable,
+	EventTaskFailed,
+	EventCanaryStarted,
+	EventCanaryPromoted,
+	EventCanaryAborted,
+	EventVerificationCompleted,
+}
+
+// webhookFormats are the built-in payload templates, `json` sends the event as
+// is while the others target chat incoming webhooks.
+var webhookFormats = map[string]string{
+	"json":  `{{ json . }}`,
+	"slack": `{"text": {{ json .Summary }}}`,
+	"teams": `{"@type": "MessageCard", "@context": "https://schema.org/extensions", "summary": {{ json .Summary }}, "themeColor": {{ json .Color }}, "text": {{ json .Summary }}}`,
+}
+
+// WebhookNotifier posts the events of a deployment to a webhook. Events are
+// delivered one at a time in the order they were emitted, without holding up
+// the deployment. Events are dropped rather than waited on if the webhook
+// falls too far behind.
+type WebhookNotifier struct {
+	client   *http.Client
+	clock    Clock
+	closed   bool
+	done     chan struct{}
+	events   map[EventType]bool
+	headers  map[string]string
+	logger   *log.Entry
+	mutex    sync.RWMutex
+	queue    chan DeploymentEvent
+	retries  int
+	secret   string
+	template *template.Template
+	url      string
+}
+
+// WebhookNotifierOption configures a webhook notifier.
+type WebhookNotifierOption func(notifier *WebhookNotifier)
+
+// WithWebhookClock sets the clock that paces retries. Defaults to the system
+// clock.
+func WithWebhookClock(clock Clock) WebhookNotifierOption {
+	return func(notifier *WebhookNotifier) {
+		notifier.clock = clock
+	}
+}
+
+// NewWebhookNotifier sets up delivery of events to the webhook. Environment
+// variables referenced in the URL, headers and secret e.g. `${SLACK_URL}` are
+// expanded so that they don't have to be committed.
+func NewWebhookNotifier(webhook *Webhook, options ...WebhookNotifierOption) (*WebhookNotifier, error) {
+	webhookURL := os.ExpandEnv(webhook.URL)
+	parsedURL, err := url.Parse(webhookURL)
+	if err != nil || parsedURL.Host == "" {
+		return nil, fmt.Errorf("invalid webhook url %s", webhook.URL)
+	}
+
+	format := "json"
+	if webhook.Format != nil {
+		format = *webhook.Format
+	}
+	templateText := webhookFormats[format]
+	if webhook.Template != nil {
+		templateText = *webhook.Template
+	}
+	payloadTemplate, err := template.New("payload").Funcs(template.FuncMap{"json": templateJSON}).Parse(templateText)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook template: %w", err)
+	}
+
+	timeout := 10 * time.Second
+	if webhook.Timeout != nil {
+		timeout = time.Duration(*webhook.Timeout) * time.Second
+	}
+
+	notifier := &WebhookNotifier{
+		client:   &http.Client{Timeout: timeout},
+		clock:    systemClock{},
+		done:     make(chan struct{}),
+		events:   map[EventType]bool{},
+		headers:  map[string]string{},
+		logger:   log.WithField("webhook", parsedURL.Host),
+		queue:    make(chan DeploymentEvent, 256),
+		retries:  3,
+		template: payloadTemplate,
+		url:      webhookURL,
+	}
+
+	for _, eventType := range webhook.Events {
+		notifier.events[EventType(eventType)] = true
+	}
+
+	if len(notifier.events) == 0 {
+		for _, eventType := range webhookDefaultEvents {
+			notifier.events[eventType] = true
+		}
+	}
+
+	for name, value := range webhook.Headers {
+		notifier.headers[name] = os.ExpandEnv(value)
+	}
+
+	if webhook.MaxRetries != nil {
+		notifier.retries = *webhook.MaxRetries
+	}
+
+	if webhook.Secret != nil {
+		notifier.secret = os.ExpandEnv(*webhook.Secret)
+	}
+
+	for _, option := range options {
+		option(notifier)
+	}
+
+	go notifier.deliver()
+
+	return notifier, nil
+}
+
+// Observe queues the event for delivery if the webhook is interested in it.
+// The event is dropped if the queue is full or the notifier has been closed.
+func (notifier *WebhookNotifier) Observe(event DeploymentEvent) {
+	eventType := event.Meta().Type
+	if !notifier.events[eventType] {
+		return
+	}
+
+	notifier.mutex.RLock()
+	defer notifier.mutex.RUnlock()
+
+	if notifier.closed {
+		notifier.logger.WithField("event", eventType).Warn("dropping webhook event, notifier is closed")
+
+		return
+	}
+
+	select {
+	case notifier.queue <- event:
+	default:
+		notifier.logger.WithField("event", eventType).Warn("dropping webhook event, delivery is falling behind")
+	}
+}
+
+// Close waits for all queued events to be delivered, events observed after
+// closing are dropped. It's safe to call more than once.
+func (notifier *WebhookNotifier) Close() {
+	notifier.mutex.Lock()
+	if !notifier.closed {
+		notifier.closed = true
+		close(notifier.queue)
+	}
+	notifier.mutex.Unlock()
+
+	<-notifier.done
+}
+
+func (notifier *WebhookNotifier) deliver() {
+	defer close(notifier.done)
+
+	for event := range notifier.queue {
+		eventSublogger := notifier.logger.WithField("event", event.Meta().Type)
+
+		payload := bytes.Buffer{}
+		err := notifier.template.Execute(&payload, event)
+		if err != nil {
+			eventSublogger.Warnf("unable to render webhook payload: %v", err)
+
+			continue
+		}
+
+		err = notifier.post(event, payload.Bytes(), eventSublogger)
+		if err != nil {
+			eventSublogger.Warnf("unable to deliver webhook: %v", err)
+		}
+	}
+}
+
+// post sends the payload to the webhook, retrying with an exponential backoff
+// on network errors, throttling and server errors.
+func (notifier *WebhookNotifier) post(event DeploymentEvent, payload []byte, logger *log.Entry) error {
+	var err error
+	backoff := time.Second
+
+	for attempt := 0; attempt <= notifier.retries; attempt++ {
+		if attempt > 0 {
+			logger.Debugf("retrying webhook delivery in %s, attempt %d of %d", backoff, attempt, notifier.retries)
+			<-notifier.clock.After(backoff)
+
+			backoff = backoff * 2
+			if backoff > 30*time.Second {
+				backoff = 30 * time.Second
+			}
+		}
+
+		var retryable bool
+		retryable, err = notifier.postOnce(event, payload)
+		if err == nil {
+			logger.Debug("delivered webhook")
+
+			return nil
+		}
+
+		if !retryable {
+			return err
+		}
+	}
+
+	return err
+}
+
+func (notifier *WebhookNotifier) postOnce(event DeploymentEvent, payload []byte) (bool, error) {
+	request, err := http.NewRequest(http.MethodPost, notifier.url, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "ecs-toolkit")
+	request.Header.Set(WebhookEventHeader, string(event.Meta().Type))
+	for name, value := range notifier.headers {
+		request.Header.Set(name, value)
+	}
+
+	if notifier.secret != "" {
+		mac := hmac.New(sha256.New, []byte(notifier.secret))
+		mac.Write(payload)
+		request.Header.Set(WebhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	response, err := notifier.client.Do(request)
+	if err != nil {
+		return true, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return false, nil
+	}
+
+	err = fmt.Errorf("unexpected response status %s", response.Status)
+	retryable := response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500
+
+	return retryable, err
+}
+
+func templateJSON(value interface{}) (string, error) {
+	encoded, err := json.Marshal(value)
+
+	return string(encoded), err
+}
@@ -17,14 +17,28 @@ limitations under the License.
 package utils
 
 import (
+	"os"
+	"sync"
+
 	log "github.com/sirupsen/logrus"
 )
 
 var (
+	// LogFormats is a list of valid log formats.
+	LogFormats = []string{"text", "json", "logfmt"}
+
 	// LogLevels is a list of valid log levels.
 	LogLevels = []string{"trace", "debug", "info", "warn", "error", "fatal", "panic"}
 )
 
+// logFileHook writes every log entry to a file in its own format, separately
+// from the console.
+type logFileHook struct {
+	file      *os.File
+	formatter log.Formatter
+	mutex     sync.Mutex
+}
+
 // SetLogLevel sets the level at which to log messages.
 func SetLogLevel(level string) {
 	switch level {
@@ -48,3 +62,62 @@ func SetLogLevel(level string) {
 
 	log.Debugf("log level set to %s", level)
 }
+
+// SetLogFormat sets the format of the messages logged to the console.
+func SetLogFormat(format string) {
+	log.SetFormatter(LogFormatter(format))
+}
+
+// AddLogFile logs messages to the file as well as the console, in the given
+// format. The file is appended to if it already exists.
+func AddLogFile(path string, format string) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Fatalf("unable to open log file %s: %v", path, err)
+	}
+
+	// Colors only make sense in a terminal.
+	formatter := LogFormatter(format)
+	if textFormatter, ok := formatter.(*log.TextFormatter); ok {
+		textFormatter.DisableColors = true
+	}
+
+	log.AddHook(&logFileHook{file: file, formatter: formatter})
+	log.Debugf("logging to %s file in %s format", path, format)
+}
+
+// LogFormatter returns the formatter for the format. Unlike `text`, which
+// only uses key=value pairs when not logging to a terminal, `logfmt` always
+// does.
+func LogFormatter(format string) log.Formatter {
+	switch format {
+	case "text":
+		return &log.TextFormatter{}
+	case "json":
+		return &log.JSONFormatter{}
+	case "logfmt":
+		return &log.TextFormatter{DisableColors: true, FullTimestamp: true}
+	default:
+		log.Fatal("invalid logging format")
+	}
+
+	return nil
+}
+
+func (hook *logFileHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (hook *logFileHook) Fire(entry *log.Entry) error {
+	line, err := hook.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+
+	hook.mutex.Lock()
+	defer hook.mutex.Unlock()
+
+	_, err = hook.file.Write(line)
+
+	return err
+}